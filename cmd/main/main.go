@@ -1,11 +1,16 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/mumoshu/flux-repo/pkg/encrypt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mumoshu/flux-repo/pkg/fluxrepo"
 )
@@ -18,6 +23,16 @@ Usage:
 Available Commands:
   write		Produces sanitized Kubernetes manifests by extracting secrets data into a secrets store
   read		Reads sanitized Kubernetes manifests and writes raw manifests for apply
+  decrypt	Decrypts manifests encrypted by "write -encrypt" and writes raw manifests
+  rotate-keys	Adds and removes master keys and rotates data keys of all the SOPS-encrypted files
+  prune		Deletes old backend versions no longer referenced from sanitized Kubernetes manifests
+  migrate	Moves secrets referenced from sanitized Kubernetes manifests to another backend and rewrites the refs
+  rotate	Generates a new value for a secret data key and rewrites the refs to it
+  scan		Reports likely plaintext secrets in Kubernetes manifests
+  verify	Checks that every ref in sanitized Kubernetes manifests resolves
+  hook		Installs the git pre-commit hook that runs check-staged
+  check-staged	Blocks a git commit containing plaintext secrets or unexpected refs
+  config	Validates the project config file
 
 Use "flux-repo [command] --help" for more information about a command
 `
@@ -35,37 +50,43 @@ func main() {
 
 	CmdWrite := "write"
 	CmdRead := "read"
+	CmdDecrypt := "decrypt"
+	CmdRotateKeys := "rotate-keys"
+	CmdPrune := "prune"
+	CmdMigrate := "migrate"
+	CmdRotate := "rotate"
+	CmdScan := "scan"
+	CmdVerify := "verify"
+	CmdHook := "hook"
+	CmdCheckStaged := "check-staged"
+	CmdConfig := "config"
 
 	if len(os.Args) == 1 {
 		flag.Usage()
 		return
 	}
 
+	ctx := signalContext()
+
 	switch os.Args[1] {
 	case CmdWrite:
-		b := backends{}
-		var awsOpts fluxrepo.AWSOptions
-
 		writeCmd := flag.NewFlagSet(CmdWrite, flag.ExitOnError)
 		secretPath := writeCmd.String("p", "", "Path to the secret stored in the secrets store")
 		fsPath := writeCmd.String("f", "-", "YAML/JSON file or directory to be decoded")
 		outputDir := writeCmd.String("o", "", "The output directory")
-		secretBackend := writeCmd.String("b", "awssecrets", "The name of secret provider backend to use")
+		secretBackend := writeCmd.String("b", "awssecrets", backendFlagUsage())
 
 		doEncrypt := writeCmd.Bool("encrypt", false, "Encrypt files instead of replacing secret values with refs")
+		routesFile := writeCmd.String("routes", "", "Path to the routing config file that maps secrets to backends and paths. -b and -p are ignored when this is set")
+		output := writeCmd.String("output", "text", "The output format. One of: text, json. json prints every written file and sanitized secret with its ref, backend, path and version")
+		defaultNamespace := writeCmd.String("default-namespace", fluxrepo.DefaultNamespace, "The namespace Secrets without metadata.namespace are saved under")
+		namespaceFromKustomization := writeCmd.Bool("namespace-from-kustomization", false, "Save Secrets without metadata.namespace under the namespace set by the nearest kustomization.yaml. -default-namespace is used when there's none, or it doesn't set the namespace")
+		doChecksum := writeCmd.Bool("checksum", false, "Annotate sanitized Secrets with the salted checksum of their data. The salt is read from the envvar named by -checksum-salt-env")
+		checksumSaltEnv := writeCmd.String("checksum-salt-env", "FLUX_REPO_CHECKSUM_SALT", "The name of envvar to obtain the salt of checksums from. Keep the salt secret and unchanged, so that checksums change only when secret data changes")
+		checksumWorkloads := writeCmd.Bool("checksum-workloads", false, "Annotate the pod templates of the workloads referencing the sanitized Secrets with the checksum of their data, so that they're rolled out when it changes. Implies -checksum")
 
-		writeCmd.StringVar(&awsOpts.Region, "aws-region", "", "AWS region to be used in aws-sdk")
-		writeCmd.StringVar(&awsOpts.Profile, "aws-profile", "", "AWS profile to be used in aws-sdk")
-
-		writeCmd.StringVar(&b.sops.KMSKeyARN, "aws-kms-key-arn", "", "Comma-separated list of KMS Key ARNs to the list of master keys on the given file")
-		writeCmd.StringVar(&b.sops.EncryptionContext, "aws-kms-encryption-context", "", "Comma-separated list of KMS encryption context key:value pairs")
-
-		writeCmd.StringVar(&b.vault.AuthMethod, "vault-auth-method", "", "Auth method for Vault. Use \"token\" or \"approle\"")
-		writeCmd.StringVar(&b.vault.Address, "vault-address", "", "The address of Vault API server")
-		writeCmd.StringVar(&b.vault.TokenFile, "vault-token-file", "", "The Vault token file for authentication")
-		writeCmd.StringVar(&b.vault.TokenEnv, "vault-token-env", "VAULT_TOKEN", "The name of envvar to obtain Vault token from")
-		writeCmd.StringVar(&b.vault.RoleID, "vault-approle-role-id", "", "Vault role_id for \"appauth\" authentication. Used only when -vault-auth-method is \"approle\" ")
-		writeCmd.StringVar(&b.vault.SecretID, "vault-approle-secret-id", "", "Vault secret_id for \"appauth\" authentication. Used only when -vault-auth-method is \"approle\" ")
+		backendOpts := addBackendFlags(writeCmd)
+		project := addProjectFlags(writeCmd)
 
 		_ = writeCmd.String("r", "", "The config repo to be updated with the sanitized manifests")
 
@@ -78,34 +99,101 @@ func main() {
 			fatal("%v", err)
 		}
 
-		var info *fluxrepo.WriteInfo
+		if *output != "text" && *output != "json" {
+			fatal("unsupported output format: %s", *output)
+		}
+
+		settings, err := project.load(backendOpts)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		if settings.Backend != "" && !project.isSet("b") {
+			*secretBackend = settings.Backend
+		}
+		if settings.Path != "" && !project.isSet("p") {
+			*secretPath = settings.Path
+		}
+		if settings.Input != "" && !project.isSet("f") {
+			*fsPath = settings.Input
+		}
+		if settings.Output != "" && !project.isSet("o") {
+			*outputDir = settings.Output
+		}
+		if settings.Encrypt != nil && !project.isSet("encrypt") {
+			*doEncrypt = *settings.Encrypt
+		}
+
+		var routingConfig *fluxrepo.RoutingConfig
+
+		if *routesFile != "" {
+			routingConfig, err = fluxrepo.LoadRoutingConfig(*routesFile)
+			if err != nil {
+				fatal("%v", err)
+			}
+		} else if len(settings.Routes) > 0 && !project.isSet("b") && !project.isSet("p") {
+			routingConfig = &fluxrepo.RoutingConfig{Routes: settings.Routes}
+		}
+
+		if routingConfig != nil {
+			routingConfig.Environment = *project.env
+		}
+
+		writeOpts := fluxrepo.WriteOptions{
+			Input:                      *fsPath,
+			Output:                     *outputDir,
+			DefaultNamespace:           *defaultNamespace,
+			NamespaceFromKustomization: *namespaceFromKustomization,
+			ChecksumWorkloads:          *checksumWorkloads,
+		}
+
+		if *doChecksum || *checksumWorkloads {
+			writeOpts.ChecksumSalt = os.Getenv(*checksumSaltEnv)
+			if writeOpts.ChecksumSalt == "" {
+				fatal("-checksum requires the salt in the envvar %s", *checksumSaltEnv)
+			}
+		}
 
 		if *doEncrypt {
 			sop := &encrypt.Sops{
-				KMS:               b.sops.KMSKeyARN,
-				EncryptionContext: b.sops.EncryptionContext,
-				AWSProfile:        b.sops.Profile,
+				KMS:               backendOpts.Get("aws-kms-key-arn"),
+				EncryptionContext: backendOpts.Get("aws-kms-encryption-context"),
+				AWSProfile:        backendOpts.Get("aws-profile"),
 			}
 
-			var err error
-
 			sop.EncryptedRegex = "^(data|stringData)$"
-			info, err = fluxrepo.FilterWithSops(sop, outputDir, fsPath)
+			writeOpts.Sops = sop
+		} else if routingConfig != nil {
+			writeOpts.Router, err = fluxrepo.NewRouter(routingConfig, backendOpts)
 			if err != nil {
 				fatal("%v", err)
 			}
 		} else {
-			backend, err := createBackend(secretBackend, &awsOpts, b, secretPath)
+			writeOpts.Backend, err = fluxrepo.NewBackend(*secretBackend, *secretPath, backendOpts)
 			if err != nil {
 				fatal("%v", err)
 			}
+		}
 
-			info, err = fluxrepo.Write(backend, outputDir, fsPath)
-			if err != nil {
+		info, err := fluxrepo.WriteContext(ctx, writeOpts)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		for _, w := range info.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+		}
+
+		if *output == "json" {
+			if err := printJSON(info); err != nil {
 				fatal("%v", err)
 			}
+			return
 		}
 
+		for _, f := range info.Files {
+			fmt.Printf("Wrote %s to %s\n", f.Input, f.Output)
+		}
 		fmt.Printf("Wrote to %s\n", info.Dir)
 		if *outputDir == "" {
 			fmt.Println("Add command-line option `-o DIR` to change the output directory")
@@ -113,7 +201,10 @@ func main() {
 	case CmdRead:
 		readCmd := flag.NewFlagSet(CmdRead, flag.ExitOnError)
 
-		if len(os.Args) != 3 {
+		backendOpts := addBackendFlags(readCmd)
+		project := addProjectFlags(readCmd)
+
+		if len(os.Args) < 3 {
 			flag.Usage()
 			return
 		}
@@ -122,72 +213,723 @@ func main() {
 			fatal("%v", err)
 		}
 
-		f := os.Args[2]
+		if _, err := project.load(backendOpts); err != nil {
+			fatal("%v", err)
+		}
+
+		if readCmd.NArg() != 1 {
+			flag.Usage()
+			return
+		}
+
+		f := readCmd.Arg(0)
+
+		if err := fluxrepo.ReadContext(ctx, fluxrepo.ReadOptions{Input: f, BackendOptions: backendOpts}); err != nil {
+			fatal("%v", err)
+		}
+	case CmdDecrypt:
+		decryptCmd := flag.NewFlagSet(CmdDecrypt, flag.ExitOnError)
+		fsPath := decryptCmd.String("f", "", "YAML/JSON file or directory to be decrypted")
+		outputDir := decryptCmd.String("o", "", "The output directory")
+		awsProfile := decryptCmd.String("aws-profile", "", "AWS profile to be used for KMS master keys that have no profile recorded")
+
+		if len(os.Args) < 3 {
+			flag.Usage()
+			return
+		}
+
+		if err := decryptCmd.Parse(os.Args[2:]); err != nil {
+			fatal("%v", err)
+		}
+
+		if *fsPath == "" {
+			fatal("missing input file or directory. Specify it with `-f PATH`")
+		}
+
+		sop := &encrypt.Sops{
+			AWSProfile: *awsProfile,
+		}
+
+		info, err := fluxrepo.DecryptContext(ctx, fluxrepo.WriteOptions{Sops: sop, Input: *fsPath, Output: *outputDir})
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		fmt.Printf("Wrote to %s\n", info.Dir)
+		if *outputDir == "" {
+			fmt.Println("Add command-line option `-o DIR` to change the output directory")
+		}
+	case CmdRotateKeys:
+		rotateKeysCmd := flag.NewFlagSet(CmdRotateKeys, flag.ExitOnError)
+		fsPath := rotateKeysCmd.String("f", "", "SOPS-encrypted file or directory to be re-keyed. Directories are walked recursively")
+		awsProfile := rotateKeysCmd.String("aws-profile", "", "AWS profile to be used in aws-sdk")
+		encryptionContext := rotateKeysCmd.String("aws-kms-encryption-context", "", "Comma-separated list of KMS encryption context key:value pairs for the added master keys")
+
+		var opts encrypt.RekeyOptions
+
+		rotateKeysCmd.StringVar(&opts.AddKMS, "add-aws-kms-key-arn", "", "Comma-separated list of KMS Key ARNs to be added to the master keys")
+		rotateKeysCmd.StringVar(&opts.RemoveKMS, "remove-aws-kms-key-arn", "", "Comma-separated list of KMS Key ARNs to be removed from the master keys")
+		rotateKeysCmd.BoolVar(&opts.RotateDataKey, "rotate-data-key", false, "Generate a new data key and re-encrypt all the values with it. Always done when a master key is removed")
+
+		if len(os.Args) < 3 {
+			flag.Usage()
+			return
+		}
+
+		if err := rotateKeysCmd.Parse(os.Args[2:]); err != nil {
+			fatal("%v", err)
+		}
+
+		if *fsPath == "" {
+			fatal("missing input file or directory. Specify it with `-f PATH`")
+		}
+
+		sop := &encrypt.Sops{
+			EncryptionContext: *encryptionContext,
+			AWSProfile:        *awsProfile,
+		}
+
+		results, err := fluxrepo.RotateKeysWithSops(sop, *fsPath, opts)
+
+		for _, r := range results {
+			if !r.Changed() {
+				fmt.Printf("Unchanged %s\n", r.Path)
+				continue
+			}
+
+			fmt.Printf("Re-keyed %s\n", r.Path)
+			for _, k := range r.AddedKeys {
+				fmt.Printf("  added master key %s\n", k)
+			}
+			for _, k := range r.RemovedKeys {
+				fmt.Printf("  removed master key %s\n", k)
+			}
+			if r.DataKeyRotated {
+				fmt.Println("  rotated data key")
+			}
+		}
+
+		if err != nil {
+			fatal("%v", err)
+		}
+	case CmdPrune:
+		pruneCmd := flag.NewFlagSet(CmdPrune, flag.ExitOnError)
+
+		var opts fluxrepo.PruneOptions
+
+		pruneCmd.BoolVar(&opts.GitHistory, "git-history", false, "Keep versions referenced from any commit in the git history of the directory, too")
+		pruneCmd.DurationVar(&opts.Retention, "retention", 30*24*time.Hour, "Unreferenced versions younger than this are kept")
+		pruneCmd.BoolVar(&opts.DryRun, "dry-run", false, "Print versions to be pruned without pruning them")
+
+		opts.BackendOptions = addBackendFlags(pruneCmd)
+		project := addProjectFlags(pruneCmd)
+
+		if len(os.Args) < 3 {
+			flag.Usage()
+			return
+		}
+
+		if err := pruneCmd.Parse(os.Args[2:]); err != nil {
+			fatal("%v", err)
+		}
+
+		if _, err := project.load(opts.BackendOptions); err != nil {
+			fatal("%v", err)
+		}
+
+		if pruneCmd.NArg() != 1 {
+			flag.Usage()
+			return
+		}
+
+		results, err := fluxrepo.Prune(ctx, pruneCmd.Arg(0), opts)
+
+		action := "pruned"
+		if opts.DryRun {
+			action = "would prune"
+		}
+
+		for _, r := range results {
+			fmt.Printf("%s %s\n", r.Backend, r.Path)
+			if !r.Supported {
+				fmt.Printf("  skipped: %s\n", r.Unsupported)
+				continue
+			}
+			for _, v := range r.Referenced {
+				fmt.Printf("  referenced %s\n", v)
+			}
+			for _, v := range r.Retained {
+				fmt.Printf("  retained %s created at %s\n", v.ID, v.Created.Format(time.RFC3339))
+			}
+			for _, v := range r.Pruned {
+				fmt.Printf("  %s %s created at %s\n", action, v.ID, v.Created.Format(time.RFC3339))
+			}
+		}
+
+		if err != nil {
+			fatal("%v", err)
+		}
+	case CmdMigrate:
+		migrateCmd := flag.NewFlagSet(CmdMigrate, flag.ExitOnError)
+		fromDir := migrateCmd.String("from-dir", "", "The directory containing sanitized Kubernetes manifests. Refs in the files are rewritten in place")
+		toBackend := migrateCmd.String("to-backend", "", backendFlagUsage()+". Secrets are moved into this backend")
+		secretPath := migrateCmd.String("p", "", "Path to the secret stored in the target secrets store")
+
+		backendOpts := addBackendFlags(migrateCmd)
+		project := addProjectFlags(migrateCmd)
+
+		if len(os.Args) < 3 {
+			flag.Usage()
+			return
+		}
+
+		if err := migrateCmd.Parse(os.Args[2:]); err != nil {
+			fatal("%v", err)
+		}
+
+		if _, err := project.load(backendOpts); err != nil {
+			fatal("%v", err)
+		}
+
+		if *fromDir == "" || *toBackend == "" {
+			fatal("migrate: both -from-dir and -to-backend are required")
+		}
+
+		backend, err := fluxrepo.NewBackend(*toBackend, *secretPath, backendOpts)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		info, err := fluxrepo.Migrate(ctx, *fromDir, fluxrepo.MigrateOptions{Target: backend, BackendOptions: backendOpts})
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		for _, f := range info.Files {
+			fmt.Printf("Rewrote %s\n", f)
+		}
+		fmt.Printf("Migrated %d refs to %s\n", info.Refs, *toBackend)
+	case CmdRotate:
+		rotateCmd := flag.NewFlagSet(CmdRotate, flag.ExitOnError)
+		fsPath := rotateCmd.String("f", ".", "The directory containing sanitized Kubernetes manifests. Refs to the rotated keys are rewritten in place")
+		generator := rotateCmd.String("generator", "random:32", "The generator of the new value. One of:\n"+fluxrepo.GeneratorUsage)
+		checksumSaltEnv := rotateCmd.String("checksum-salt-env", "FLUX_REPO_CHECKSUM_SALT", "The name of envvar to obtain the salt of checksums from. Required for rotating Secrets written with -checksum, so that the checksums are updated")
+
+		var opts fluxrepo.RotateOptions
+
+		opts.BackendOptions = addBackendFlags(rotateCmd)
+		project := addProjectFlags(rotateCmd)
+
+		if len(os.Args) < 3 {
+			flag.Usage()
+			return
+		}
+
+		if err := rotateCmd.Parse(os.Args[2:]); err != nil {
+			fatal("%v", err)
+		}
+
+		if _, err := project.load(opts.BackendOptions); err != nil {
+			fatal("%v", err)
+		}
+
+		if rotateCmd.NArg() != 1 {
+			fatal("rotate: specify exactly one secret data key to rotate in the form of NAMESPACE/NAME/KEY")
+		}
+
+		var err error
+
+		opts.Generator, err = fluxrepo.ParseGenerator(*generator)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		opts.ChecksumSalt = os.Getenv(*checksumSaltEnv)
+
+		info, err := fluxrepo.Rotate(ctx, *fsPath, rotateCmd.Arg(0), opts)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		for _, k := range info.Keys {
+			fmt.Printf("Rotated %s: %s\n", k, info.Refs[k])
+		}
+		for _, f := range info.Files {
+			fmt.Printf("Rewrote %s\n", f)
+		}
+	case CmdScan:
+		scanCmd := flag.NewFlagSet(CmdScan, flag.ExitOnError)
+		output := scanCmd.String("output", "text", "The output format. One of: text, json, sarif")
+		allowlistFile := scanCmd.String("allowlist", "", "Path to the YAML file of findings to be ignored")
+
+		var opts fluxrepo.ScanOptions
+
+		scanCmd.Float64Var(&opts.MinEntropy, "min-entropy", 4.0, "Strings with the Shannon entropy in bits per character above this are reported as high-entropy")
+		scanCmd.IntVar(&opts.MinLength, "min-length", 20, "Strings shorter than this are never reported as high-entropy")
+
+		if len(os.Args) < 3 {
+			flag.Usage()
+			return
+		}
 
-		if err := fluxrepo.Read(f); err != nil {
+		if err := scanCmd.Parse(os.Args[2:]); err != nil {
 			fatal("%v", err)
 		}
+
+		if scanCmd.NArg() != 1 {
+			flag.Usage()
+			return
+		}
+
+		if *allowlistFile != "" {
+			allowlist, err := fluxrepo.LoadScanAllowlist(*allowlistFile)
+			if err != nil {
+				fatal("%v", err)
+			}
+
+			opts.Allowlist = allowlist
+		}
+
+		findings, err := fluxrepo.Scan(scanCmd.Arg(0), opts)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		switch *output {
+		case "text":
+			err = fluxrepo.WriteScanFindingsText(os.Stdout, findings)
+		case "json":
+			err = fluxrepo.WriteScanFindingsJSON(os.Stdout, findings)
+		case "sarif":
+			err = fluxrepo.WriteScanFindingsSARIF(os.Stdout, findings)
+		default:
+			fatal("unsupported output format: %s", *output)
+		}
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		if len(findings) > 0 {
+			os.Exit(1)
+		}
+	case CmdVerify:
+		verifyCmd := flag.NewFlagSet(CmdVerify, flag.ExitOnError)
+		output := verifyCmd.String("output", "text", "The output format. One of: text, json")
+
+		var opts fluxrepo.VerifyOptions
+
+		opts.BackendOptions = addBackendFlags(verifyCmd)
+		project := addProjectFlags(verifyCmd)
+
+		if len(os.Args) < 3 {
+			flag.Usage()
+			return
+		}
+
+		if err := verifyCmd.Parse(os.Args[2:]); err != nil {
+			fatal("%v", err)
+		}
+
+		if *output != "text" && *output != "json" {
+			fatal("unsupported output format: %s", *output)
+		}
+
+		if _, err := project.load(opts.BackendOptions); err != nil {
+			fatal("%v", err)
+		}
+
+		if verifyCmd.NArg() != 1 {
+			flag.Usage()
+			return
+		}
+
+		failures, err := fluxrepo.Verify(ctx, verifyCmd.Arg(0), opts)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		if *output == "json" {
+			if failures == nil {
+				failures = []fluxrepo.VerifyFailure{}
+			}
+			err = printJSON(failures)
+		} else {
+			err = fluxrepo.WriteVerifyFailuresText(os.Stdout, failures)
+		}
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		if len(failures) > 0 {
+			os.Exit(1)
+		}
+	case CmdHook:
+		if len(os.Args) < 3 || os.Args[2] != "install" {
+			fatal("Usage: flux-repo hook install [-force] [-command PATH] [-- CHECK_STAGED_FLAGS]")
+		}
+
+		hookCmd := flag.NewFlagSet(CmdHook+" install", flag.ExitOnError)
+
+		var opts fluxrepo.HookOptions
+
+		hookCmd.BoolVar(&opts.Force, "force", false, "Overwrite the existing pre-commit hook even when it isn't installed by flux-repo")
+		hookCmd.StringVar(&opts.Command, "command", "flux-repo", "The flux-repo executable run by the hook")
+
+		if err := hookCmd.Parse(os.Args[3:]); err != nil {
+			fatal("%v", err)
+		}
+
+		opts.Args = hookCmd.Args()
+
+		// Fail early on flags that would make every commit fail
+		checkCmd := flag.NewFlagSet(CmdCheckStaged, flag.ContinueOnError)
+		addCheckStagedFlags(checkCmd)
+		addProjectFlags(checkCmd)
+		if err := checkCmd.Parse(opts.Args); err != nil {
+			fatal("invalid check-staged flags: %v", err)
+		}
+
+		hook, err := fluxrepo.InstallHook(ctx, ".", opts)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		fmt.Printf("Installed %s\n", hook)
+	case CmdCheckStaged:
+		checkCmd := flag.NewFlagSet(CmdCheckStaged, flag.ExitOnError)
+
+		checkFlags := addCheckStagedFlags(checkCmd)
+		project := addProjectFlags(checkCmd)
+
+		if err := checkCmd.Parse(os.Args[2:]); err != nil {
+			fatal("%v", err)
+		}
+
+		if *checkFlags.output != "text" && *checkFlags.output != "json" {
+			fatal("unsupported output format: %s", *checkFlags.output)
+		}
+
+		settings, err := project.load(fluxrepo.BackendOptions{})
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		res, err := fluxrepo.CheckStaged(ctx, ".", checkFlags.options(settings))
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		for _, w := range res.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+		}
+
+		findings := res.Findings
+
+		if *checkFlags.output == "json" {
+			err = fluxrepo.WriteScanFindingsJSON(os.Stdout, findings)
+		} else {
+			err = fluxrepo.WriteScanFindingsText(os.Stdout, findings)
+		}
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		if len(findings) > 0 {
+			fatal("Commit blocked by flux-repo. Sanitize the secrets with `flux-repo write`, or use `git commit --no-verify` to bypass")
+		}
+	case CmdConfig:
+		if len(os.Args) < 3 || os.Args[2] != "validate" {
+			fatal("Usage: flux-repo config validate [-config FILE]")
+		}
+
+		configCmd := flag.NewFlagSet(CmdConfig+" validate", flag.ExitOnError)
+		configFile := configCmd.String("config", "", fmt.Sprintf("Path to the project config file. Defaults to %s in the working directory or the nearest parent directory", fluxrepo.ProjectConfigFileName))
+
+		if err := configCmd.Parse(os.Args[3:]); err != nil {
+			fatal("%v", err)
+		}
+
+		file := *configFile
+		if file == "" {
+			var err error
+
+			file, err = fluxrepo.FindProjectConfig(".")
+			if err != nil {
+				fatal("%v", err)
+			}
+
+			if file == "" {
+				fatal("no %s found in the working directory or any parent directory", fluxrepo.ProjectConfigFileName)
+			}
+		}
+
+		config, err := fluxrepo.LoadProjectConfig(file)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		if err := config.Validate(); err != nil {
+			fatal("%v", err)
+		}
+
+		fmt.Printf("%s is valid\n", file)
 	default:
 		flag.Usage()
 	}
 }
 
-type backends struct {
-	awsSecrets fluxrepo.AWSSecretsBackend
-	vault      fluxrepo.VaultBackend
-	ssm        fluxrepo.AWSSSMBackend
-	s3         fluxrepo.S3Backend
-	sops       fluxrepo.SOPSBackend
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM, so that interrupting flux-repo aborts
+// in-flight API calls to secrets stores
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	return ctx
 }
 
-func createBackend(backendName *string, awsOpts *fluxrepo.AWSOptions, backends backends, secretPath *string) (fluxrepo.SecretProviderBackend, error) {
-	if secretPath == nil || *secretPath == "" {
-		return nil, errors.New("missing secret path")
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+// projectFlags loads the defaults of flags from the project config
+type projectFlags struct {
+	fs     *flag.FlagSet
+	config *string
+	env    *string
+}
+
+func addProjectFlags(fs *flag.FlagSet) *projectFlags {
+	return &projectFlags{
+		fs:     fs,
+		config: fs.String("config", "", fmt.Sprintf("Path to the project config file. Defaults to %s in the working directory or the nearest parent directory", fluxrepo.ProjectConfigFileName)),
+		env:    fs.String("env", "", "The environment in the project config to be used"),
 	}
+}
 
-	var backend fluxrepo.SecretProviderBackend
+// load loads the project config, and sets its backend options to opts unless they are set via flags.
+// It returns empty settings when there's no project config.
+func (p *projectFlags) load(opts fluxrepo.BackendOptions) (*fluxrepo.ProjectSettings, error) {
+	file := *p.config
+	if file == "" {
+		var err error
 
-	if backendName == nil || *backendName == "awssecrets" {
-		awsBackend := backends.awsSecrets
+		file, err = fluxrepo.FindProjectConfig(".")
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		awsBackend.Path = *secretPath
-		awsBackend.AWSOptions = *awsOpts
+	if file == "" {
+		if *p.env != "" {
+			return nil, fmt.Errorf("-env %s requires %s", *p.env, fluxrepo.ProjectConfigFileName)
+		}
 
-		backend = &awsBackend
-	} else if *backendName == "awsssm" {
-		awsSSMBackend := backends.ssm
+		return &fluxrepo.ProjectSettings{}, nil
+	}
 
-		awsSSMBackend.Path = *secretPath
-		awsSSMBackend.AWSOptions = *awsOpts
+	config, err := fluxrepo.LoadProjectConfig(file)
+	if err != nil {
+		return nil, err
+	}
 
-		backend = &awsSSMBackend
-	} else if *backendName == "s3" || *backendName == "awss3" {
-		s3Backend := backends.s3
+	settings, err := config.Settings(*p.env)
+	if err != nil {
+		return nil, err
+	}
 
-		s3Backend.Key = *secretPath
-		s3Backend.AWSOptions = *awsOpts
+	for k, vs := range settings.Options {
+		if !p.isSet(k) {
+			opts[k] = vs
+		}
+	}
 
-		backend = &s3Backend
-	} else if *backendName == "sops" {
-		sopsBackend := backends.sops
+	return settings, nil
+}
 
-		sopsBackend.FilePath = *secretPath
-		sopsBackend.AWSOptions = *awsOpts
+// isSet returns true when the flag is explicitly set on the command-line
+func (p *projectFlags) isSet(name string) bool {
+	var set bool
 
-		if err := sopsBackend.Validate(); err != nil {
-			return nil, err
+	p.fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
+	})
 
-		backend = &sopsBackend
-	} else if *backendName == "vault" {
-		vaultBackend := backends.vault
+	return set
+}
 
-		vaultBackend.Path = *secretPath
+type checkStagedFlags struct {
+	output       *string
+	backends     *string
+	pathPrefixes *string
+	deniedPaths  *string
+}
 
-		backend = &vaultBackend
+func addCheckStagedFlags(fs *flag.FlagSet) *checkStagedFlags {
+	return &checkStagedFlags{
+		output:       fs.String("output", "text", "The output format. One of: text, json"),
+		backends:     fs.String("allow-backends", "", "Comma-separated list of backends refs may point to. Refs produced by plugins are matched by their scheme. Defaults to the backends in the project config"),
+		pathPrefixes: fs.String("allow-path-prefixes", "", "Comma-separated list of backend path prefixes refs may point to. Defaults to the paths in the project config"),
+		deniedPaths:  fs.String("deny-paths", "", "Comma-separated list of files and directories that must never be committed. Defaults to the input directory in the project config"),
+	}
+}
+
+// options returns the options set via flags, falling back to the ones derived from the project settings
+func (f *checkStagedFlags) options(settings *fluxrepo.ProjectSettings) fluxrepo.CheckStagedOptions {
+	var opts fluxrepo.CheckStagedOptions
+
+	split := func(s string) []string {
+		var res []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				res = append(res, v)
+			}
+		}
+		return res
+	}
+
+	// Route paths are templates rendered per secret
+	pathPrefix := func(p string) string {
+		return strings.SplitN(p, "{{", 2)[0]
+	}
+
+	if *f.backends == "" && *f.pathPrefixes == "" && len(settings.Routes) > 0 {
+		// Each ref must match the backend and the path of a single route, so that e.g. a ref to the path of one route
+		// in the backend of another route is reported
+		for _, r := range settings.Routes {
+			t := fluxrepo.CheckTarget{PathPrefix: pathPrefix(r.Path)}
+
+			// The scheme of refs produced by plugins is unknown until they're run
+			if factory, _, err := fluxrepo.LookupBackend(r.Backend); err == nil && factory.ArgOption == "" {
+				t.Backend = factory.Name
+			}
+
+			opts.AllowedTargets = append(opts.AllowedTargets, t)
+		}
 	} else {
-		return nil, fmt.Errorf("unsupported secret provider backend: %v", *backendName)
+		if *f.backends != "" {
+			for _, b := range split(*f.backends) {
+				// Normalize aliases like awss3
+				if factory, _, err := fluxrepo.LookupBackend(b); err == nil {
+					b = factory.Name
+				}
+				opts.AllowedBackends = append(opts.AllowedBackends, b)
+			}
+		} else {
+			// Backend and Path are ignored by write when there are routes
+			var backends []string
+			if len(settings.Routes) > 0 {
+				for _, r := range settings.Routes {
+					backends = append(backends, r.Backend)
+				}
+			} else if settings.Backend != "" {
+				backends = append(backends, settings.Backend)
+			}
+
+			for _, b := range backends {
+				factory, _, err := fluxrepo.LookupBackend(b)
+				if err != nil || factory.ArgOption != "" {
+					// The scheme of refs produced by plugins is unknown until they're run
+					opts.AllowedBackends = nil
+					break
+				}
+				opts.AllowedBackends = append(opts.AllowedBackends, factory.Name)
+			}
+		}
+
+		if *f.pathPrefixes != "" {
+			opts.AllowedPathPrefixes = split(*f.pathPrefixes)
+		} else {
+			var paths []string
+			if len(settings.Routes) > 0 {
+				for _, r := range settings.Routes {
+					paths = append(paths, r.Path)
+				}
+			} else if settings.Path != "" {
+				paths = append(paths, settings.Path)
+			}
+
+			for _, p := range paths {
+				prefix := pathPrefix(p)
+				if prefix == "" {
+					opts.AllowedPathPrefixes = nil
+					break
+				}
+				opts.AllowedPathPrefixes = append(opts.AllowedPathPrefixes, prefix)
+			}
+		}
+	}
+
+	if *f.deniedPaths != "" {
+		opts.DeniedPaths = split(*f.deniedPaths)
+	} else if settings.Input != "" && settings.Input != "-" {
+		opts.DeniedPaths = []string{settings.Input}
+	}
+
+	return opts
+}
+
+// addBackendFlags adds a flag for every option of the registered secret provider backends.
+func addBackendFlags(fs *flag.FlagSet) fluxrepo.BackendOptions {
+	opts := fluxrepo.BackendOptions{}
+
+	for _, o := range fluxrepo.BackendOptionsFor(fluxrepo.Backends()) {
+		if o.Default != "" {
+			opts.Set(o.Name, o.Default)
+		}
+
+		fs.Var(&backendOptionFlag{opts: opts, name: o.Name, multi: o.Multi}, o.Name, o.Usage)
+	}
+
+	return opts
+}
+
+func backendFlagUsage() string {
+	var names []string
+
+	for _, f := range fluxrepo.Backends() {
+		n := f.Name
+		if f.ArgOption != "" {
+			n += ":ARG"
+		}
+		if len(f.Aliases) > 0 {
+			n += fmt.Sprintf(" (alias: %s)", strings.Join(f.Aliases, ", "))
+		}
+		names = append(names, n)
 	}
 
-	return backend, nil
+	return fmt.Sprintf("The name of secret provider backend to use. One of: %s", strings.Join(names, ", "))
+}
+
+type backendOptionFlag struct {
+	opts  fluxrepo.BackendOptions
+	name  string
+	multi bool
+}
+
+func (f *backendOptionFlag) String() string {
+	if f.opts == nil {
+		return ""
+	}
+	return strings.Join(f.opts[f.name], ",")
+}
+
+func (f *backendOptionFlag) Set(v string) error {
+	if f.multi {
+		f.opts.Add(f.name, v)
+	} else {
+		f.opts.Set(f.name, v)
+	}
+	return nil
 }
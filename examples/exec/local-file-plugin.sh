@@ -0,0 +1,66 @@
+#!/usr/bin/env bash
+#
+# An example flux-repo backend plugin that saves secrets into versioned local JSON files.
+#
+# Usage:
+#   flux-repo write -b exec:examples/exec/local-file-plugin.sh -p path/to/secrets -f indir -o outdir
+#
+# Each save creates `path/to/secrets.VERSION.json`, and the refs point to it with vals' `ref+file://` scheme.
+# Each load reads `path/to/secrets.VERSION.json`, or the latest version when no version is requested.
+# `-p` must be relative to the directory you run `flux-repo read` in.
+# Requires jq.
+
+set -euo pipefail
+
+PROTOCOL_VERSION=flux-repo.exec/v1
+
+req=$(cat)
+
+fail() {
+  jq -n --arg v "$PROTOCOL_VERSION" --arg e "$1" '{protocolVersion: $v, error: $e}'
+  exit 0
+}
+
+if [ "$(jq -r .protocolVersion <<<"$req")" != "$PROTOCOL_VERSION" ]; then
+  fail "unsupported protocol version"
+fi
+
+path=$(jq -r .path <<<"$req")
+
+case "$(jq -r .operation <<<"$req")" in
+save)
+  version=$(date +%s%N)
+
+  mkdir -p "$(dirname "$path")"
+  jq .secrets <<<"$req" > "$path.$version.json"
+
+  jq -n --arg v "$PROTOCOL_VERSION" --arg version "$version" '{
+    protocolVersion: $v,
+    version: $version,
+    refTemplate: "ref+file://{{.Path}}.{{.Version}}.json#/{{.Namespace}}/{{.Name}}/{{.Key}}"
+  }'
+  ;;
+load)
+  version=$(jq -r '.version // ""' <<<"$req")
+
+  if [ -z "$version" ]; then
+    # Versions are nanosecond timestamps of the same length, so that they sort lexically
+    latest=$(ls "$path".*.json 2>/dev/null | sort | tail -n 1 || true)
+    if [ -z "$latest" ]; then
+      fail "no secrets saved at $path"
+    fi
+
+    version=${latest#"$path".}
+    version=${version%.json}
+  fi
+
+  if [ ! -f "$path.$version.json" ]; then
+    fail "version $version not found at $path"
+  fi
+
+  jq --arg v "$PROTOCOL_VERSION" '{protocolVersion: $v, secrets: .}' "$path.$version.json"
+  ;;
+*)
+  fail "unsupported operation $(jq -r .operation <<<"$req")"
+  ;;
+esac
@@ -7,6 +7,8 @@ require (
 	github.com/hashicorp/vault/api v1.0.5-0.20190909201928-35325e2c3262
 	github.com/variantdev/vals v0.9.2
 	go.mozilla.org/sops v0.0.0-20190912205235-14a22d7a7060
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
+	google.golang.org/grpc v1.28.0
 	gopkg.in/yaml.v3 v3.0.0-20200506231410-2ff61e1afc86
 )
 
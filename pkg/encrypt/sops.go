@@ -23,6 +23,16 @@ type Sops struct {
 	AWSProfile        string
 	EncryptedRegex    string
 	EncryptedSuffix   string
+	// KeyServices encrypt and decrypt data keys with the master keys. Defaults to the local key service
+	KeyServices []keyservice.KeyServiceClient
+}
+
+func (sp *Sops) keyServices() []keyservice.KeyServiceClient {
+	if len(sp.KeyServices) > 0 {
+		return sp.KeyServices
+	}
+
+	return []keyservice.KeyServiceClient{keyservice.NewLocalClient()}
 }
 
 // File is a wrapper around Data that reads a local cleartext
@@ -97,9 +107,7 @@ func (sp *Sops) Data(path string, data []byte, format string) (cleartext []byte,
 		FilePath: absPath,
 	}
 
-	var keyServices []keyservice.KeyServiceClient
-
-	keyServices = append(keyServices, keyservice.NewLocalClient())
+	keyServices := sp.keyServices()
 
 	dataKey, errs := tree.GenerateDataKeyWithKeyServices(keyServices)
 	if len(errs) > 0 {
@@ -125,3 +133,217 @@ func (sp *Sops) Data(path string, data []byte, format string) (cleartext []byte,
 
 	return encryptedFile, nil
 }
+
+// Decrypt is the inverse of Data. It takes data encrypted by sops,
+// decrypts it with the master keys recorded in its metadata and returns the cleartext in the format given to Data.
+// The format string can be `json`, `yaml`, `dotenv` or `binary`.
+// If the format string is empty, binary format is assumed.
+func (sp *Sops) Decrypt(path string, data []byte, format string) (cleartext []byte, err error) {
+	// Data always emits YAML, regardless of the format
+	store := &sopsyaml.Store{}
+
+	var outputStore sops.Store
+	switch format {
+	case "json":
+		outputStore = &sopsjson.Store{}
+	case "yaml":
+		outputStore = &sopsyaml.Store{}
+	case "dotenv":
+		outputStore = &sopsdotenv.Store{}
+	default:
+		outputStore = &sopsjson.BinaryStore{}
+	}
+
+	tree, err := store.LoadEncryptedFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("getting absolute path of %s: %w", path, err)
+	}
+
+	tree.FilePath = absPath
+
+	sp.overrideAWSProfile(&tree)
+
+	keyServices := sp.keyServices()
+
+	_, err = common.DecryptTree(common.DecryptTreeOpts{
+		Tree:        &tree,
+		KeyServices: keyServices,
+		Cipher:      aes.NewCipher(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedFile, err := outputStore.EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, common.NewExitError(fmt.Sprintf("Could not marshal tree: %s", err), codes.ErrorDumpingTree)
+	}
+
+	return decryptedFile, nil
+}
+
+// overrideAWSProfile makes KMS master keys without a recorded AWS profile use the one configured for sp, if any.
+func (sp *Sops) overrideAWSProfile(tree *sops.Tree) {
+	if sp.AWSProfile == "" {
+		return
+	}
+
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, k := range group {
+			if kmsKey, ok := k.(*kms.MasterKey); ok && kmsKey.AwsProfile == "" {
+				kmsKey.AwsProfile = sp.AWSProfile
+			}
+		}
+	}
+}
+
+// RekeyOptions specifies how Rekey changes the master keys and the data key of sops-encrypted data.
+type RekeyOptions struct {
+	// AddKMS is the comma-separated list of KMS key ARNs to be added to the master keys
+	AddKMS string
+	// RemoveKMS is the comma-separated list of KMS key ARNs to be removed from the master keys
+	RemoveKMS string
+	// RotateDataKey generates a new data key and re-encrypts all the values with it, like `sops -r`.
+	// The data key is always rotated when a master key is removed, regardless of this option
+	RotateDataKey bool
+}
+
+// RekeyResult describes what Rekey changed
+type RekeyResult struct {
+	AddedKeys      []string
+	RemovedKeys    []string
+	DataKeyRotated bool
+}
+
+// Changed returns true when Rekey modified the data
+func (r *RekeyResult) Changed() bool {
+	return len(r.AddedKeys) > 0 || len(r.RemovedKeys) > 0 || r.DataKeyRotated
+}
+
+// Rekey takes data encrypted by sops, and adds and removes KMS master keys and optionally rotates the data key,
+// similar to `sops updatekeys` and `sops -r`.
+// It returns the data as-is when there's nothing to change, so that it is safe to be run repeatedly.
+// Removing a master key always rotates the data key, as the removed key can still decrypt the old data key
+// kept in git history and files elsewhere.
+// New KMS master keys are created with the encryption context and the AWS profile configured for sp.
+func (sp *Sops) Rekey(path string, data []byte, opts RekeyOptions) ([]byte, *RekeyResult, error) {
+	store := &sopsyaml.Store{}
+
+	tree, err := store.LoadEncryptedFile(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting absolute path of %s: %w", path, err)
+	}
+
+	tree.FilePath = absPath
+
+	sp.overrideAWSProfile(&tree)
+
+	keyServices := sp.keyServices()
+
+	dataKey, err := common.DecryptTree(common.DecryptTreeOpts{
+		Tree:        &tree,
+		KeyServices: keyServices,
+		Cipher:      aes.NewCipher(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kmsEncryptionContext := kms.ParseKMSContext(sp.EncryptionContext)
+	if sp.EncryptionContext != "" && kmsEncryptionContext == nil {
+		return nil, nil, common.NewExitError("Invalid KMS encryption context format", codes.ErrorInvalidKMSEncryptionContextFormat)
+	}
+
+	res := &RekeyResult{}
+
+	removals := map[string]bool{}
+	for _, k := range kms.MasterKeysFromArnString(opts.RemoveKMS, nil, "") {
+		removals[k.Arn] = true
+	}
+
+	existing := map[string]bool{}
+
+	for i, group := range tree.Metadata.KeyGroups {
+		var kept sops.KeyGroup
+
+		for _, k := range group {
+			if kmsKey, ok := k.(*kms.MasterKey); ok {
+				if removals[kmsKey.Arn] {
+					res.RemovedKeys = append(res.RemovedKeys, kmsKey.Arn)
+					continue
+				}
+
+				existing[kmsKey.Arn] = true
+			}
+
+			kept = append(kept, k)
+		}
+
+		tree.Metadata.KeyGroups[i] = kept
+	}
+
+	if opts.AddKMS != "" {
+		if len(tree.Metadata.KeyGroups) == 0 {
+			tree.Metadata.KeyGroups = []sops.KeyGroup{{}}
+		}
+
+		for _, k := range kms.MasterKeysFromArnString(opts.AddKMS, kmsEncryptionContext, sp.AWSProfile) {
+			if existing[k.Arn] || removals[k.Arn] {
+				continue
+			}
+
+			tree.Metadata.KeyGroups[0] = append(tree.Metadata.KeyGroups[0], k)
+			existing[k.Arn] = true
+			res.AddedKeys = append(res.AddedKeys, k.Arn)
+		}
+	}
+
+	res.DataKeyRotated = opts.RotateDataKey || len(res.RemovedKeys) > 0
+
+	if !res.Changed() {
+		return data, res, nil
+	}
+
+	for i, group := range tree.Metadata.KeyGroups {
+		if len(group) == 0 {
+			return nil, nil, fmt.Errorf("refusing to remove all the master keys in key group %d of %s", i, path)
+		}
+	}
+
+	if res.DataKeyRotated {
+		newDataKey, errs := tree.GenerateDataKeyWithKeyServices(keyServices)
+		if len(errs) > 0 {
+			return nil, nil, fmt.Errorf("Could not generate data key: %s", errs)
+		}
+
+		dataKey = newDataKey
+	} else if errs := tree.Metadata.UpdateMasterKeysWithKeyServices(dataKey, keyServices); len(errs) > 0 {
+		return nil, nil, fmt.Errorf("Could not update master keys: %s", errs)
+	}
+
+	err = common.EncryptTree(common.EncryptTreeOpts{
+		DataKey: dataKey,
+		Tree:    &tree,
+		Cipher:  aes.NewCipher(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptedFile, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		return nil, nil, common.NewExitError(fmt.Sprintf("Could not marshal tree: %s", err), codes.ErrorDumpingTree)
+	}
+
+	return encryptedFile, res, nil
+}
@@ -0,0 +1,216 @@
+package fluxrepo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BackendOption describes a configuration option of secret provider backends.
+// Options sharing the same name across backends, like "aws-region", are configured at once.
+type BackendOption struct {
+	Name    string
+	Usage   string
+	Default string
+	// Multi is true when the option can be specified multiple times
+	Multi bool
+}
+
+// BackendOptions holds values of BackendOption keyed by their names.
+type BackendOptions map[string][]string
+
+// Get returns the last value set for the option, or an empty string.
+func (o BackendOptions) Get(name string) string {
+	vs := o[name]
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[len(vs)-1]
+}
+
+// Set replaces the values of the option with v.
+func (o BackendOptions) Set(name, v string) {
+	o[name] = []string{v}
+}
+
+// Add appends v to the values of the option.
+func (o BackendOptions) Add(name, v string) {
+	o[name] = append(o[name], v)
+}
+
+// KeyValues parses the values of the option in the form of KEY=VALUE.
+func (o BackendOptions) KeyValues(name string) (map[string]string, error) {
+	res := map[string]string{}
+
+	for _, kv := range o[name] {
+		split := strings.SplitN(kv, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("parsing %s: expected KEY=VALUE, got %q", name, kv)
+		}
+		res[split[0]] = split[1]
+	}
+
+	return res, nil
+}
+
+// BackendFactory registers a secret provider backend so that it can be created by name.
+type BackendFactory struct {
+	Name        string
+	Aliases     []string
+	Description string
+	// ArgOption is the name of the option that is set from ARG when the backend is specified as NAME:ARG,
+	// like "exec:/path/to/plugin"
+	ArgOption string
+	Options   []BackendOption
+	// RefScheme is the scheme of the refs produced by the backend, like "awssecrets" for "ref+awssecrets://".
+	// `flux-repo read` loads secrets with the backend itself when a ref has this scheme.
+	RefScheme string
+	// RefVersion is the name of the query parameter of refs that holds the version ID
+	RefVersion string
+	// New creates the backend that stores secrets at path
+	New func(path string, opts BackendOptions) (SecretProviderBackend, error)
+	// Validate checks the backend created by New before it saves secrets. It's optional.
+	// NewBackend calls it, while backends used only for loading secrets aren't validated.
+	Validate func(backend SecretProviderBackend) error
+}
+
+var backendFactories = map[string]*BackendFactory{}
+
+// RegisterBackend makes the backend available by its name and aliases.
+// It panics when the name or one of the aliases is already registered.
+func RegisterBackend(f BackendFactory) {
+	for _, n := range append([]string{f.Name}, f.Aliases...) {
+		if _, ok := backendFactories[n]; ok {
+			panic(fmt.Sprintf("BUG: secret provider backend %q registered twice", n))
+		}
+
+		backendFactories[n] = &f
+	}
+}
+
+// Backends returns all the registered backends sorted by name.
+func Backends() []BackendFactory {
+	var res []BackendFactory
+
+	for n, f := range backendFactories {
+		if n == f.Name {
+			res = append(res, *f)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
+
+// BackendOptionsFor returns the options of all the registered backends, deduplicated by name and sorted.
+// The usage of each option is suffixed with the names of the backends that use it.
+func BackendOptionsFor(factories []BackendFactory) []BackendOption {
+	byName := map[string]BackendOption{}
+	users := map[string][]string{}
+
+	for _, f := range factories {
+		for _, o := range f.Options {
+			if _, ok := byName[o.Name]; !ok {
+				byName[o.Name] = o
+			}
+			users[o.Name] = append(users[o.Name], f.Name)
+		}
+	}
+
+	var res []BackendOption
+
+	for n, o := range byName {
+		o.Usage = fmt.Sprintf("%s. Used by the backends: %s", o.Usage, strings.Join(users[n], ", "))
+		res = append(res, o)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
+
+// LookupBackend returns the factory of the backend named name, which can be either NAME or NAME:ARG.
+func LookupBackend(name string) (*BackendFactory, string, error) {
+	n, arg := name, ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		n, arg = name[:i], name[i+1:]
+	}
+
+	f, ok := backendFactories[n]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported secret provider backend: %v", name)
+	}
+
+	if arg != "" && f.ArgOption == "" {
+		return nil, "", fmt.Errorf("unsupported secret provider backend: %v: %s does not accept the NAME:ARG form", name, f.Name)
+	}
+
+	return f, arg, nil
+}
+
+// LookupBackendByRefScheme returns the factory of the backend that produces refs with the scheme,
+// or nil if there's none.
+func LookupBackendByRefScheme(scheme string) *BackendFactory {
+	for n, f := range backendFactories {
+		if n == f.Name && f.RefScheme != "" && f.RefScheme == scheme {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// NewBackend creates and validates the backend named name that stores secrets at path.
+func NewBackend(name, path string, opts BackendOptions) (SecretProviderBackend, error) {
+	f, arg, err := LookupBackend(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("validating %s backend: missing secret path", f.Name)
+	}
+
+	backend, err := f.newBackend(path, arg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Validate != nil {
+		if err := f.Validate(backend); err != nil {
+			return nil, fmt.Errorf("validating %s backend: %w", f.Name, err)
+		}
+	}
+
+	return backend, nil
+}
+
+// newBackend creates the backend without validation.
+// Validation is skipped when the backend is used only for loading secrets,
+// as it checks options like -aws-kms-key-arn that are required only for saving.
+func (f *BackendFactory) newBackend(path, arg string, opts BackendOptions) (SecretProviderBackend, error) {
+	o := BackendOptions{}
+	for _, opt := range f.Options {
+		if opt.Default != "" {
+			o.Set(opt.Name, opt.Default)
+		}
+	}
+	for k, vs := range opts {
+		o[k] = vs
+	}
+	if arg != "" {
+		o.Set(f.ArgOption, arg)
+	}
+
+	backend, err := f.New(path, o)
+	if err != nil {
+		return nil, fmt.Errorf("creating %s backend: %w", f.Name, err)
+	}
+
+	return backend, nil
+}
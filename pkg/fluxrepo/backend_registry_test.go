@@ -0,0 +1,77 @@
+package fluxrepo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewBackendValidates(t *testing.T) {
+	testcases := []struct {
+		name    string
+		backend string
+		path    string
+		opts    BackendOptions
+		wantErr string
+	}{
+		{
+			name:    "sops without key",
+			backend: "sops",
+			path:    "secrets.enc",
+			wantErr: "validating sops backend: -aws-kms-key-arn must be provided when using sops backend",
+		},
+		{
+			name:    "sops",
+			backend: "sops",
+			path:    "secrets.enc",
+			opts:    BackendOptions{"aws-kms-key-arn": {"arn:aws:kms:us-east-2:123456789012:key/foo"}},
+		},
+		{
+			name:    "s3 with unknown sse",
+			backend: "s3",
+			path:    "bucket/key",
+			opts:    BackendOptions{"s3-sse": {"foo"}},
+			wantErr: "validating s3 backend: validating `-s3-sse \"foo\"`",
+		},
+		{
+			name:    "exec without plugin",
+			backend: "exec:/nonexistent/plugin",
+			path:    "foo",
+			wantErr: "validating exec backend: looking up plugin /nonexistent/plugin",
+		},
+		{
+			name:    "memory without validation",
+			backend: "memory",
+			path:    "foo",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewBackend(tc.backend, tc.path, tc.opts)
+
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewBackendForLoadingSkipsValidation(t *testing.T) {
+	f, arg, err := LookupBackend("sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Backends created to resolve refs don't need the options required only for saving
+	if _, err := f.newBackend("secrets.enc", arg, BackendOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
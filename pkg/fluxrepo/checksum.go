@@ -0,0 +1,289 @@
+package fluxrepo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ChecksumAnnotation is the annotation of sanitized Secrets whose value is the salted checksum of their data.
+// The same annotation is added to the pod templates of the workloads referencing them, so that the workloads are rolled out
+// exactly when the data changes, rather than on every write that changes the versions in refs.
+const ChecksumAnnotation = "flux-repo.mumoshu.github.io/checksum"
+
+// podTemplatePaths are the paths to the pod templates of the workload kinds, from the root of the resources
+var podTemplatePaths = map[string][]string{
+	"Deployment":            {"spec", "template"},
+	"StatefulSet":           {"spec", "template"},
+	"DaemonSet":             {"spec", "template"},
+	"ReplicaSet":            {"spec", "template"},
+	"ReplicationController": {"spec", "template"},
+	"Job":                   {"spec", "template"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template"},
+}
+
+// checksum returns an HMAC-SHA256 of v keyed with the salt, so that low-entropy values can't be guessed from the checksums committed to git
+func checksum(salt string, v interface{}) string {
+	// Map keys are sorted by json.Marshal, so that the same data always results in the same checksum
+	bs, _ := json.Marshal(v)
+
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write(bs)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// annotateWorkload returns a copy of the node whose pod template is annotated with the checksum of the Secrets it references.
+// Only Secrets sanitized by the same write are taken into account. Nodes other than workloads are returned as-is.
+func annotateWorkload(secrets *SecretProvider, node yaml.Node) (*yaml.Node, error) {
+	if _, ok := listItems(node); ok {
+		return mapListItems(node, func(item yaml.Node) (*yaml.Node, error) {
+			return annotateWorkload(secrets, item)
+		})
+	}
+
+	res := node
+
+	if node.Kind != yaml.DocumentNode || len(node.Content) == 0 || node.Content[0].Kind != yaml.MappingNode {
+		return &res, nil
+	}
+
+	root := node.Content[0]
+
+	path, ok := podTemplatePaths[stringMap(root)["kind"]]
+	if !ok {
+		return &res, nil
+	}
+
+	template := root
+	for _, k := range path {
+		if template = mapValue(template, k); template == nil || template.Kind != yaml.MappingNode {
+			return &res, nil
+		}
+	}
+
+	var ns string
+	if m := mapValue(root, "metadata"); m != nil {
+		ns = stringMap(m)["namespace"]
+	}
+	ns = secrets.namespaceOr(ns)
+
+	checksums := map[string]string{}
+
+	for _, name := range podSecretNames(mapValue(template, "spec")) {
+		if c, ok := secrets.checksum(ns, name); ok {
+			checksums[name] = c
+		}
+	}
+
+	if len(checksums) == 0 {
+		return &res, nil
+	}
+
+	annotated := withAnnotation(template, ChecksumAnnotation, checksum(secrets.ChecksumSalt, checksums))
+
+	// Replace the pod template in copies of its ancestors, so that the original node is left unchanged
+	for i := len(path) - 1; i >= 0; i-- {
+		parent := root
+		for _, k := range path[:i] {
+			parent = mapValue(parent, k)
+		}
+
+		annotated = setMapValue(parent, path[i], annotated)
+	}
+
+	res.Content = []*yaml.Node{annotated}
+
+	return &res, nil
+}
+
+// podSecretNames returns the sorted names of the Secrets mounted or referenced by the pod spec
+func podSecretNames(spec *yaml.Node) []string {
+	set := map[string]bool{}
+
+	add := func(n *yaml.Node, key string) {
+		if n == nil || n.Kind != yaml.MappingNode {
+			return
+		}
+
+		if v := stringMap(n)[key]; v != "" {
+			set[v] = true
+		}
+	}
+
+	for _, s := range seqItems(mapValue(spec, "imagePullSecrets")) {
+		add(s, "name")
+	}
+
+	for _, v := range seqItems(mapValue(spec, "volumes")) {
+		add(mapValue(v, "secret"), "secretName")
+
+		for _, src := range seqItems(mapValue(mapValue(v, "projected"), "sources")) {
+			add(mapValue(src, "secret"), "name")
+		}
+	}
+
+	for _, k := range []string{"initContainers", "containers", "ephemeralContainers"} {
+		for _, c := range seqItems(mapValue(spec, k)) {
+			for _, e := range seqItems(mapValue(c, "env")) {
+				add(mapValue(mapValue(e, "valueFrom"), "secretKeyRef"), "name")
+			}
+
+			for _, e := range seqItems(mapValue(c, "envFrom")) {
+				add(mapValue(e, "secretRef"), "name")
+			}
+		}
+	}
+
+	var names []string
+	for n := range set {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// withAnnotation returns a copy of the mapping node of a resource or a pod template, with the annotation set in its metadata
+func withAnnotation(m *yaml.Node, key, value string) *yaml.Node {
+	meta := mapValue(m, "metadata")
+	if meta == nil || meta.Kind != yaml.MappingNode {
+		meta = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+
+	annotations := mapValue(meta, "annotations")
+	if annotations == nil || annotations.Kind != yaml.MappingNode {
+		annotations = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+
+	annotations = setMapValue(annotations, key, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+	meta = setMapValue(meta, "annotations", annotations)
+
+	if mapValue(m, "metadata") == nil {
+		// Conventionally, metadata comes first in pod templates
+		res := *m
+		res.Content = append([]*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: "metadata"}, meta}, m.Content...)
+
+		return &res
+	}
+
+	return setMapValue(m, "metadata", meta)
+}
+
+// mapValue returns the value of the key in the mapping node, or nil when there's none
+func mapValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// setMapValue returns a copy of the mapping node with the value of the key replaced, or appended when there's none
+func setMapValue(m *yaml.Node, key string, value *yaml.Node) *yaml.Node {
+	res := *m
+	res.Content = append([]*yaml.Node{}, m.Content...)
+
+	for i := 0; i+1 < len(res.Content); i += 2 {
+		if res.Content[i].Value == key {
+			res.Content[i+1] = value
+			return &res
+		}
+	}
+
+	res.Content = append(res.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+
+	return &res
+}
+
+// seqItems returns the items of the sequence node, or nil for other nodes
+func seqItems(n *yaml.Node) []*yaml.Node {
+	if n == nil || n.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	return n.Content
+}
+
+// annotationOf returns the annotation in the metadata of the mapping node of a resource or a pod template, or an empty string when there's none
+func annotationOf(m *yaml.Node, key string) string {
+	annotations := mapValue(mapValue(m, "metadata"), "annotations")
+	if annotations == nil || annotations.Kind != yaml.MappingNode {
+		return ""
+	}
+
+	return stringMap(annotations)[key]
+}
+
+// updateWorkloadChecksums recomputes in place the checksums of the pod templates in docs that reference the Secret named name in the namespace ns,
+// from the checksums of the Secrets keyed by NAMESPACE/NAME. Namespaces are the ones in the manifests, which are empty when omitted.
+// Only pod templates already annotated by write are updated. It returns true when any of them is updated.
+func updateWorkloadChecksums(salt string, secretChecksums map[string]string, docs []*yaml.Node, ns, name string) bool {
+	var updated bool
+
+	for _, doc := range docs {
+		if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+
+		root := doc.Content[0]
+
+		path, ok := podTemplatePaths[stringMap(root)["kind"]]
+		if !ok {
+			continue
+		}
+
+		template := root
+		for _, k := range path {
+			if template = mapValue(template, k); template == nil || template.Kind != yaml.MappingNode {
+				break
+			}
+		}
+
+		if template == nil || template.Kind != yaml.MappingNode || annotationOf(template, ChecksumAnnotation) == "" {
+			continue
+		}
+
+		var workloadNs string
+		if m := mapValue(root, "metadata"); m != nil && m.Kind == yaml.MappingNode {
+			workloadNs = stringMap(m)["namespace"]
+		}
+
+		if workloadNs != ns {
+			continue
+		}
+
+		var references bool
+
+		checksums := map[string]string{}
+
+		for _, n := range podSecretNames(mapValue(template, "spec")) {
+			if n == name {
+				references = true
+			}
+
+			if c, ok := secretChecksums[workloadNs+"/"+n]; ok {
+				checksums[n] = c
+			}
+		}
+
+		if !references {
+			continue
+		}
+
+		*template = *withAnnotation(template, ChecksumAnnotation, checksum(salt, checksums))
+		updated = true
+	}
+
+	return updated
+}
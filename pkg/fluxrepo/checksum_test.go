@@ -0,0 +1,242 @@
+package fluxrepo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const testChecksumSalt = "salt"
+
+// testPodTemplatePaths are the paths to the pod templates in the Kubernetes API, written independently of podTemplatePaths
+var testPodTemplatePaths = map[string][]string{
+	"Deployment":            {"spec", "template"},
+	"StatefulSet":           {"spec", "template"},
+	"DaemonSet":             {"spec", "template"},
+	"ReplicaSet":            {"spec", "template"},
+	"ReplicationController": {"spec", "template"},
+	"Job":                   {"spec", "template"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template"},
+}
+
+// workloadManifest returns a workload of the kind whose pod template references the Secret named app
+func workloadManifest(t *testing.T, kind string) string {
+	t.Helper()
+
+	path, ok := testPodTemplatePaths[kind]
+	if !ok {
+		t.Fatalf("unknown workload kind %s", kind)
+	}
+
+	var obj interface{} = map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{
+					"name":    "app",
+					"envFrom": []interface{}{map[string]interface{}{"secretRef": map[string]interface{}{"name": "app"}}},
+				},
+			},
+		},
+	}
+
+	for i := len(path) - 1; i >= 1; i-- {
+		obj = map[string]interface{}{path[i]: obj}
+	}
+
+	root := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": "app", "namespace": "ns1"},
+		path[0]:      obj,
+	}
+
+	bs, err := yaml.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(bs)
+}
+
+func appSecretManifest(password string) string {
+	return `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+stringData:
+  password: ` + password + `
+`
+}
+
+// writeWithChecksums writes the files with the memory backend and returns the written files keyed by the names
+func writeWithChecksums(t *testing.T, files map[string]string) map[string]string {
+	t.Helper()
+
+	in := tempDir(t)
+	defer os.RemoveAll(in)
+
+	out := tempDir(t)
+	defer os.RemoveAll(out)
+
+	writeFiles(t, in, files)
+
+	_, err := WriteContext(context.Background(), WriteOptions{
+		Input:             in,
+		Output:            out,
+		Backend:           &memoryBackend{Path: "app"},
+		ChecksumSalt:      testChecksumSalt,
+		ChecksumWorkloads: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := map[string]string{}
+
+	for name := range files {
+		written[name] = readFile(t, filepath.Join(out, name))
+	}
+
+	return written
+}
+
+// annotationAt returns the checksum annotation of the mapping at the path in the first document of the content
+func annotationAt(t *testing.T, content string, path ...string) string {
+	t.Helper()
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	m := doc
+	for _, k := range path {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			t.Fatalf("no mapping at %s in:\n%s", strings.Join(path, "."), content)
+		}
+
+		m = next
+	}
+
+	meta, _ := m["metadata"].(map[string]interface{})
+	annotations, _ := meta["annotations"].(map[string]interface{})
+	v, _ := annotations[ChecksumAnnotation].(string)
+
+	return v
+}
+
+func TestChecksumWorkloadKinds(t *testing.T) {
+	for kind := range podTemplatePaths {
+		if _, ok := testPodTemplatePaths[kind]; !ok {
+			t.Errorf("workload kind %s isn't tested", kind)
+		}
+	}
+
+	for kind, path := range testPodTemplatePaths {
+		kind, path := kind, path
+
+		t.Run(kind, func(t *testing.T) {
+			resetMemoryStore()
+			defer resetMemoryStore()
+
+			written := writeWithChecksums(t, map[string]string{
+				"secret.yaml":   appSecretManifest("pass1"),
+				"workload.yaml": workloadManifest(t, kind),
+			})
+
+			secretChecksum := checksum(testChecksumSalt, Secret{"password": "pass1"})
+
+			if got := annotationAt(t, written["secret.yaml"]); got != secretChecksum {
+				t.Errorf("unexpected checksum of the secret: want %s, got %s", secretChecksum, got)
+			}
+
+			want := checksum(testChecksumSalt, map[string]string{"app": secretChecksum})
+
+			if got := annotationAt(t, written["workload.yaml"], path...); got != want {
+				t.Errorf("unexpected checksum of the pod template at %s: want %s, got %s", strings.Join(path, "."), want, got)
+			}
+
+			if got := annotationAt(t, written["workload.yaml"]); got != "" {
+				t.Errorf("expected the workload itself not to be annotated, got %s", got)
+			}
+		})
+	}
+}
+
+func TestChecksumStableAcrossWrites(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	write := func(password string) (string, string) {
+		written := writeWithChecksums(t, map[string]string{
+			"secret.yaml":   appSecretManifest(password),
+			"workload.yaml": workloadManifest(t, "Deployment"),
+		})
+
+		return written["secret.yaml"], annotationAt(t, written["workload.yaml"], "spec", "template")
+	}
+
+	secret1, checksum1 := write("pass1")
+	secret2, checksum2 := write("pass1")
+
+	// The refs change on every write, as each write saves a new version
+	if secret1 == secret2 {
+		t.Fatalf("expected the refs to point to different versions:\n%s", secret1)
+	}
+
+	if checksum1 == "" || checksum1 != checksum2 {
+		t.Errorf("expected the checksum to be unchanged when the data is unchanged, got %q and %q", checksum1, checksum2)
+	}
+
+	if _, checksum3 := write("pass2"); checksum3 == checksum1 {
+		t.Errorf("expected the checksum to change when the data changes, got %q", checksum3)
+	}
+}
+
+func TestChecksumWorkloadsInList(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	var items strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(workloadManifest(t, "Deployment")), "\n") {
+		prefix := "    "
+		if items.Len() == 0 {
+			prefix = "  - "
+		}
+
+		items.WriteString(prefix + line + "\n")
+	}
+
+	written := writeWithChecksums(t, map[string]string{
+		"secret.yaml": appSecretManifest("pass1"),
+		"list.yaml":   "apiVersion: v1\nkind: List\nitems:\n" + items.String(),
+	})
+
+	var list struct {
+		Items []interface{} `yaml:"items"`
+	}
+	if err := yaml.Unmarshal([]byte(written["list.yaml"]), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Items) != 1 {
+		t.Fatalf("expected a single item, got:\n%s", written["list.yaml"])
+	}
+
+	item, err := yaml.Marshal(list.Items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := checksum(testChecksumSalt, map[string]string{"app": checksum(testChecksumSalt, Secret{"password": "pass1"})})
+
+	if got := annotationAt(t, string(item), "spec", "template"); got != want {
+		t.Errorf("unexpected checksum of the pod template in the list: want %s, got %s", want, got)
+	}
+}
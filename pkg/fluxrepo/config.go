@@ -0,0 +1,256 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ProjectConfigFileName is the name of the project config file discovered from the working directory upward
+const ProjectConfigFileName = ".flux-repo.yaml"
+
+// ProjectConfig declares the defaults of command-line flags shared across a project, so that they don't need to be
+// repeated on every invocation.
+//
+//	backend: awssecrets
+//	path: "{{.Environment}}/flux-repo"
+//	input: manifests/{{.Environment}}
+//	output: sanitized/{{.Environment}}
+//	options:
+//	  aws-region: us-east-1
+//	environments:
+//	  production:
+//	    options:
+//	      aws-profile: production
+type ProjectConfig struct {
+	ProjectSettings `yaml:",inline"`
+
+	// Environments override the top-level settings when selected with `-env NAME`
+	Environments map[string]ProjectSettings `yaml:"environments"`
+
+	// File is the path to the file the config is loaded from
+	File string `yaml:"-"`
+}
+
+// ProjectSettings is the set of defaults for command-line flags.
+// Path, Input and Output are Go templates rendered with .Environment.
+type ProjectSettings struct {
+	// Backend is the default of -b
+	Backend string `yaml:"backend"`
+	// Path is the default of -p
+	Path string `yaml:"path"`
+	// Input is the default of -f. Relative paths are relative to the directory of the config file
+	Input string `yaml:"input"`
+	// Output is the default of -o. Relative paths are relative to the directory of the config file
+	Output string `yaml:"output"`
+	// Encrypt is the default of -encrypt
+	Encrypt *bool `yaml:"encrypt"`
+	// Options are the defaults of the backend options like -aws-region
+	Options BackendOptions `yaml:"options"`
+	// Routes are the sanitization rules that map secrets to backends and paths, in the same format as the -routes file.
+	// Backend and Path are ignored when this is set.
+	Routes []Route `yaml:"routes"`
+}
+
+// FindProjectConfig returns the path to the project config file in dir or the nearest parent directory of it.
+// It returns an empty string when there's none.
+func FindProjectConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		file := filepath.Join(dir, ProjectConfigFileName)
+
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+
+		dir = parent
+	}
+}
+
+// LoadProjectConfig reads the project config from the YAML file. Unknown fields are rejected to catch typos.
+func LoadProjectConfig(file string) (*ProjectConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading project config %s: %w", file, err)
+	}
+	defer f.Close()
+
+	config := ProjectConfig{File: file}
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("decoding project config %s: %w", file, err)
+	}
+
+	return &config, nil
+}
+
+// Validate checks backend names, backend options, templates and routes of the top-level settings and all the environments.
+// It reports all the problems found at once.
+func (c *ProjectConfig) Validate() error {
+	var problems []string
+
+	problems = append(problems, c.ProjectSettings.validate("")...)
+
+	var envs []string
+	for env := range c.Environments {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	for _, env := range envs {
+		s := c.Environments[env]
+		problems = append(problems, s.validate(fmt.Sprintf("environments.%s.", env))...)
+
+		// Templates are validated by rendering them
+		if _, err := c.Settings(env); err != nil {
+			problems = append(problems, fmt.Sprintf("environments.%s: %v", env, err))
+		}
+	}
+
+	if _, err := c.Settings(""); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("validating project config %s:\n  %s", c.File, strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+func (s ProjectSettings) validate(prefix string) []string {
+	var problems []string
+
+	knownOptions := map[string]bool{}
+	for _, o := range BackendOptionsFor(Backends()) {
+		knownOptions[o.Name] = true
+	}
+
+	if s.Backend != "" {
+		if _, _, err := LookupBackend(s.Backend); err != nil {
+			problems = append(problems, fmt.Sprintf("%sbackend: %v", prefix, err))
+		}
+	}
+
+	for k := range s.Options {
+		if !knownOptions[k] {
+			problems = append(problems, fmt.Sprintf("%soptions: unknown backend option %q", prefix, k))
+		}
+	}
+
+	for i, r := range s.Routes {
+		for k := range r.Options {
+			if !knownOptions[k] {
+				problems = append(problems, fmt.Sprintf("%sroutes[%d].options: unknown backend option %q", prefix, i, k))
+			}
+		}
+	}
+
+	if len(s.Routes) > 0 {
+		if _, err := NewRouter(&RoutingConfig{Routes: s.Routes}, nil); err != nil {
+			problems = append(problems, fmt.Sprintf("%sroutes: %v", prefix, err))
+		}
+	}
+
+	sort.Strings(problems)
+
+	return problems
+}
+
+type projectTemplateData struct {
+	Environment string
+}
+
+// Settings returns the top-level settings overridden by the environment, with templates rendered.
+// env can be empty to use only the top-level settings.
+func (c *ProjectConfig) Settings(env string) (*ProjectSettings, error) {
+	s := c.ProjectSettings
+
+	s.Options = BackendOptions{}
+	for k, vs := range c.ProjectSettings.Options {
+		s.Options[k] = vs
+	}
+
+	if env != "" {
+		e, ok := c.Environments[env]
+		if !ok {
+			return nil, fmt.Errorf("environment %q not found in %s", env, c.File)
+		}
+
+		if e.Backend != "" {
+			s.Backend = e.Backend
+		}
+		if e.Path != "" {
+			s.Path = e.Path
+		}
+		if e.Input != "" {
+			s.Input = e.Input
+		}
+		if e.Output != "" {
+			s.Output = e.Output
+		}
+		if e.Encrypt != nil {
+			s.Encrypt = e.Encrypt
+		}
+		for k, vs := range e.Options {
+			s.Options[k] = vs
+		}
+		if len(e.Routes) > 0 {
+			s.Routes = e.Routes
+		}
+	}
+
+	data := projectTemplateData{Environment: env}
+
+	for _, f := range []struct {
+		name string
+		v    *string
+		dir  bool
+	}{
+		{"path", &s.Path, false},
+		{"input", &s.Input, true},
+		{"output", &s.Output, true},
+	} {
+		if *f.v == "" {
+			continue
+		}
+
+		tmpl, err := template.New(f.name).Option("missingkey=error").Parse(*f.v)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s in %s: %w", f.name, c.File, err)
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering %s in %s: %w", f.name, c.File, err)
+		}
+
+		*f.v = buf.String()
+
+		if f.dir && *f.v != "-" && !filepath.IsAbs(*f.v) && c.File != "" {
+			*f.v = filepath.Join(filepath.Dir(c.File), *f.v)
+		}
+	}
+
+	return &s, nil
+}
@@ -0,0 +1,176 @@
+package fluxrepo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testProjectConfig = `backend: awssecrets
+path: "{{.Environment}}/flux-repo"
+input: manifests/{{.Environment}}
+output: /sanitized/{{.Environment}}
+options:
+  aws-region: [us-east-1]
+  aws-profile: [default]
+environments:
+  production:
+    backend: awsssm
+    output: "-"
+    options:
+      aws-profile: [production]
+  staging:
+    path: staging
+`
+
+func loadTestProjectConfig(t *testing.T, content string) (*ProjectConfig, string) {
+	t.Helper()
+
+	dir := tempDir(t)
+
+	writeFiles(t, dir, map[string]string{ProjectConfigFileName: content})
+
+	config, err := LoadProjectConfig(filepath.Join(dir, ProjectConfigFileName))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return config, dir
+}
+
+func TestProjectConfigSettings(t *testing.T) {
+	config, dir := loadTestProjectConfig(t, testProjectConfig)
+	defer os.RemoveAll(dir)
+
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		env  string
+		want ProjectSettings
+	}{
+		{
+			env: "",
+			want: ProjectSettings{
+				Backend: "awssecrets",
+				Path:    "/flux-repo",
+				Input:   filepath.Join(dir, "manifests"),
+				Output:  "/sanitized/",
+				Options: BackendOptions{"aws-region": {"us-east-1"}, "aws-profile": {"default"}},
+			},
+		},
+		{
+			// Settings of the environment take precedence, and options are merged per option
+			env: "production",
+			want: ProjectSettings{
+				Backend: "awsssm",
+				Path:    "production/flux-repo",
+				Input:   filepath.Join(dir, "manifests", "production"),
+				Output:  "-",
+				Options: BackendOptions{"aws-region": {"us-east-1"}, "aws-profile": {"production"}},
+			},
+		},
+		{
+			env: "staging",
+			want: ProjectSettings{
+				Backend: "awssecrets",
+				Path:    "staging",
+				Input:   filepath.Join(dir, "manifests", "staging"),
+				Output:  "/sanitized/staging",
+				Options: BackendOptions{"aws-region": {"us-east-1"}, "aws-profile": {"default"}},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.env, func(t *testing.T) {
+			got, err := config.Settings(tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("unexpected settings:\nwant: %+v\ngot:  %+v", tc.want, *got)
+			}
+		})
+	}
+
+	// The top-level settings are left unchanged by the environments
+	if got := config.Options["aws-profile"]; !reflect.DeepEqual(got, []string{"default"}) {
+		t.Errorf("expected the top-level options to be left unchanged, got %v", got)
+	}
+
+	if _, err := config.Settings("dev"); err == nil || !strings.Contains(err.Error(), `environment "dev" not found`) {
+		t.Errorf("expected an error for an unknown environment, got %v", err)
+	}
+}
+
+func TestLoadProjectConfigUnknownField(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, ProjectConfigFileName)
+
+	writeFiles(t, dir, map[string]string{ProjectConfigFileName: "backend: awssecrets\nouptut: sanitized\n"})
+
+	if _, err := LoadProjectConfig(file); err == nil || !strings.Contains(err.Error(), "ouptut") {
+		t.Errorf("expected an error for the unknown field, got %v", err)
+	}
+}
+
+func TestProjectConfigValidate(t *testing.T) {
+	config, dir := loadTestProjectConfig(t, `backend: unknown
+path: "{{.Env}}"
+options:
+  aws-regoin: [us-east-1]
+environments:
+  production:
+    routes:
+    - backend: s3
+`)
+	defer os.RemoveAll(dir)
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// All the problems are reported at once
+	for _, want := range []string{"backend: ", `options: unknown backend option "aws-regoin"`, "environments.production.routes: validating routes[0]: missing path", "rendering path"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to contain %q, got:\n%s", want, err.Error())
+		}
+	}
+}
+
+func TestFindProjectConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		ProjectConfigFileName:                     "backend: awssecrets\n",
+		filepath.Join("a", "b", "c.yaml"):         "foo: bar\n",
+		filepath.Join("x", ProjectConfigFileName): "backend: vault\n",
+	})
+
+	testcases := map[string]string{
+		filepath.Join(dir, "a", "b"): filepath.Join(dir, ProjectConfigFileName),
+		dir:                          filepath.Join(dir, ProjectConfigFileName),
+		filepath.Join(dir, "x"):      filepath.Join(dir, "x", ProjectConfigFileName),
+	}
+
+	for from, want := range testcases {
+		got, err := FindProjectConfig(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Errorf("unexpected config found from %s: want %s, got %s", from, want, got)
+		}
+	}
+}
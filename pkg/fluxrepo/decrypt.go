@@ -0,0 +1,254 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mumoshu/flux-repo/pkg/encrypt"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DecryptWithSops is the inverse of FilterWithSops.
+// It decrypts every SOPS-encrypted file found under fsPath and copies other files as-is into the output directory.
+//
+// Deprecated: Use DecryptContext.
+func DecryptWithSops(sop *encrypt.Sops, outputDir *string, fsPath *string) (*WriteInfo, error) {
+	return DecryptContext(context.Background(), WriteOptions{Sops: sop, Output: derefString(outputDir), Input: derefString(fsPath)})
+}
+
+// DecryptContext is the inverse of WriteContext with Sops set.
+// It decrypts every SOPS-encrypted file found under opts.Input and copies other files as-is into opts.Output.
+// Encrypted files are decrypted into the format they were encrypted from, which is determined by the extension as FilterWithSops does.
+// Files split per document by FilterWithSops, named BASE.0.EXT, BASE.1.EXT and so on, are joined back into BASE.EXT.
+// See splitFileGroups for how they're told apart from other files.
+func DecryptContext(ctx context.Context, opts WriteOptions) (*WriteInfo, error) {
+	if opts.Sops == nil {
+		return nil, errors.New("decrypting: no sops specified")
+	}
+
+	fsPath := opts.Input
+
+	dir, err := fallbackToTempDir(opts.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := FindFiles(fsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	contents := map[string][]byte{}
+
+	for _, path := range files {
+		fileContent, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading file %s: %w", path, err)
+		}
+
+		contents[path] = fileContent
+	}
+
+	groups := splitFileGroups(files, contents)
+
+	info := &WriteInfo{Dir: dir, Files: []WrittenFile{}, Secrets: []SanitizedSecret{}}
+
+	out, err := newStagedOutput(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer out.cleanup()
+
+	for _, path := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		joined, split := groups[path]
+		if split && joined == "" {
+			// Written together with the first document of the group
+			continue
+		}
+
+		var (
+			data []byte
+			dest = path
+		)
+
+		if split {
+			dest = joined
+
+			for i, p := range splitFileGroupMembers(joined, groups) {
+				// Each document was encrypted as YAML
+				doc, err := decryptFile(opts.Sops, p, contents[p], "yaml")
+				if err != nil {
+					return nil, err
+				}
+
+				if i > 0 {
+					data = append(data, "---\n"...)
+				}
+
+				data = append(data, doc...)
+			}
+		} else {
+			data, err = decryptFile(opts.Sops, path, contents[path], strings.TrimPrefix(filepath.Ext(path), "."))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var relpath string
+		if dest != fsPath {
+			relpath = strings.TrimPrefix(dest, fsPath)
+		} else {
+			relpath = dest
+		}
+
+		output := filepath.Join(dir, relpath)
+
+		if err := out.write(output, data); err != nil {
+			return nil, err
+		}
+
+		info.Files = append(info.Files, WrittenFile{Input: path, Output: output})
+	}
+
+	if err := out.commit(); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// decryptFile decrypts the content of the file at path when it's SOPS-encrypted, or returns it as-is
+func decryptFile(sop *encrypt.Sops, path string, content []byte, format string) ([]byte, error) {
+	if !isSopsEncrypted(content) {
+		return content, nil
+	}
+
+	data, err := sop.Decrypt(path, content, format)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", path, err)
+	}
+
+	return data, nil
+}
+
+var splitFilePattern = regexp.MustCompile(`^(.*)\.(0|[1-9][0-9]*)(\.[^.]+)$`)
+
+// splitFileGroups finds the files split per document by FilterWithSops, and maps each of them to the path to join them into.
+// The path is empty for every file in a group other than the first one.
+//
+// Files named BASE.0.EXT to BASE.N.EXT are considered split only when there are two or more of them without a gap,
+// at least one of them is SOPS-encrypted, and there's no BASE.EXT, as FilterWithSops never writes both.
+// Files that happen to be named like that otherwise, like values.0.yaml and values.1.yaml, are decrypted one by one.
+func splitFileGroups(files []string, contents map[string][]byte) map[string]string {
+	exists := map[string]bool{}
+	for _, f := range files {
+		exists[f] = true
+	}
+
+	indices := map[string]map[int]string{}
+
+	for _, f := range files {
+		m := splitFilePattern.FindStringSubmatch(f)
+		if m == nil {
+			continue
+		}
+
+		i, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+
+		joined := m[1] + m[3]
+		if indices[joined] == nil {
+			indices[joined] = map[int]string{}
+		}
+
+		indices[joined][i] = f
+	}
+
+	groups := map[string]string{}
+
+	for joined, members := range indices {
+		if len(members) < 2 || exists[joined] {
+			continue
+		}
+
+		var encrypted bool
+
+		for i := 0; i < len(members); i++ {
+			p, ok := members[i]
+			if !ok {
+				encrypted = false
+				break
+			}
+
+			encrypted = encrypted || isSopsEncrypted(contents[p])
+		}
+
+		if !encrypted {
+			continue
+		}
+
+		for i := 0; i < len(members); i++ {
+			groups[members[i]] = ""
+		}
+
+		groups[members[0]] = joined
+	}
+
+	return groups
+}
+
+// splitFileGroupMembers returns the files to be joined into the path in the order of the documents
+func splitFileGroupMembers(joined string, groups map[string]string) []string {
+	ext := filepath.Ext(joined)
+	base := strings.TrimSuffix(joined, ext)
+
+	var members []string
+
+	for i := 0; ; i++ {
+		p := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if _, ok := groups[p]; !ok {
+			return members
+		}
+
+		members = append(members, p)
+	}
+}
+
+// isSopsEncrypted returns true when any document in the YAML or JSON content has the top-level `sops` metadata key.
+// Content that cannot be decoded as YAML is never considered encrypted, so that it is passed through as-is.
+func isSopsEncrypted(content []byte) bool {
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var node yaml.Node
+		if err := dec.Decode(&node); err != nil {
+			return false
+		}
+
+		if len(node.Content) == 0 || node.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+
+		mappings := node.Content[0].Content
+		for i := 0; i+1 < len(mappings); i += 2 {
+			if mappings[i].Value == "sops" {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package fluxrepo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/flux-repo/pkg/encrypt"
+	"go.mozilla.org/sops/keyservice"
+	"google.golang.org/grpc"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const testKMSKeyARN = "arn:aws:kms:us-east-1:000000000000:key/test"
+
+// fakeKeyService encrypts data keys by reversing the bytes, so that sops-encrypted files can be decrypted without KMS
+type fakeKeyService struct{}
+
+func reversed(bs []byte) []byte {
+	res := make([]byte, len(bs))
+	for i, b := range bs {
+		res[len(bs)-1-i] = b
+	}
+
+	return res
+}
+
+func (fakeKeyService) Encrypt(ctx context.Context, in *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return &keyservice.EncryptResponse{Ciphertext: reversed(in.Plaintext)}, nil
+}
+
+func (fakeKeyService) Decrypt(ctx context.Context, in *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	return &keyservice.DecryptResponse{Plaintext: reversed(in.Ciphertext)}, nil
+}
+
+// unavailableKeyService fails to decrypt data keys, like KMS without the permission
+type unavailableKeyService struct{ fakeKeyService }
+
+func (unavailableKeyService) Decrypt(ctx context.Context, in *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	return nil, errors.New("access denied")
+}
+
+// testDecryptableSops encrypts with a fake KMS key, so that the encrypted files can be decrypted
+func testDecryptableSops() *encrypt.Sops {
+	return &encrypt.Sops{
+		KMS:            testKMSKeyARN,
+		EncryptedRegex: "^(data|stringData)$",
+		KeyServices:    []keyservice.KeyServiceClient{fakeKeyService{}},
+	}
+}
+
+// decodeDocuments returns the non-empty documents in the YAML or JSON content
+func decodeDocuments(t *testing.T, content string) []interface{} {
+	t.Helper()
+
+	var docs []interface{}
+
+	dec := yaml.NewDecoder(strings.NewReader(content))
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			t.Fatalf("decoding %s: %v", content, err)
+		}
+
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+
+	return docs
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, m := range matches {
+		names = append(names, filepath.Base(m))
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func TestDecryptRoundTrip(t *testing.T) {
+	secret := `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+stringData:
+  password: pass1
+`
+
+	configMap := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: ns1
+data:
+  foo: bar
+`
+
+	files := map[string]string{
+		"secret.yaml": secret,
+		// Encrypted as a whole in the binary format, as .yml isn't a format known to sops
+		"secret.yml":  secret,
+		"secret.json": `{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "app", "namespace": "ns1"}, "stringData": {"password": "pass1"}}`,
+		// Split into mixed.0.yaml and mixed.1.yaml
+		"mixed.yaml":     secret + "---\n" + configMap,
+		"configmap.yaml": configMap,
+		// Named like split files, but not written by the filter
+		"values.0.yaml": "foo: bar\n",
+		"values.1.yaml": "foo: baz\n",
+	}
+
+	in := tempDir(t)
+	defer os.RemoveAll(in)
+
+	enc := tempDir(t)
+	defer os.RemoveAll(enc)
+
+	dec := tempDir(t)
+	defer os.RemoveAll(dec)
+
+	writeFiles(t, in, files)
+
+	sop := testDecryptableSops()
+
+	if _, err := WriteContext(context.Background(), WriteOptions{Input: in, Output: enc, Sops: sop}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Added by hand. Files that aren't YAML are passed through too
+	writeFiles(t, enc, map[string]string{"notes.txt": "foo: [\n"})
+	files["notes.txt"] = "foo: [\n"
+
+	want := []string{"configmap.yaml", "mixed.0.yaml", "mixed.1.yaml", "notes.txt", "secret.json", "secret.yaml", "secret.yml", "values.0.yaml", "values.1.yaml"}
+	if got := listFiles(t, enc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected encrypted files: want %v, got %v", want, got)
+	}
+
+	for _, name := range []string{"mixed.0.yaml", "secret.json", "secret.yaml", "secret.yml"} {
+		if got := readFile(t, filepath.Join(enc, name)); strings.Contains(got, "pass1") || !isSopsEncrypted([]byte(got)) {
+			t.Errorf("expected %s to be encrypted, got:\n%s", name, got)
+		}
+	}
+
+	info, err := DecryptContext(context.Background(), WriteOptions{Input: enc, Output: dec, Sops: sop})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Files) != len(files) {
+		t.Errorf("expected %d written files, got %v", len(files), info.Files)
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if got := listFiles(t, dec); !reflect.DeepEqual(got, names) {
+		t.Fatalf("unexpected decrypted files: want %v, got %v", names, got)
+	}
+
+	for _, name := range names {
+		got := readFile(t, filepath.Join(dec, name))
+
+		switch name {
+		case "secret.yml", "configmap.yaml", "values.0.yaml", "values.1.yaml", "notes.txt":
+			if got != files[name] {
+				t.Errorf("expected %s to be the same as the input:\nwant:\n%s\ngot:\n%s", name, files[name], got)
+			}
+
+			continue
+		case "secret.json":
+			if !json.Valid([]byte(got)) {
+				t.Errorf("expected %s to be decrypted into JSON, got:\n%s", name, got)
+			}
+		}
+
+		if w, g := decodeDocuments(t, files[name]), decodeDocuments(t, got); !reflect.DeepEqual(w, g) {
+			t.Errorf("expected %s to have the same documents as the input:\nwant:\n%s\ngot:\n%s", name, files[name], got)
+		}
+	}
+}
+
+func TestDecryptNoFilesOnError(t *testing.T) {
+	in := tempDir(t)
+	defer os.RemoveAll(in)
+
+	enc := tempDir(t)
+	defer os.RemoveAll(enc)
+
+	dec := tempDir(t)
+	defer os.RemoveAll(dec)
+
+	writeFiles(t, in, map[string]string{
+		"configmap.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  foo: bar\n",
+		"secret.yaml":    "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\nstringData:\n  password: pass1\n",
+	})
+
+	if _, err := WriteContext(context.Background(), WriteOptions{Input: in, Output: enc, Sops: testDecryptableSops()}); err != nil {
+		t.Fatal(err)
+	}
+
+	sop := testDecryptableSops()
+	sop.KeyServices = []keyservice.KeyServiceClient{unavailableKeyService{}}
+
+	// configmap.yaml is passed through before secret.yaml fails to be decrypted
+	if _, err := DecryptContext(context.Background(), WriteOptions{Input: enc, Output: dec, Sops: sop}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if got := listFiles(t, dec); len(got) != 0 {
+		t.Errorf("expected no file to be written, got %v", got)
+	}
+}
@@ -0,0 +1,101 @@
+package fluxrepo
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMissingName is returned when a Secret to be sanitized has no metadata.name
+	ErrMissingName = errors.New("no metadata.name found for secret")
+
+	// ErrNonRefValue is returned when a Secret data value to be restored isn't a ref
+	ErrNonRefValue = errors.New("secret data value must start with ref+ to be restored")
+
+	// ErrRevertUnsupported is returned when a write fails after saving secrets into a backend that is unable to revert the save
+	ErrRevertUnsupported = errors.New("the backend is unable to revert saves. The saved version is left unreferenced")
+)
+
+// SanitizedValueError is returned when a Secret to be sanitized already has a ref as a data value,
+// like a sanitized manifest given to write by mistake
+type SanitizedValueError struct {
+	Namespace string
+	Name      string
+	Key       string
+}
+
+func (e *SanitizedValueError) Error() string {
+	return fmt.Sprintf("unexpected secret data value of %s/%s/%s: it must NOT start with ref+ to be sanitized", e.Namespace, e.Name, e.Key)
+}
+
+// Operations of secret provider backends reported in BackendError
+const (
+	BackendOpSave          = "save"
+	BackendOpLoad          = "load"
+	BackendOpListVersions  = "list versions"
+	BackendOpDeleteVersion = "delete version"
+	BackendOpRevert        = "revert"
+	// BackendOpReadCurrentVersion is reading the version that the save expects to be current
+	BackendOpReadCurrentVersion = "read the current version of"
+)
+
+// BackendError is returned when a secret provider backend fails.
+// Use errors.As to distinguish failures of the secrets store from problems in the manifests.
+type BackendError struct {
+	// Op is one of the BackendOp* constants
+	Op string
+	// Target is the ref, the path or the version the operation failed for. Can be empty
+	Target string
+	Err    error
+}
+
+func (e *BackendError) Error() string {
+	if e.Target == "" {
+		return fmt.Sprintf("backend failed to %s: %v", e.Op, e.Err)
+	}
+
+	return fmt.Sprintf("backend failed to %s %s: %v", e.Op, e.Target, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// ConflictError is returned when another writer updates the backend path between reading its current version and saving.
+// Running the write again saves on top of the competing version.
+type ConflictError struct {
+	Path string
+	// Expected is the version read before saving. Empty when nothing was saved at the path
+	Expected string
+	// Actual is the competing version. Empty when unknown
+	Actual string
+	// Orphaned is the version saved despite the conflict by backends that can only detect conflicts after saving.
+	// Nothing references it. Empty for backends that detect conflicts before saving
+	Orphaned string
+	// OrphanedLabel is the label attached to the orphaned version, if any
+	OrphanedLabel string
+}
+
+func (e *ConflictError) Error() string {
+	expected, actual := e.Expected, e.Actual
+
+	if expected == "" {
+		expected = "none"
+	}
+
+	if actual == "" {
+		actual = "unknown"
+	}
+
+	msg := fmt.Sprintf("conflict: %s was updated by another writer. Expected the current version to be %s, but it's %s. Run the write again to save on top of it", e.Path, expected, actual)
+
+	if e.Orphaned != "" {
+		msg += fmt.Sprintf(". The version %s saved by this write is left unreferenced", e.Orphaned)
+
+		if e.OrphanedLabel != "" {
+			msg += fmt.Sprintf(" with the label %s", e.OrphanedLabel)
+		}
+	}
+
+	return msg
+}
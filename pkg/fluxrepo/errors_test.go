@@ -0,0 +1,157 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestConflictErrorMessage(t *testing.T) {
+	testcases := []struct {
+		name string
+		err  *ConflictError
+		want string
+	}{
+		{
+			name: "created",
+			err:  &ConflictError{Path: "app"},
+			want: "conflict: app was updated by another writer. Expected the current version to be none, but it's unknown. Run the write again to save on top of it",
+		},
+		{
+			name: "orphaned",
+			err:  &ConflictError{Path: "/app", Expected: "1", Actual: "2", Orphaned: "3", OrphanedLabel: ssmConflictLabel},
+			want: "conflict: /app was updated by another writer. Expected the current version to be 1, but it's 2. Run the write again to save on top of it. The version 3 saved by this write is left unreferenced with the label flux-repo-conflict",
+		},
+		{
+			name: "orphaned without label",
+			err:  &ConflictError{Path: "/app", Expected: "1", Actual: "2", Orphaned: "3"},
+			want: "conflict: /app was updated by another writer. Expected the current version to be 1, but it's 2. Run the write again to save on top of it. The version 3 saved by this write is left unreferenced",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.err.Error(); got != tc.want {
+				t.Errorf("unexpected message:\nwant: %s\ngot:  %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWriteContextErrors(t *testing.T) {
+	testcases := []struct {
+		name    string
+		input   string
+		backend SecretProviderBackend
+		check   func(t *testing.T, err error)
+	}{
+		{
+			name:    "missing name",
+			input:   "apiVersion: v1\nkind: Secret\nmetadata:\n  namespace: ns1\nstringData:\n  password: pass1\n",
+			backend: &memoryBackend{Path: "app"},
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, ErrMissingName) {
+					t.Errorf("expected ErrMissingName, got %v", err)
+				}
+			},
+		},
+		{
+			name:    "sanitized value",
+			input:   "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\n  namespace: ns1\nstringData:\n  password: ref+memory://app?version=1#/ns1/app/password\n",
+			backend: &memoryBackend{Path: "app"},
+			check: func(t *testing.T, err error) {
+				var sanitized *SanitizedValueError
+				if !errors.As(err, &sanitized) {
+					t.Fatalf("expected SanitizedValueError, got %v", err)
+				}
+
+				if want := (SanitizedValueError{Namespace: "ns1", Name: "app", Key: "password"}); *sanitized != want {
+					t.Errorf("unexpected error: want %+v, got %+v", want, *sanitized)
+				}
+			},
+		},
+		{
+			name:    "backend",
+			input:   "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\n  namespace: ns1\nstringData:\n  password: pass1\n",
+			backend: &failingBackend{memoryBackend: memoryBackend{Path: "app"}},
+			check: func(t *testing.T, err error) {
+				var backendErr *BackendError
+				if !errors.As(err, &backendErr) {
+					t.Fatalf("expected BackendError, got %v", err)
+				}
+
+				if backendErr.Op != BackendOpSave {
+					t.Errorf("unexpected operation: want %s, got %s", BackendOpSave, backendErr.Op)
+				}
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetMemoryStore()
+			defer resetMemoryStore()
+
+			in := tempDir(t)
+			defer os.RemoveAll(in)
+
+			out := tempDir(t)
+			defer os.RemoveAll(out)
+
+			writeFiles(t, in, map[string]string{"secret.yaml": tc.input})
+
+			_, err := WriteContext(context.Background(), WriteOptions{Input: in, Output: out, Backend: tc.backend})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			tc.check(t, err)
+		})
+	}
+}
+
+func TestSecretProviderConflictError(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	secrets := NewSecretProvider(&memoryBackend{Path: "app"})
+	secrets.Add("ns1", "app", "password", "pass1")
+
+	if err := secrets.ReadCurrentVersions(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer saves in the meantime
+	if err := (&memoryBackend{Path: "app"}).Save(ctx, map[string]map[string]Secret{"ns1": {"app": {"password": "pass2"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := secrets.Save(ctx)
+
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected ConflictError, got %v", err)
+	}
+
+	if conflict.Path != "app" || conflict.Expected != "" || conflict.Actual != "1" {
+		t.Errorf("unexpected error: %+v", *conflict)
+	}
+}
+
+func TestReadContextNonRefValue(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"secret.yaml": "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\nstringData:\n  password: pass1\n",
+	})
+
+	err := ReadContext(context.Background(), ReadOptions{Input: dir, Output: &bytes.Buffer{}})
+	if !errors.Is(err, ErrNonRefValue) {
+		t.Errorf("expected ErrNonRefValue, got %v", err)
+	}
+}
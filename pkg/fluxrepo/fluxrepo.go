@@ -1,98 +1,144 @@
 package fluxrepo
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"strings"
 
-	"github.com/variantdev/vals"
 	yaml "gopkg.in/yaml.v3"
 )
 
 type Secret map[string]string
 
-func RestoreSecrets(r *vals.Runtime, node yaml.Node) (*yaml.Node, error) {
+// RestoreSecrets returns a copy of the node with the refs in the stringData of the Secret resolved with r.
+// Values saved base64-encoded because they aren't valid UTF-8 are restored into `data` instead.
+// Secrets in the items of List kinds are restored too. Nodes other than Secrets are returned as-is.
+func RestoreSecrets(ctx context.Context, r RefResolver, node yaml.Node) (*yaml.Node, error) {
 	if node.Kind != yaml.DocumentNode {
 		return nil, fmt.Errorf("unexpected kind of node: expected %d, got %d", yaml.DocumentNode, node.Kind)
 	}
 
+	if _, ok := listItems(node); ok {
+		return mapListItems(node, func(item yaml.Node) (*yaml.Node, error) {
+			return RestoreSecrets(ctx, r, item)
+		})
+	}
+
 	var res yaml.Node
 	res = node
 
-	var kk yaml.Node
-	var vv yaml.Node
-	var ii int
-
-	isSecret := false
-	mappings := node.Content[0].Content
-	for i := 0; i < len(mappings); i += 2 {
-		j := i + 1
-		k := mappings[i]
-		v := mappings[j]
+	if !isSecretNode(node) {
+		return &res, nil
+	}
 
-		if k.Value == "kind" && v.Value == "Secret" {
-			isSecret = true
-		}
+	// Indices of the data and stringData keys in the mapping, or -1 when absent
+	dataIndex, stringDataIndex := -1, -1
 
-		if k.Value == "stringData" {
-			ii = i
-			kk = *k
-			vv = *v
+	mappings := node.Content[0].Content
+	for i := 0; i+1 < len(mappings); i += 2 {
+		switch mappings[i].Value {
+		case "data":
+			dataIndex = i
+		case "stringData":
+			stringDataIndex = i
 		}
 	}
 
-	if isSecret {
-		stringDataNodeValue := vv
+	if stringDataIndex < 0 {
+		return &res, nil
+	}
 
-		stringDataMappingNodes := stringDataNodeValue.Content
-		stringDataNodeValue.Content = make([]*yaml.Node, len(stringDataNodeValue.Content))
-		for i := 0; i < len(stringDataMappingNodes); i += 2 {
-			valNode := stringDataMappingNodes[i+1]
+	stringData := mappings[stringDataIndex+1]
 
-			refValue := valNode.Value
-			if !strings.HasPrefix(refValue, "ref+") {
-				return nil, fmt.Errorf("unexpected secret data value: it must start with ref+ to be restored: got %q", refValue)
-			}
+	restored := *stringData
+	restored.Content = nil
 
-			dataKey := "sec"
-			dec, err := r.Eval(map[string]interface{}{dataKey: refValue})
-			if err != nil {
-				return nil, err
-			}
+	var binary []*yaml.Node
 
-			origValue := dec[dataKey].(string)
+	for i := 0; i+1 < len(stringData.Content); i += 2 {
+		keyNode, valNode := stringData.Content[i], stringData.Content[i+1]
 
-			valNode.Value = origValue
+		origValue, err := r.Resolve(ctx, valNode.Value)
+		if err != nil {
+			return nil, err
+		}
 
-			keyNode := stringDataMappingNodes[i]
+		v := *valNode
 
-			stringDataNodeValue.Content[i] = keyNode
-			stringDataNodeValue.Content[i+1] = valNode
+		if RefEncoding(valNode.Value) == RefEncodingBase64 {
+			v.Value = base64.StdEncoding.EncodeToString([]byte(origValue))
+			binary = append(binary, keyNode, &v)
+			continue
 		}
 
-		res.Content[0].Content[ii] = &kk
-		res.Content[0].Content[ii+1] = &stringDataNodeValue
+		v.Value = origValue
+		restored.Content = append(restored.Content, keyNode, &v)
 	}
 
+	root := *node.Content[0]
+	root.Content = nil
+
+	for i := 0; i+1 < len(mappings); i += 2 {
+		switch i {
+		case stringDataIndex:
+			if len(restored.Content) > 0 || len(binary) == 0 {
+				root.Content = append(root.Content, mappings[i], &restored)
+			}
+
+			if len(binary) > 0 && dataIndex < 0 {
+				root.Content = append(root.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "data"},
+					&yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: binary},
+				)
+			}
+		case dataIndex:
+			data := *mappings[i+1]
+			if len(binary) > 0 && data.Kind != yaml.MappingNode {
+				// e.g. `data:` with no value
+				data = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			data.Content = append(append([]*yaml.Node{}, data.Content...), binary...)
+
+			root.Content = append(root.Content, mappings[i], &data)
+		default:
+			root.Content = append(root.Content, mappings[i], mappings[i+1])
+		}
+	}
+
+	res.Content = []*yaml.Node{&root}
+
 	return &res, nil
 }
 
+// SanitizeSecrets schedules the data of the Secret to be saved into the secrets provider when add is true,
+// and replaces the data with refs otherwise.
+//
+// `data` and `stringData` are merged into a single `stringData` with the Kubernetes semantics, where stringData wins.
+// A key that exists in both with different values is recorded in secrets.Warnings.
+// Secrets without metadata.namespace are saved under secrets.DefaultNamespace.
+// Secrets in the items of List kinds, like the output of `kubectl get -o yaml`, are sanitized too.
+// Sanitized Secrets are annotated with ChecksumAnnotation when secrets.ChecksumSalt is set.
 func SanitizeSecrets(secrets *SecretProvider, node yaml.Node, add bool) (*yaml.Node, error) {
 	if node.Kind != yaml.DocumentNode {
 		return nil, fmt.Errorf("unexpected kind of node: expected %d, got %d", yaml.DocumentNode, node.Kind)
 	}
 
+	if _, ok := listItems(node); ok {
+		return mapListItems(node, func(item yaml.Node) (*yaml.Node, error) {
+			return SanitizeSecrets(secrets, item, add)
+		})
+	}
+
 	var res yaml.Node
 	res = node
 
-	var kk yaml.Node
-	var vv yaml.Node
-	var ii int
-
 	var ns, name string
+	var labels, annotations map[string]string
 
-	var hasData, isStringData bool
+	// Indices of the data and stringData keys in the mapping, or -1 when absent
+	dataIndex, stringDataIndex := -1, -1
 
 	isSecret := false
 	mappings := node.Content[0].Content
@@ -116,82 +162,163 @@ func SanitizeSecrets(secrets *SecretProvider, node yaml.Node, add bool) (*yaml.N
 					ns = mv.Value
 				case "name":
 					name = mv.Value
+				case "labels":
+					labels = stringMap(mv)
+				case "annotations":
+					annotations = stringMap(mv)
 				}
 			}
 		}
 
 		if k.Value == "data" {
-			ii = i
-			kk = *k
-			vv = *v
-
-			hasData = true
+			dataIndex = i
 		}
 
 		if k.Value == "stringData" {
-			ii = i
-			kk = *k
-			vv = *v
-
-			isStringData = true
+			stringDataIndex = i
 		}
 	}
 
-	if isSecret {
-		if name == "" {
-			panic("BUG: No metadata.name found for secret")
-		}
+	if !isSecret {
+		return &res, nil
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("sanitizing secret in namespace %q: %w", ns, ErrMissingName)
+	}
 
-		stringDataNodeValue := vv
+	// The manifest is left as-is, so that the namespace can be added later, e.g. by kustomize
+	ns = secrets.namespaceOr(ns)
 
-		stringDataMappingNodes := stringDataNodeValue.Content
-		stringDataNodeValue.Content = make([]*yaml.Node, len(stringDataNodeValue.Content))
-		for i := 0; i < len(stringDataMappingNodes); i += 2 {
-			keyNode := stringDataMappingNodes[i]
-			valNode := stringDataMappingNodes[i+1]
+	// Secrets without data, like service account tokens populated by Kubernetes, have nothing to sanitize
+	if dataIndex < 0 && stringDataIndex < 0 {
+		return &res, nil
+	}
 
-			rawOrigValue := valNode.Value
+	if add {
+		if err := secrets.Route(ns, name, labels, annotations); err != nil {
+			return nil, err
+		}
+	}
 
-			var origValue string
+	type entry struct {
+		keyNode, valNode *yaml.Node
+		value            string
+	}
 
-			if hasData {
-				bs, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(rawOrigValue)))
-				if err != nil {
-					return nil, fmt.Errorf("uenxpected error while decoding base64-encded secret data field: %w", err)
-				}
+	var entries []*entry
+	byKey := map[string]*entry{}
 
-				origValue = string(bs)
-			} else if isStringData {
-				origValue = rawOrigValue
-			} else {
-				panic("BUG: unexpected condition: either data or stringData must be detected before reaching here")
-			}
+	if dataIndex >= 0 {
+		data := mappings[dataIndex+1]
+
+		for i := 0; i+1 < len(data.Content); i += 2 {
+			keyNode, valNode := data.Content[i], data.Content[i+1]
 
-			if strings.HasPrefix(origValue, "ref+") {
-				return nil, fmt.Errorf("unexpected secret data value: it must NOT start with ref+ to be sanitized")
+			bs, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(valNode.Value)))
+			if err != nil {
+				return nil, fmt.Errorf("decoding data.%s of secret %s/%s: %w", keyNode.Value, ns, name, err)
 			}
 
-			if add {
-				secrets.Add(ns, name, keyNode.Value, origValue)
-			} else {
-				refValue, err := secrets.GetRef(ns, name, keyNode.Value)
-				if err != nil {
-					return nil, err
+			e := &entry{keyNode: keyNode, valNode: valNode, value: string(bs)}
+			entries = append(entries, e)
+			byKey[keyNode.Value] = e
+		}
+	}
+
+	if stringDataIndex >= 0 {
+		stringData := mappings[stringDataIndex+1]
+
+		for i := 0; i+1 < len(stringData.Content); i += 2 {
+			keyNode, valNode := stringData.Content[i], stringData.Content[i+1]
+
+			if e, ok := byKey[keyNode.Value]; ok {
+				if add && e.value != valNode.Value {
+					secrets.Warnings = append(secrets.Warnings, fmt.Sprintf("secret %s/%s has different values for %s in data and stringData. The one in stringData is used", ns, name, keyNode.Value))
 				}
-				valNode.Value = refValue
+
+				// The key stays at its position in data, while its comments come from stringData
+				e.keyNode, e.valNode, e.value = keyNode, valNode, valNode.Value
+				continue
 			}
 
-			stringDataNodeValue.Content[i] = keyNode
-			stringDataNodeValue.Content[i+1] = valNode
+			e := &entry{keyNode: keyNode, valNode: valNode, value: valNode.Value}
+			entries = append(entries, e)
+			byKey[keyNode.Value] = e
+		}
+	}
+
+	// The merged stringData takes the place of whichever of data and stringData comes first
+	first := dataIndex
+	if first < 0 || (stringDataIndex >= 0 && stringDataIndex < first) {
+		first = stringDataIndex
+	}
+
+	stringDataNode := *mappings[first+1]
+	stringDataNode.Content = nil
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.value, "ref+") {
+			return nil, &SanitizedValueError{Namespace: ns, Name: name, Key: e.keyNode.Value}
 		}
 
-		if !add {
-			kk.Value = "stringData"
+		if add {
+			secrets.Add(ns, name, e.keyNode.Value, e.value)
+			continue
 		}
 
-		res.Content[0].Content[ii] = &kk
-		res.Content[0].Content[ii+1] = &stringDataNodeValue
+		refValue, err := secrets.GetRef(ns, name, e.keyNode.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		valNode := *e.valNode
+		valNode.Value = refValue
+		valNode.Tag = "!!str"
+		// Refs are single-line
+		valNode.Style &^= yaml.LiteralStyle | yaml.FoldedStyle
+
+		stringDataNode.Content = append(stringDataNode.Content, e.keyNode, &valNode)
+	}
+
+	if add {
+		return &res, nil
+	}
+
+	root := *node.Content[0]
+	root.Content = nil
+
+	for i := 0; i+1 < len(mappings); i += 2 {
+		switch i {
+		case first:
+			keyNode := *mappings[i]
+			keyNode.Value = "stringData"
+
+			root.Content = append(root.Content, &keyNode, &stringDataNode)
+		case dataIndex, stringDataIndex:
+		default:
+			root.Content = append(root.Content, mappings[i], mappings[i+1])
+		}
 	}
 
+	sanitized := &root
+
+	if secrets.ChecksumSalt != "" {
+		c, _ := secrets.checksum(ns, name)
+		sanitized = withAnnotation(sanitized, ChecksumAnnotation, c)
+	}
+
+	res.Content = []*yaml.Node{sanitized}
+
 	return &res, nil
 }
+
+func stringMap(node *yaml.Node) map[string]string {
+	m := map[string]string{}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		m[node.Content[i].Value] = node.Content[i+1].Value
+	}
+
+	return m
+}
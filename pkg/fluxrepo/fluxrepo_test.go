@@ -0,0 +1,296 @@
+package fluxrepo
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// binaryValue isn't valid UTF-8, like keystores and keytabs
+const binaryValue = "\xfe\xed\xfe\xed\x00\x00\x00\x02\xff"
+
+func parseDocument(t *testing.T, content string) yaml.Node {
+	t.Helper()
+
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &node); err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
+
+func encodeDocument(t *testing.T, node *yaml.Node) string {
+	t.Helper()
+
+	bs, err := EncodeYAMLDocuments([]yaml.Node{*node})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(bs)
+}
+
+func TestSecretsRoundTripNonUTF8(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	node := parseDocument(t, `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+data:
+  keystore: `+base64.StdEncoding.EncodeToString([]byte(binaryValue))+`
+stringData:
+  user: admin
+`)
+
+	secrets := NewSecretProvider(&memoryBackend{Path: "app"})
+
+	if _, err := SanitizeSecrets(secrets, node, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := secrets.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sanitized, err := SanitizeSecrets(secrets, node, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+stringData:
+  keystore: ref+memory://app?version=1&encoding=base64#/ns1/app/keystore
+  user: ref+memory://app?version=1#/ns1/app/user
+`
+	if got := encodeDocument(t, sanitized); got != want {
+		t.Fatalf("unexpected sanitized secret:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	restored, err := RestoreSecrets(ctx, NewRefResolver(nil), *sanitized)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+stringData:
+  user: admin
+data:
+  keystore: ` + base64.StdEncoding.EncodeToString([]byte(binaryValue)) + `
+`
+	if got := encodeDocument(t, restored); got != want {
+		t.Errorf("unexpected restored secret:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestRestoreSecretsNonUTF8IntoExistingData(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	backend := &memoryBackend{Path: "app"}
+
+	if err := backend.Save(ctx, map[string]map[string]Secret{"ns1": {"app": {"keystore": base64.StdEncoding.EncodeToString([]byte(binaryValue))}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// data added to the sanitized Secret by hand, or by a tool like kustomize
+	node := parseDocument(t, `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+data:
+  ca.crt: Q0E=
+stringData:
+  keystore: ref+memory://app?version=1&encoding=base64#/ns1/app/keystore
+`)
+
+	restored, err := RestoreSecrets(ctx, NewRefResolver(nil), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+data:
+  ca.crt: Q0E=
+  keystore: ` + base64.StdEncoding.EncodeToString([]byte(binaryValue)) + `
+`
+	if got := encodeDocument(t, restored); got != want {
+		t.Errorf("unexpected restored secret:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestRestoreSecretsNonUTF8WithVals(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Refs of schemes unknown to the backends are resolved with vals, which doesn't understand the encoding param
+	writeFiles(t, dir, map[string]string{
+		"secrets.yaml": "ns1:\n  app:\n    keystore: " + base64.StdEncoding.EncodeToString([]byte(binaryValue)) + "\n",
+	})
+
+	path := filepath.ToSlash(filepath.Join(dir, "secrets.yaml"))
+
+	ref := "ref+file:///" + path + "?encoding=base64#/ns1/app/keystore"
+
+	if got, want := removeRefParam(ref, RefEncodingParam), "ref+file:///"+path+"#/ns1/app/keystore"; got != want {
+		t.Fatalf("unexpected ref without the encoding: want %s, got %s", want, got)
+	}
+
+	node := parseDocument(t, `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+stringData:
+  keystore: `+ref+`
+`)
+
+	restored, err := RestoreSecrets(context.Background(), NewRefResolver(nil), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := encodeDocument(t, restored)
+
+	if want := "data:\n  keystore: " + base64.StdEncoding.EncodeToString([]byte(binaryValue)) + "\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("unexpected restored secret:\nwant the suffix:\n%s\ngot:\n%s", want, got)
+	}
+
+	if strings.Contains(got, "stringData") {
+		t.Errorf("expected the binary value to be moved out of stringData, got:\n%s", got)
+	}
+}
+
+func TestSanitizeSecretsMergesDataAndStringData(t *testing.T) {
+	testcases := []struct {
+		name     string
+		input    string
+		want     string
+		secret   Secret
+		warnings []string
+	}{
+		{
+			name: "data first",
+			input: `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+data:
+  # the password
+  password: b2xk
+  user: YWRtaW4=
+type: Opaque
+stringData:
+  token: tok
+  # the new password
+  password: new
+`,
+			// The key in both stays at its position in data, with the comments of stringData
+			want: `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+stringData:
+  # the new password
+  password: ref+memory://app?version=1#/ns1/app/password
+  user: ref+memory://app?version=1#/ns1/app/user
+  token: ref+memory://app?version=1#/ns1/app/token
+type: Opaque
+`,
+			secret:   Secret{"password": "new", "user": "admin", "token": "tok"},
+			warnings: []string{"secret ns1/app has different values for password in data and stringData. The one in stringData is used"},
+		},
+		{
+			name: "stringData first",
+			input: `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+stringData:
+  token: tok
+  user: admin
+type: Opaque
+data:
+  user: YWRtaW4=
+  password: cGFzcw==
+`,
+			want: `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: ns1
+stringData:
+  user: ref+memory://app?version=1#/ns1/app/user
+  password: ref+memory://app?version=1#/ns1/app/password
+  token: ref+memory://app?version=1#/ns1/app/token
+type: Opaque
+`,
+			secret: Secret{"password": "pass", "user": "admin", "token": "tok"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetMemoryStore()
+			defer resetMemoryStore()
+
+			node := parseDocument(t, tc.input)
+
+			secrets := NewSecretProvider(&memoryBackend{Path: "app"})
+
+			if _, err := SanitizeSecrets(secrets, node, true); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := secrets.Save(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			sanitized, err := SanitizeSecrets(secrets, node, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := encodeDocument(t, sanitized); got != tc.want {
+				t.Errorf("unexpected sanitized secret:\nwant:\n%s\ngot:\n%s", tc.want, got)
+			}
+
+			if got := secrets.Secrets["ns1"]["app"]; !reflect.DeepEqual(got, tc.secret) {
+				t.Errorf("unexpected saved secret: want %v, got %v", tc.secret, got)
+			}
+
+			if !reflect.DeepEqual(secrets.Warnings, tc.warnings) {
+				t.Errorf("unexpected warnings: want %v, got %v", tc.warnings, secrets.Warnings)
+			}
+		})
+	}
+}
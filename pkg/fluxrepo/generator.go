@@ -0,0 +1,268 @@
+package fluxrepo
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Generator generates new secret values for `flux-repo rotate`.
+type Generator interface {
+	// Generate returns the new values of the secret data keys to be rotated.
+	// It usually returns only key, but it may also return companion keys of key found in current,
+	// like the public key of an SSH private key, so that they are rotated together.
+	Generate(name, key string, current Secret) (map[string]string, error)
+}
+
+// GeneratorUsage describes the generators accepted by ParseGenerator.
+const GeneratorUsage = `random[:LENGTH]: alphanumeric string. LENGTH defaults to 32
+password[:LENGTH]: alphanumeric string mixed with symbols. LENGTH defaults to 32
+hex[:BYTES]: hex-encoded random bytes. BYTES defaults to 32
+uuid: random (version 4) UUID
+ssh-key[:BITS]: PEM-encoded RSA private key. BITS defaults to 4096. KEY.pub is rotated too, when the secret has it
+tls-self-signed[:HOST,...]: self-signed certificate valid for a year. Both tls.crt and tls.key are rotated`
+
+const (
+	alphanumericChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	symbolChars       = "!#$%&()*+,-./:;<=>?@[]^_{|}~"
+)
+
+// ParseGenerator parses a generator spec in the form of NAME[:ARG], like "random:32".
+func ParseGenerator(spec string) (Generator, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	intArg := func(def int) (int, error) {
+		if arg == "" {
+			return def, nil
+		}
+
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("parsing generator %q: expected a positive integer after %s:, got %q", spec, name, arg)
+		}
+
+		return n, nil
+	}
+
+	switch name {
+	case "random":
+		n, err := intArg(32)
+		if err != nil {
+			return nil, err
+		}
+		return &randomGenerator{length: n, chars: alphanumericChars}, nil
+	case "password":
+		n, err := intArg(32)
+		if err != nil {
+			return nil, err
+		}
+		if n < 4 {
+			return nil, fmt.Errorf("parsing generator %q: passwords must be at least 4 characters long", spec)
+		}
+		return &randomGenerator{length: n, chars: alphanumericChars + symbolChars, password: true}, nil
+	case "hex":
+		n, err := intArg(32)
+		if err != nil {
+			return nil, err
+		}
+		return &hexGenerator{bytes: n}, nil
+	case "uuid":
+		if arg != "" {
+			return nil, fmt.Errorf("parsing generator %q: uuid takes no argument", spec)
+		}
+		return &uuidGenerator{}, nil
+	case "ssh-key":
+		n, err := intArg(4096)
+		if err != nil {
+			return nil, err
+		}
+		if n < 2048 {
+			return nil, fmt.Errorf("parsing generator %q: RSA keys must be at least 2048 bits", spec)
+		}
+		return &sshKeyGenerator{bits: n}, nil
+	case "tls-self-signed":
+		var hosts []string
+		if arg != "" {
+			hosts = strings.Split(arg, ",")
+		}
+		return &tlsSelfSignedGenerator{hosts: hosts}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported generator: %s", spec)
+}
+
+type randomGenerator struct {
+	length int
+	chars  string
+	// password is true when the value must contain at least one upper, lower, digit and symbol character
+	password bool
+}
+
+func (g *randomGenerator) Generate(name, key string, current Secret) (map[string]string, error) {
+	for {
+		v, err := randomString(g.length, g.chars)
+		if err != nil {
+			return nil, err
+		}
+
+		if !g.password || isStrongPassword(v) {
+			return map[string]string{key: v}, nil
+		}
+	}
+}
+
+func randomString(length int, chars string) (string, error) {
+	max := big.NewInt(int64(len(chars)))
+
+	buf := make([]byte, length)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("generating random string: %w", err)
+		}
+		buf[i] = chars[n.Int64()]
+	}
+
+	return string(buf), nil
+}
+
+func isStrongPassword(v string) bool {
+	return strings.ContainsAny(v, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") &&
+		strings.ContainsAny(v, "abcdefghijklmnopqrstuvwxyz") &&
+		strings.ContainsAny(v, "0123456789") &&
+		strings.ContainsAny(v, symbolChars)
+}
+
+type hexGenerator struct {
+	bytes int
+}
+
+func (g *hexGenerator) Generate(name, key string, current Secret) (map[string]string, error) {
+	buf := make([]byte, g.bytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("generating random bytes: %w", err)
+	}
+
+	return map[string]string{key: hex.EncodeToString(buf)}, nil
+}
+
+type uuidGenerator struct{}
+
+func (g *uuidGenerator) Generate(name, key string, current Secret) (map[string]string, error) {
+	u, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{key: u}, nil
+}
+
+// newUUID returns a random UUID
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", fmt.Errorf("generating random bytes: %w", err)
+	}
+
+	// Version 4, variant 10 as per RFC 4122
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+type sshKeyGenerator struct {
+	bits int
+}
+
+func (g *sshKeyGenerator) Generate(name, key string, current Secret) (map[string]string, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, g.bits)
+	if err != nil {
+		return nil, fmt.Errorf("generating RSA key: %w", err)
+	}
+
+	res := map[string]string{
+		key: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})),
+	}
+
+	pubKey := key + ".pub"
+	if _, ok := current[pubKey]; ok {
+		pub, err := ssh.NewPublicKey(&priv.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("encoding SSH public key: %w", err)
+		}
+
+		res[pubKey] = string(ssh.MarshalAuthorizedKey(pub))
+	}
+
+	return res, nil
+}
+
+type tlsSelfSignedGenerator struct {
+	hosts []string
+}
+
+func (g *tlsSelfSignedGenerator) Generate(name, key string, current Secret) (map[string]string, error) {
+	if key != "tls.crt" && key != "tls.key" {
+		return nil, fmt.Errorf("tls-self-signed generates tls.crt and tls.key: got %s", key)
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating RSA key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial number: %w", err)
+	}
+
+	cn := name
+	if len(g.hosts) > 0 {
+		cn = g.hosts[0]
+	}
+
+	now := time.Now()
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now,
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, h := range g.hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate: %w", err)
+	}
+
+	return map[string]string{
+		"tls.crt": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"tls.key": string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})),
+	}, nil
+}
@@ -0,0 +1,336 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Rules reported by CheckStaged in addition to ScanRulePlaintextSecret
+const (
+	// CheckRuleUnexpectedBackend is a ref to a backend other than the allowed ones
+	CheckRuleUnexpectedBackend = "unexpected-backend"
+	// CheckRuleUnexpectedPath is a ref to a backend path outside the allowed prefixes
+	CheckRuleUnexpectedPath = "unexpected-path"
+	// CheckRuleDeniedFile is a file under the paths that must never be committed
+	CheckRuleDeniedFile = "denied-file"
+)
+
+// hookMarker identifies hooks installed by InstallHook, so that they can be overwritten on reinstall
+const hookMarker = "# Installed by flux-repo hook install."
+
+type CheckStagedOptions struct {
+	// AllowedBackends is the list of backend names refs may point to. Any backend is allowed when empty.
+	// Refs produced by plugins are matched by their scheme.
+	AllowedBackends []string
+	// AllowedPathPrefixes is the list of backend path prefixes refs may point to. Any path is allowed when empty
+	AllowedPathPrefixes []string
+	// AllowedTargets is the list of pairs of backends and path prefixes refs may point to, like the routes of write.
+	// Unlike AllowedBackends and AllowedPathPrefixes, a ref must match both of a single pair. Ignored when empty
+	AllowedTargets []CheckTarget
+	// DeniedPaths is the list of files and directories that must never be committed, like the `-f` input directory of write.
+	// Relative paths are relative to the working directory.
+	DeniedPaths []string
+}
+
+// CheckTarget is a backend and a path prefix that refs may point to
+type CheckTarget struct {
+	// Backend is the name of the backend. Any backend is allowed when empty, like for plugins whose ref scheme is unknown
+	Backend string
+	// PathPrefix is the prefix of the backend path. Any path is allowed when empty
+	PathPrefix string
+}
+
+func (t CheckTarget) String() string {
+	b := t.Backend
+	if b == "" {
+		b = "*"
+	}
+
+	return b + ":" + t.PathPrefix + "*"
+}
+
+// CheckStagedResult is the result of CheckStaged
+type CheckStagedResult struct {
+	// Findings block the commit
+	Findings []ScanFinding
+	// Warnings are about files that are only partially checked, like templates that aren't valid YAML
+	Warnings []string
+}
+
+// CheckStaged checks the files staged in the git repository containing dir, so that it can block a commit that
+// contains Secrets with plaintext data, refs to unexpected backends or paths, or files under DeniedPaths.
+// Files are read from the index rather than the working tree, so that what's checked is what's going to be committed.
+//
+// Files that can't be parsed, like Helm chart templates, are still checked for refs, and reported in the warnings
+// rather than failing the whole check.
+func CheckStaged(ctx context.Context, dir string, opts CheckStagedOptions) (*CheckStagedResult, error) {
+	top, err := runGit(ctx, dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+
+	root := strings.TrimSpace(string(top))
+
+	var denied []string
+
+	for _, p := range opts.DeniedPaths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+
+		// git prints the toplevel with symlinks resolved
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+
+		rel, err := filepath.Rel(root, abs)
+		if err != nil {
+			return nil, err
+		}
+
+		denied = append(denied, filepath.ToSlash(rel))
+	}
+
+	staged, err := runGit(ctx, root, "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, f := range strings.Split(string(staged), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+
+	res := &CheckStagedResult{}
+
+	for _, f := range files {
+		if d := deniedBy(f, denied); d != "" {
+			res.Findings = append(res.Findings, ScanFinding{
+				Rule:    CheckRuleDeniedFile,
+				Message: fmt.Sprintf("File is under %s, which must never be committed", d),
+				File:    f,
+				Line:    1,
+				Column:  1,
+			})
+			continue
+		}
+
+		if !isManifestFile(f) {
+			continue
+		}
+
+		content, err := runGit(ctx, root, "show", ":"+f)
+		if err != nil {
+			return res, err
+		}
+
+		fs, warnings := checkContent(f, content, opts)
+
+		res.Findings = append(res.Findings, fs...)
+		res.Warnings = append(res.Warnings, warnings...)
+	}
+
+	return res, nil
+}
+
+// deniedBy returns the denied path that contains the file, or an empty string when there's none
+func deniedBy(file string, denied []string) string {
+	for _, d := range denied {
+		if d == "." || file == d || strings.HasPrefix(file, d+"/") {
+			return d
+		}
+	}
+
+	return ""
+}
+
+// checkContent returns the findings in the content of the file, along with warnings about the parts that couldn't be checked.
+// Refs are found in the raw content, so that they are checked even in files that aren't valid YAML.
+func checkContent(file string, content []byte, opts CheckStagedOptions) ([]ScanFinding, []string) {
+	var warnings []string
+
+	// Content that can't be parsed is reported as a finding
+	scanned := ScanContent(file, content, ScanOptions{})
+
+	var findings []ScanFinding
+
+	for _, f := range scanned {
+		switch f.Rule {
+		case ScanRulePlaintextSecret:
+			findings = append(findings, f)
+		case ScanRuleUnparsable:
+			warnings = append(warnings, fmt.Sprintf("%s:%d: %s", f.File, f.Line, f.Message))
+		}
+	}
+
+	for _, loc := range refPattern.FindAllIndex(content, -1) {
+		ref := string(content[loc[0]:loc[1]])
+
+		parsed, err := ParseRef(ref)
+		if err != nil {
+			continue
+		}
+
+		line := bytes.Count(content[:loc[0]], []byte("\n")) + 1
+		column := loc[0] - bytes.LastIndexByte(content[:loc[0]], '\n')
+
+		backend := parsed.Scheme
+		if f := LookupBackendByRefScheme(parsed.Scheme); f != nil {
+			backend = f.Name
+		}
+
+		var rule, msg string
+
+		switch {
+		case len(opts.AllowedBackends) > 0 && !containsString(opts.AllowedBackends, backend):
+			rule = CheckRuleUnexpectedBackend
+			msg = fmt.Sprintf("Ref points to the backend %s, which is not one of %s", backend, strings.Join(opts.AllowedBackends, ", "))
+		case len(opts.AllowedPathPrefixes) > 0 && !hasAnyPrefix(parsed.Path, opts.AllowedPathPrefixes):
+			rule = CheckRuleUnexpectedPath
+			msg = fmt.Sprintf("Ref points to the path %s, which doesn't start with any of %s", parsed.Path, strings.Join(opts.AllowedPathPrefixes, ", "))
+		case len(opts.AllowedTargets) > 0:
+			rule, msg = checkTargets(backend, parsed.Path, opts.AllowedTargets)
+			if rule == "" {
+				continue
+			}
+		default:
+			continue
+		}
+
+		findings = append(findings, ScanFinding{
+			Rule:    rule,
+			Message: msg,
+			File:    file,
+			Line:    line,
+			Column:  column,
+			Path:    ref,
+		})
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Line != findings[j].Line {
+			return findings[i].Line < findings[j].Line
+		}
+		return findings[i].Column < findings[j].Column
+	})
+
+	return findings, warnings
+}
+
+// checkTargets returns the rule and the message of the finding for a ref to the backend and path that matches none of the targets,
+// or an empty rule when any of them matches
+func checkTargets(backend, path string, targets []CheckTarget) (string, string) {
+	var backendMatched bool
+
+	var all []string
+
+	for _, t := range targets {
+		all = append(all, t.String())
+
+		if t.Backend != "" && t.Backend != backend {
+			continue
+		}
+
+		backendMatched = true
+
+		if strings.HasPrefix(path, t.PathPrefix) {
+			return "", ""
+		}
+	}
+
+	if !backendMatched {
+		return CheckRuleUnexpectedBackend, fmt.Sprintf("Ref points to the backend %s, which is not one of %s", backend, strings.Join(all, ", "))
+	}
+
+	return CheckRuleUnexpectedPath, fmt.Sprintf("Ref points to the path %s of the backend %s, which doesn't match any of %s", path, backend, strings.Join(all, ", "))
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type HookOptions struct {
+	// Command is the flux-repo executable run by the hook. Defaults to "flux-repo" found in PATH
+	Command string
+	// Args are the flags passed to `flux-repo check-staged`
+	Args []string
+	// Force overwrites the existing pre-commit hook even when it isn't installed by flux-repo
+	Force bool
+}
+
+// InstallHook installs the git pre-commit hook that runs `flux-repo check-staged` into the git repository containing dir.
+// It returns the path to the installed hook.
+func InstallHook(ctx context.Context, dir string, opts HookOptions) (string, error) {
+	out, err := runGit(ctx, dir, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+
+	hooksDir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(hooksDir) {
+		hooksDir = filepath.Join(dir, hooksDir)
+	}
+
+	hook := filepath.Join(hooksDir, "pre-commit")
+
+	if existing, err := ioutil.ReadFile(hook); err == nil {
+		if !opts.Force && !bytes.Contains(existing, []byte(hookMarker)) {
+			return "", fmt.Errorf("installing hook: %s already exists. Remove it or overwrite it with -force", hook)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("installing hook: %w", err)
+	}
+
+	command := opts.Command
+	if command == "" {
+		command = "flux-repo"
+	}
+
+	args := []string{shellQuote(command), "check-staged"}
+	for _, a := range opts.Args {
+		args = append(args, shellQuote(a))
+	}
+
+	script := fmt.Sprintf("#!/bin/sh\n%s\n# Blocks commits containing plaintext secrets. Reinstall to update.\nexec %s\n", hookMarker, strings.Join(args, " "))
+
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		return "", fmt.Errorf("creating directory %s: %w", hooksDir, err)
+	}
+
+	if err := replaceFile(hook, []byte(script), 0755); err != nil {
+		return "", fmt.Errorf("installing hook: %w", err)
+	}
+
+	return hook, nil
+}
+
+// shellQuote quotes s for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
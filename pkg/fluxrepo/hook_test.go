@@ -0,0 +1,103 @@
+package fluxrepo
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCheckContentInvalidYAML(t *testing.T) {
+	content := `apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ .Values.name }}
+stringData:
+  url: ref+vault://team-b/db?version=1#/default/db/url
+{{- if .Values.password }}
+  password: {{ .Values.password }}
+{{- end }}
+`
+
+	findings, warnings := checkContent("templates/secret.yaml", []byte(content), CheckStagedOptions{AllowedPathPrefixes: []string{"team-a/"}})
+
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "templates/secret.yaml") {
+		t.Errorf("expected a warning about the file, got %v", warnings)
+	}
+
+	if len(findings) != 1 || findings[0].Rule != CheckRuleUnexpectedPath || findings[0].Line != 6 {
+		t.Errorf("expected the ref to be checked, got %+v", findings)
+	}
+}
+
+func TestCheckContent(t *testing.T) {
+	content := `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+stringData:
+  password: pass1
+  url: ref+vault://team-b/db?version=1#/default/db/url
+`
+
+	findings, warnings := checkContent("db.yaml", []byte(content), CheckStagedOptions{AllowedPathPrefixes: []string{"team-a/"}})
+
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	var rules []string
+	for _, f := range findings {
+		rules = append(rules, f.Rule)
+	}
+
+	if got, want := strings.Join(rules, ","), ScanRulePlaintextSecret+","+CheckRuleUnexpectedPath; got != want {
+		t.Errorf("unexpected findings: want %s, got %s", want, got)
+	}
+}
+
+func TestCheckContentAllowedTargets(t *testing.T) {
+	content := `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+stringData:
+  a: ref+vault://platform/db?version=1#/default/db/a
+  b: ref+awssecrets://apps/db?version=1#/default/db/b
+  c: ref+vault://apps/db?version=1#/default/db/c
+  d: ref+s3://bucket/db?version=1#/default/db/d
+`
+
+	opts := CheckStagedOptions{
+		AllowedTargets: []CheckTarget{
+			{Backend: "vault", PathPrefix: "platform/"},
+			{Backend: "awssecrets", PathPrefix: "apps/"},
+		},
+	}
+
+	findings, _ := checkContent("db.yaml", []byte(content), opts)
+
+	var got []string
+	for _, f := range findings {
+		got = append(got, fmt.Sprintf("%d:%s", f.Line, f.Rule))
+	}
+
+	// The path of c is allowed for awssecrets but not for vault
+	want := []string{"8:" + CheckRuleUnexpectedPath, "9:" + CheckRuleUnexpectedBackend}
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected findings: want %v, got %v", want, got)
+	}
+}
+
+func TestCheckContentAllowedTargetsAnyBackend(t *testing.T) {
+	content := `stringData:
+  a: ref+myplugin://apps/db#/default/db/a
+  b: ref+myplugin://platform/db#/default/db/b
+`
+
+	findings, _ := checkContent("db.yaml", []byte(content), CheckStagedOptions{AllowedTargets: []CheckTarget{{PathPrefix: "apps/"}}})
+
+	if len(findings) != 1 || findings[0].Line != 3 || findings[0].Rule != CheckRuleUnexpectedPath {
+		t.Errorf("unexpected findings: %+v", findings)
+	}
+}
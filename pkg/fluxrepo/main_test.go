@@ -0,0 +1,309 @@
+package fluxrepo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// The test binary acts as an exec backend plugin when testPluginModeEnv is set, so that ExecBackend can be tested
+// without depending on a plugin written in another language.
+const (
+	testPluginModeEnv = "FLUX_REPO_TEST_PLUGIN_MODE"
+	testPluginDirEnv  = "FLUX_REPO_TEST_PLUGIN_DIR"
+)
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(testPluginModeEnv); mode != "" {
+		if err := runTestPlugin(mode, os.Getenv(testPluginDirEnv)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// runTestPlugin serves a single request of the exec protocol.
+//
+// Modes:
+// - store: saves secrets into numbered files in dir, and loads them
+// - version-mismatch: responds with an unsupported protocol version
+// - error: responds with an error
+// - malformed: responds with something that isn't JSON
+// - bad-template: responds with a refTemplate that fails to render
+func runTestPlugin(mode, dir string) error {
+	var req ExecRequest
+
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		return err
+	}
+
+	res := ExecResponse{ProtocolVersion: ExecProtocolVersion}
+
+	switch mode {
+	case "version-mismatch":
+		res.ProtocolVersion = "flux-repo.exec/v0"
+	case "error":
+		res.Error = "the store is unavailable"
+	case "malformed":
+		_, err := os.Stdout.WriteString("this is not json\n")
+		return err
+	case "bad-template":
+		res.RefTemplate = "ref+test://{{.Path}}?version={{.Nonexistent}}#/{{.Namespace}}/{{.Name}}/{{.Key}}"
+	case "store":
+		prefix := filepath.Join(dir, url.PathEscape(req.Path))
+
+		switch req.Operation {
+		case "save":
+			existing, err := filepath.Glob(prefix + ".*.json")
+			if err != nil {
+				return err
+			}
+
+			res.Version = fmt.Sprintf("%d", len(existing)+1)
+			res.RefTemplate = "ref+test://{{.Path}}?version={{.Version}}#/{{.Namespace}}/{{.Name}}/{{.Key}}"
+
+			bs, err := json.Marshal(req.Secrets)
+			if err != nil {
+				return err
+			}
+
+			if err := ioutil.WriteFile(prefix+"."+res.Version+".json", bs, 0644); err != nil {
+				return err
+			}
+		case "load":
+			bs, err := ioutil.ReadFile(prefix + "." + req.Version + ".json")
+			if err != nil {
+				res.Error = err.Error()
+				break
+			}
+
+			if err := json.Unmarshal(bs, &res.Secrets); err != nil {
+				return err
+			}
+		default:
+			res.Error = "unsupported operation " + req.Operation
+		}
+	default:
+		return fmt.Errorf("unknown test plugin mode %q", mode)
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(res)
+}
+
+// useTestPlugin makes the test binary act as the plugin in the mode, and returns the ExecBackend that runs it.
+// Call the returned function to stop acting as the plugin.
+func useTestPlugin(t *testing.T, mode, path string) (*ExecBackend, func()) {
+	t.Helper()
+
+	dir := tempDir(t)
+
+	os.Setenv(testPluginModeEnv, mode)
+	os.Setenv(testPluginDirEnv, dir)
+
+	cleanup := func() {
+		os.Unsetenv(testPluginModeEnv)
+		os.Unsetenv(testPluginDirEnv)
+		os.RemoveAll(dir)
+	}
+
+	return &ExecBackend{Command: os.Args[0], Path: path}, cleanup
+}
+
+// tempDir returns a temporary directory. The caller removes it
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "flux-repo-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// writeFiles writes the files keyed by their paths relative to dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(bs)
+}
+
+func init() {
+	RegisterBackend(BackendFactory{
+		Name:        "memory",
+		Description: "In-memory store for tests",
+		RefScheme:   "memory",
+		RefVersion:  "version",
+		New: func(path string, opts BackendOptions) (SecretProviderBackend, error) {
+			return &memoryBackend{Path: path}, nil
+		},
+	})
+}
+
+// memoryStore is the storage of memoryBackend, keyed by the path. The version N is at the index N-1
+var memoryStore = map[string][][]byte{}
+
+// memoryShardLimit is the size in bytes above which memoryBackend shards secrets, like the AWS backends do
+var memoryShardLimit = 256
+
+// memoryBackend stores versions of secrets in memory, sharding them in the same way as the AWS backends.
+// It saves conditionally and reverts saves like the backends implementing ConditionalSaver and SaveReverter.
+type memoryBackend struct {
+	Path    string
+	Version string
+
+	shards *secretShards
+
+	// saved is the paths the last Save appended versions to
+	saved []string
+
+	precondition versionPrecondition
+}
+
+func resetMemoryStore() {
+	memoryStore = map[string][][]byte{}
+}
+
+func (s *memoryBackend) FormatRef(ns, name, dataKey string) string {
+	path, version := s.Path, s.Version
+
+	if s.shards != nil {
+		path, version = s.shards.lookup(ns, name, dataKey)
+	}
+
+	return fmt.Sprintf("ref+memory://%s?version=%s#/%s/%s/%s", path, version, ns, name, dataKey)
+}
+
+func (s *memoryBackend) Save(ctx context.Context, sec map[string]map[string]Secret) error {
+	data, err := encodeSecrets(sec)
+	if err != nil {
+		return err
+	}
+
+	s.saved = nil
+
+	precondition := s.precondition
+	s.precondition = versionPrecondition{}
+
+	if current := memoryCurrentVersion(s.Path); precondition.read && current != precondition.version {
+		return &ConflictError{Path: s.Path, Expected: precondition.version, Actual: current}
+	}
+
+	put := func(path string, data []byte) (string, error) {
+		memoryStore[path] = append(memoryStore[path], data)
+		s.saved = append(s.saved, path)
+
+		return fmt.Sprintf("%d", len(memoryStore[path])), nil
+	}
+
+	current := func(path string) ([]byte, bool, error) {
+		versions := memoryStore[path]
+		if len(versions) == 0 {
+			return nil, false, nil
+		}
+
+		return versions[len(versions)-1], true, nil
+	}
+
+	s.shards = nil
+
+	if len(data) <= memoryShardLimit {
+		s.Version, err = put(s.Path, data)
+		if err != nil {
+			return err
+		}
+
+		return clearStaleShards(s.Path, 1, current, put)
+	}
+
+	shards, err := shardSecrets(sec, memoryShardLimit)
+	if err != nil {
+		return err
+	}
+
+	if err := shards.save(s.Path, put); err != nil {
+		return err
+	}
+
+	s.Version = shards.versions[0]
+	s.shards = shards
+
+	return clearStaleShards(s.Path, len(shards.shards), current, put)
+}
+
+func memoryCurrentVersion(path string) string {
+	if len(memoryStore[path]) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d", len(memoryStore[path]))
+}
+
+func (s *memoryBackend) ReadCurrentVersion(ctx context.Context) error {
+	s.precondition = versionPrecondition{read: true, version: memoryCurrentVersion(s.Path)}
+
+	return nil
+}
+
+// RevertSave removes the versions appended by the last Save
+func (s *memoryBackend) RevertSave(ctx context.Context) error {
+	for i := len(s.saved) - 1; i >= 0; i-- {
+		p := s.saved[i]
+		memoryStore[p] = memoryStore[p][:len(memoryStore[p])-1]
+	}
+
+	s.saved = nil
+	s.Version = ""
+	s.shards = nil
+
+	return nil
+}
+
+func (s *memoryBackend) Load(ctx context.Context, version string) (map[string]map[string]Secret, error) {
+	versions := memoryStore[s.Path]
+
+	i := len(versions)
+	if version != "" {
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, err
+		}
+		i = n
+	}
+
+	if i < 1 || i > len(versions) {
+		return nil, fmt.Errorf("version %q of %s not found", version, s.Path)
+	}
+
+	return decodeSecrets(versions[i-1])
+}
@@ -0,0 +1,173 @@
+package fluxrepo
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+type MigrateInfo struct {
+	// Files is the list of files whose refs were rewritten
+	Files []string
+	// Refs is the number of rewritten refs
+	Refs int
+}
+
+type MigrateOptions struct {
+	// Target is the backend the secrets are moved into
+	Target SecretProviderBackend
+	// Resolver resolves the refs to the source backends. Defaults to the one returned by NewRefResolver(BackendOptions)
+	Resolver RefResolver
+	// BackendOptions configures the backends used by the default resolver, and the ones used to verify the new refs
+	BackendOptions BackendOptions
+}
+
+// Migrate moves the secrets referenced from the sanitized manifests under dir into the target backend,
+// and rewrites the refs in place to point to the target backend.
+//
+// The values resolved with the resolver are kept in memory only.
+// Files are rewritten only after every new ref is verified to resolve to the original value.
+// The saved secrets are reverted when the verification or rewriting the files fails.
+func Migrate(ctx context.Context, dir string, opts MigrateOptions) (*MigrateInfo, error) {
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = NewRefResolver(opts.BackendOptions)
+	}
+
+	yamlFiles, err := ReadYAMLFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for path := range yamlFiles {
+		// The encrypted file of the sops backend isn't a manifest
+		if filepath.Ext(path) == ".enc" {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	secrets := NewSecretProvider(opts.Target)
+
+	type refNode struct {
+		ns, name, key string
+		node          *yaml.Node
+		// value is the resolved value, which differs from the saved one when it's saved encoded
+		value string
+	}
+
+	var refs []refNode
+
+	// sources maps NAMESPACE/NAME/KEY to the file and the ref it's first resolved from
+	type source struct {
+		path, ref, value string
+	}
+
+	sources := map[string]source{}
+
+	changed := map[string]bool{}
+
+	for _, path := range paths {
+		nodes := yamlFiles[path]
+
+		for _, doc := range documentsIn(nodes) {
+			ns, name, stringData, ok := SecretStringData(doc)
+			if !ok {
+				continue
+			}
+
+			for j := 0; j+1 < len(stringData.Content); j += 2 {
+				keyNode, valNode := stringData.Content[j], stringData.Content[j+1]
+
+				if !strings.HasPrefix(valNode.Value, "ref+") {
+					continue
+				}
+
+				v, err := resolver.Resolve(ctx, valNode.Value)
+				if err != nil {
+					return nil, fmt.Errorf("resolving %s/%s/%s in %s: %w", ns, name, keyNode.Value, path, err)
+				}
+
+				// Keep the namespace the secret was saved under when it was defaulted on write
+				secretNs := ns
+				if parsed, err := ParseRef(valNode.Value); secretNs == "" && err == nil {
+					secretNs = parsed.Namespace
+				}
+				secretNs = secrets.namespaceOr(secretNs)
+
+				// The target backend holds a single value per key, so refs to different values, like the ones to multiple versions, can't be migrated together
+				k := shardKey(secretNs, name, keyNode.Value)
+				if src, ok := sources[k]; !ok {
+					sources[k] = source{path: path, ref: valNode.Value, value: v}
+				} else if src.value != v {
+					return nil, fmt.Errorf("migrating %s: the refs %s in %s and %s in %s resolve to different values. Run write to save them into a single value first", k, src.ref, src.path, valNode.Value, path)
+				}
+
+				secrets.Add(secretNs, name, keyNode.Value, v)
+
+				refs = append(refs, refNode{ns: secretNs, name: name, key: keyNode.Value, node: valNode, value: v})
+
+				changed[path] = true
+			}
+		}
+	}
+
+	if len(refs) == 0 {
+		return &MigrateInfo{}, nil
+	}
+
+	if err := secrets.ReadCurrentVersions(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := secrets.Save(ctx); err != nil {
+		return nil, revertOnError(secrets, fmt.Errorf("saving secrets into the target backend: %w", err))
+	}
+
+	// Verify the round trip with a fresh resolver, so that nothing is served from the cache of the source backends
+	verifier := NewRefResolver(opts.BackendOptions)
+
+	newRefs := make([]string, len(refs))
+
+	for i, r := range refs {
+		newRef, err := secrets.GetRef(r.ns, r.name, r.key)
+		if err != nil {
+			return nil, revertOnError(secrets, err)
+		}
+
+		v, err := verifier.Resolve(ctx, newRef)
+		if err != nil {
+			return nil, revertOnError(secrets, fmt.Errorf("verifying %s/%s/%s: %w", r.ns, r.name, r.key, err))
+		}
+
+		if v != r.value {
+			return nil, revertOnError(secrets, fmt.Errorf("verifying %s/%s/%s: the value resolved from the new ref differs from the original", r.ns, r.name, r.key))
+		}
+
+		newRefs[i] = newRef
+	}
+
+	for i, r := range refs {
+		r.node.Value = newRefs[i]
+	}
+
+	if err := rewriteFiles(ctx, dir, yamlFiles, paths, changed); err != nil {
+		return nil, revertOnError(secrets, err)
+	}
+
+	info := &MigrateInfo{Refs: len(refs)}
+
+	for _, path := range paths {
+		if changed[path] {
+			info.Files = append(info.Files, path)
+		}
+	}
+
+	return info, nil
+}
@@ -0,0 +1,169 @@
+package fluxrepo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// misreferencingBackend formats refs to a path other than the one it saves to, so that the refs don't resolve
+type misreferencingBackend struct {
+	*memoryBackend
+}
+
+func (s misreferencingBackend) FormatRef(ns, name, dataKey string) string {
+	return strings.Replace(s.memoryBackend.FormatRef(ns, name, dataKey), "ref+memory://"+s.Path, "ref+memory://missing", 1)
+}
+
+func TestMigrate(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	source := &memoryBackend{Path: "src"}
+
+	if err := source.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass1", "user": "user1"}}, "ns2": {"app": {"token": "tok"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	configMap := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  foo: bar\n"
+
+	writeFiles(t, dir, map[string]string{
+		"db.yaml":        secretManifest(source, "ns1", "db", "password", "user"),
+		"db-copy.yaml":   secretManifest(source, "ns1", "db", "password"),
+		"app.yaml":       secretManifest(source, "ns2", "app", "token"),
+		"configmap.yaml": configMap,
+	})
+
+	info, err := Migrate(ctx, dir, MigrateOptions{Target: &memoryBackend{Path: "dst"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Refs != 4 {
+		t.Errorf("expected 4 refs to be rewritten, got %d", info.Refs)
+	}
+
+	if want := []string{filepath.Join(dir, "app.yaml"), filepath.Join(dir, "db-copy.yaml"), filepath.Join(dir, "db.yaml")}; !reflect.DeepEqual(info.Files, want) {
+		t.Errorf("unexpected rewritten files: want %v, got %v", want, info.Files)
+	}
+
+	if got := len(memoryStore["dst"]); got != 1 {
+		t.Fatalf("expected the secrets to be saved into a single version, got %d", got)
+	}
+
+	for _, name := range []string{"app.yaml", "db-copy.yaml", "db.yaml"} {
+		values, refs := resolveMemoryRefs(t, filepath.Join(dir, name))
+
+		for _, r := range refs {
+			if !strings.HasPrefix(r, "ref+memory://dst?version=1#/") {
+				t.Errorf("expected the ref in %s to point to the target, got %s", name, r)
+			}
+		}
+
+		for k, v := range values {
+			want := map[string]string{"ns1/db/password": "pass1", "ns1/db/user": "user1", "ns2/app/token": "tok"}[k]
+			if v != want {
+				t.Errorf("unexpected value of %s in %s: want %q, got %q", k, name, want, v)
+			}
+		}
+	}
+
+	if got := readFile(t, filepath.Join(dir, "configmap.yaml")); got != configMap {
+		t.Errorf("expected the file without refs to be left as is, got:\n%s", got)
+	}
+}
+
+func TestMigrateConflictingValues(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	source := &memoryBackend{Path: "src"}
+
+	if err := source.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	old := secretManifest(source, "ns1", "db", "password")
+
+	if err := source.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass2"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"old.yaml": old,
+		"new.yaml": secretManifest(source, "ns1", "db", "password"),
+	}
+
+	writeFiles(t, dir, files)
+
+	_, err := Migrate(ctx, dir, MigrateOptions{Target: &memoryBackend{Path: "dst"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, want := range []string{"ns1/db/password", "new.yaml", "old.yaml", "resolve to different values"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to contain %q, got %q", want, err.Error())
+		}
+	}
+
+	if got := len(memoryStore["dst"]); got != 0 {
+		t.Errorf("expected nothing to be saved, got %d versions", got)
+	}
+
+	for name, content := range files {
+		if got := readFile(t, filepath.Join(dir, name)); got != content {
+			t.Errorf("expected %s to be left as is, got:\n%s", name, got)
+		}
+	}
+}
+
+func TestMigrateRevertsOnVerificationFailure(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	source := &memoryBackend{Path: "src"}
+
+	if err := source.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	content := secretManifest(source, "ns1", "db", "password")
+
+	writeFiles(t, dir, map[string]string{"db.yaml": content})
+
+	_, err := Migrate(ctx, dir, MigrateOptions{Target: misreferencingBackend{&memoryBackend{Path: "dst"}}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if want := "verifying ns1/db/password"; !strings.Contains(err.Error(), want) {
+		t.Errorf("expected the error to contain %q, got %q", want, err.Error())
+	}
+
+	if got := len(memoryStore["dst"]); got != 0 {
+		t.Errorf("expected the saved secrets to be reverted, got %d versions", got)
+	}
+
+	if got := readFile(t, filepath.Join(dir, "db.yaml")); got != content {
+		t.Errorf("expected the file to be left as is, got:\n%s", got)
+	}
+}
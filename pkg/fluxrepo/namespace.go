@@ -0,0 +1,63 @@
+package fluxrepo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DefaultNamespace is the namespace Secrets without metadata.namespace are saved under, unless specified otherwise.
+// It's the namespace Kubernetes uses for such resources by default.
+const DefaultNamespace = "default"
+
+// kustomizationFileNames are the names of the files kustomize recognizes as kustomizations
+var kustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// KustomizationNamespace returns the namespace set by the nearest kustomization in dir or its parent directories up to root.
+// Only the nearest kustomization is read, as it's the one that includes the files in dir, whereas kustomizations in
+// parent directories don't necessarily include it.
+// It returns an empty string when there's no kustomization, or the nearest one doesn't set the namespace.
+func KustomizationNamespace(dir, root string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		for _, n := range kustomizationFileNames {
+			file := filepath.Join(dir, n)
+
+			bs, err := ioutil.ReadFile(file)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return "", fmt.Errorf("reading kustomization %s: %w", file, err)
+			}
+
+			var k struct {
+				Namespace string `yaml:"namespace"`
+			}
+
+			if err := yaml.Unmarshal(bs, &k); err != nil {
+				return "", fmt.Errorf("parsing kustomization %s: %w", file, err)
+			}
+
+			return k.Namespace, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if dir == root || parent == dir {
+			return "", nil
+		}
+
+		dir = parent
+	}
+}
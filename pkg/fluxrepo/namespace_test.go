@@ -0,0 +1,71 @@
+package fluxrepo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKustomizationNamespace(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	writeFiles(t, root, map[string]string{
+		"kustomization.yaml":            "namespace: root\n",
+		"app/secret.yaml":               "",
+		"base/kustomization.yaml":       "resources:\n- secret.yaml\n",
+		"base/secret.yaml":              "",
+		"overlay/kustomization.yml":     "namespace: overlay\n",
+		"overlay/patches/secret.yaml":   "",
+		"unparsable/kustomization.yaml": "namespace: [\n",
+	})
+
+	testcases := []struct {
+		dir  string
+		want string
+	}{
+		// The kustomization in the parent directory applies when there's none in the directory
+		{dir: "app", want: "root"},
+		// The nearest kustomization doesn't set the namespace, which results in the default namespace
+		{dir: "base", want: ""},
+		{dir: "overlay", want: "overlay"},
+		{dir: "overlay/patches", want: "overlay"},
+		{dir: ".", want: "root"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.dir, func(t *testing.T) {
+			got, err := KustomizationNamespace(filepath.Join(root, tc.dir), root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tc.want {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := KustomizationNamespace(filepath.Join(root, "unparsable"), root); err == nil {
+		t.Error("expected an error for the unparsable kustomization")
+	}
+}
+
+func TestKustomizationNamespaceOutsideRoot(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"kustomization.yaml": "namespace: parent\n",
+		"root/a/secret.yaml": "",
+	})
+
+	got, err := KustomizationNamespace(filepath.Join(dir, "root", "a"), filepath.Join(dir, "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "" {
+		t.Errorf("expected kustomizations above root to be ignored, got %q", got)
+	}
+}
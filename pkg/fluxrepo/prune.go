@@ -0,0 +1,261 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type PruneOptions struct {
+	// GitHistory makes refs contained in any commit of the git repository to be considered referenced
+	GitHistory bool
+	// Retention is the duration unreferenced versions are kept for after their creation.
+	// It's measured from the creation time, not from the time the version stopped being referenced,
+	// so a version that has just been unreferenced is pruned right away when it's older than Retention
+	Retention time.Duration
+	// DryRun reports versions to be pruned without actually pruning them
+	DryRun bool
+
+	BackendOptions BackendOptions
+}
+
+// PruneResult describes what Prune did for a secret saved at Path in the backend
+type PruneResult struct {
+	Backend string
+	Path    string
+	// Supported is false when the backend is unable to prune versions
+	Supported bool
+	// Unsupported is the reason the backend is unable to prune versions, when Supported is false
+	Unsupported string
+
+	Referenced []string
+	Pruned     []BackendVersion
+	// Retained is unreferenced versions that are still within the retention period
+	Retained []BackendVersion
+}
+
+// pruneUnsupportedReasons explains why the backends that don't implement VersionPruner are unable to prune versions
+var pruneUnsupportedReasons = map[string]string{
+	"awsssm": "SSM can't delete individual versions of a parameter. It keeps the latest 100 versions and deletes the oldest one on each write",
+	"sops":   "the encrypted file holds only the latest version. Older versions are in the git history",
+}
+
+// Prune deletes or deprecates versions of the backend secrets referenced from the sanitized manifests under dir,
+// when they are no longer referenced and older than the retention period.
+// The current version of each secret is never pruned.
+func Prune(ctx context.Context, dir string, opts PruneOptions) ([]PruneResult, error) {
+	refs, err := findRefsInDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.GitHistory {
+		histRefs, err := findRefsInGitHistory(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		refs = append(refs, histRefs...)
+	}
+
+	type target struct {
+		factory *BackendFactory
+		path    string
+	}
+
+	targets := map[string]*target{}
+	referenced := map[string]map[string]bool{}
+
+	for _, ref := range refs {
+		parsed, err := ParseRef(ref)
+		if err != nil {
+			continue
+		}
+
+		f := LookupBackendByRefScheme(parsed.Scheme)
+		if f == nil {
+			continue
+		}
+
+		k := parsed.Scheme + "://" + parsed.Path
+
+		if _, ok := targets[k]; !ok {
+			targets[k] = &target{factory: f, path: parsed.Path}
+			referenced[k] = map[string]bool{}
+		}
+
+		if f.RefVersion != "" {
+			if v := parsed.Params.Get(f.RefVersion); v != "" {
+				referenced[k][v] = true
+			}
+		}
+	}
+
+	var keys []string
+	for k := range targets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	threshold := time.Now().Add(-opts.Retention)
+
+	var results []PruneResult
+
+	for _, k := range keys {
+		t := targets[k]
+
+		res := PruneResult{
+			Backend: t.factory.Name,
+			Path:    t.path,
+		}
+
+		for v := range referenced[k] {
+			res.Referenced = append(res.Referenced, v)
+		}
+		sort.Strings(res.Referenced)
+
+		backend, err := t.factory.newBackend(t.path, "", opts.BackendOptions)
+		if err != nil {
+			return results, err
+		}
+
+		pruner, ok := backend.(VersionPruner)
+		if !ok {
+			res.Unsupported = pruneUnsupportedReasons[t.factory.Name]
+			if res.Unsupported == "" {
+				res.Unsupported = fmt.Sprintf("%s backend does not support pruning versions", t.factory.Name)
+			}
+
+			results = append(results, res)
+			continue
+		}
+
+		res.Supported = true
+
+		versions, err := pruner.ListVersions(ctx)
+		if err != nil {
+			return results, &BackendError{Op: BackendOpListVersions, Target: k, Err: err}
+		}
+
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Created.Before(versions[j].Created)
+		})
+
+		for _, v := range versions {
+			if v.Current || referenced[k][v.ID] {
+				continue
+			}
+
+			if v.Created.After(threshold) {
+				res.Retained = append(res.Retained, v)
+				continue
+			}
+
+			if !opts.DryRun {
+				if err := pruner.DeleteVersion(ctx, v.ID); err != nil {
+					results = append(results, res)
+					return results, &BackendError{Op: BackendOpDeleteVersion, Target: v.ID + " of " + k, Err: err}
+				}
+			}
+
+			res.Pruned = append(res.Pruned, v)
+		}
+
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+func findRefsInDir(dir string) ([]string, error) {
+	var refs []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading file %s: %w", path, err)
+		}
+
+		refs = append(refs, FindRefs(content)...)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
+
+// findRefsInGitHistory returns refs contained in the files under dir in every commit reachable from any ref of the git repository.
+func findRefsInGitHistory(ctx context.Context, dir string) ([]string, error) {
+	revList, err := runGit(ctx, dir, "rev-list", "--all", "--", ".")
+	if err != nil {
+		return nil, err
+	}
+
+	revs := strings.Fields(string(revList))
+
+	var refs []string
+
+	// Batched to not exceed the maximum command-line length
+	const batchSize = 100
+
+	for i := 0; i < len(revs); i += batchSize {
+		end := i + batchSize
+		if end > len(revs) {
+			end = len(revs)
+		}
+
+		args := append([]string{"grep", "-h", "-I", "-o", "-E", `ref\+[a-z0-9]+://[^[:space:]"']+`}, revs[i:end]...)
+		args = append(args, "--", ".")
+
+		out, err := runGit(ctx, dir, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		refs = append(refs, FindRefs(out)...)
+	}
+
+	return refs, nil
+}
+
+func runGit(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// git-grep exits with 1 when nothing matched
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && stderr.Len() == 0 {
+			return stdout.Bytes(), nil
+		}
+
+		return nil, fmt.Errorf("running git %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,47 @@
+package fluxrepo
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestPruneUnsupported(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"secret.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: foo
+stringData:
+  a: ref+awsssm://foo/bar?mode=singleparam&version=2#/default/foo/a
+  b: ref+memory://foo/baz?version=1#/default/foo/b
+`,
+	})
+
+	results, err := Prune(context.Background(), dir, PruneOptions{BackendOptions: BackendOptions{"aws-region": {"us-east-2"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", results)
+	}
+
+	want := map[string]string{
+		"awsssm": pruneUnsupportedReasons["awsssm"],
+		"memory": "memory backend does not support pruning versions",
+	}
+
+	for _, r := range results {
+		if r.Supported {
+			t.Errorf("expected %s to be unsupported", r.Backend)
+		}
+
+		if r.Unsupported != want[r.Backend] {
+			t.Errorf("unexpected reason for %s: %q", r.Backend, r.Unsupported)
+		}
+	}
+}
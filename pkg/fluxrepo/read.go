@@ -1,65 +1,95 @@
 package fluxrepo
 
 import (
-	"bytes"
-	"fmt"
+	"context"
+	"errors"
+	"io"
+	"os"
 	"path/filepath"
+	"sort"
 
-	"github.com/variantdev/vals"
 	yaml "gopkg.in/yaml.v3"
 )
 
+// ReadOptions configures ReadContext
+type ReadOptions struct {
+	// Input is the sanitized manifest file or the directory containing sanitized manifests
+	Input string
+	// Output is where the restored manifests are written to. Defaults to os.Stdout
+	Output io.Writer
+	// Resolver resolves refs into secret values. Defaults to the one returned by NewRefResolver(BackendOptions)
+	Resolver RefResolver
+	// BackendOptions configures the backends used by the default resolver
+	BackendOptions BackendOptions
+}
+
+// Read restores the secrets in the sanitized manifests under path and prints the manifests to stdout.
+//
+// Deprecated: Use ReadContext.
 func Read(path string) error {
-	yamlFiles, err := ReadYAMLFiles(path)
-	if err != nil {
-		return err
+	return ReadWithBackendOptions(path, nil)
+}
+
+// ReadWithBackendOptions is the same as Read, except that the backends used for resolving refs are configured with opts.
+//
+// Deprecated: Use ReadContext.
+func ReadWithBackendOptions(path string, opts BackendOptions) error {
+	return ReadContext(context.Background(), ReadOptions{Input: path, BackendOptions: opts})
+}
+
+// ReadContext restores the secrets in the sanitized manifests in opts.Input and writes the manifests to opts.Output
+// as a multi-document YAML stream.
+// Cancelling ctx aborts the API calls to the secrets store.
+func ReadContext(ctx context.Context, opts ReadOptions) error {
+	if opts.Input == "" {
+		return errors.New("reading: no input specified")
 	}
 
-	runtime, err := vals.New(vals.Options{})
+	out := opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+
+	runtime := opts.Resolver
+	if runtime == nil {
+		runtime = NewRefResolver(opts.BackendOptions)
+	}
+
+	yamlFiles, err := ReadYAMLFiles(opts.Input)
 	if err != nil {
 		return err
 	}
 
-	var fileIndex int
-
-	for path, nodes := range yamlFiles {
+	var paths []string
+	for path := range yamlFiles {
 		// For sops backend, the user may have saved the encrypted file under the same directory as the target files
 		// If we didn't skip the encrypted file, it is emitted as-is, which breaks e.g. `flux-repo read | kubectl apply -f -`.
 		if filepath.Ext(path) == ".enc" {
 			continue
 		}
 
-		var res []yaml.Node
-		for _, node := range nodes {
-			n, err := RestoreSecrets(runtime, node)
-			if err != nil {
-				return err
-			}
-			res = append(res, *n)
-		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
 
-		for i, node := range res {
-			buf := &bytes.Buffer{}
-			encoder := yaml.NewEncoder(buf)
-			encoder.SetIndent(2)
+	var res []yaml.Node
 
-			if err := encoder.Encode(&node); err != nil {
+	for _, path := range paths {
+		for _, node := range yamlFiles[path] {
+			n, err := RestoreSecrets(ctx, runtime, node)
+			if err != nil {
 				return err
 			}
-
-			print(buf.String())
-
-			if i != len(res)-1 {
-				fmt.Println("---")
-			}
-		}
-
-		if fileIndex != len(yamlFiles)-1 {
-			fmt.Println("---")
+			res = append(res, *n)
 		}
+	}
 
-		fileIndex++
+	data, err := EncodeYAMLDocuments(res)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	_, err = out.Write(data)
+
+	return err
 }
@@ -0,0 +1,233 @@
+package fluxrepo
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/variantdev/vals"
+)
+
+// Ref is a parsed `ref+SCHEME://PATH?PARAMS#/NAMESPACE/NAME/KEY` URL produced by SecretProviderBackend.FormatRef
+type Ref struct {
+	Scheme string
+	Path   string
+	Params url.Values
+
+	Namespace, Name, Key string
+}
+
+const (
+	// RefEncodingParam is the query parameter of refs to values saved encoded in the backend
+	RefEncodingParam = "encoding"
+	// RefEncodingBase64 marks values that aren't valid UTF-8, like keystores and keytabs.
+	// They're saved base64-encoded, and restored into the `data` of Secrets byte-for-byte.
+	RefEncodingBase64 = "base64"
+)
+
+// ParseRef parses a ref produced by flux-repo.
+func ParseRef(ref string) (*Ref, error) {
+	if !strings.HasPrefix(ref, "ref+") {
+		return nil, fmt.Errorf("parsing ref %q: it must start with ref+", ref)
+	}
+
+	u, err := url.Parse(strings.TrimPrefix(ref, "ref+"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing ref %q: %w", ref, err)
+	}
+
+	fragment := strings.SplitN(strings.TrimPrefix(u.Fragment, "/"), "/", 3)
+	if len(fragment) != 3 {
+		return nil, fmt.Errorf("parsing ref %q: the fragment must be in the form of #/NAMESPACE/NAME/KEY", ref)
+	}
+
+	return &Ref{
+		Scheme:    u.Scheme,
+		Path:      u.Host + u.Path,
+		Params:    u.Query(),
+		Namespace: fragment[0],
+		Name:      fragment[1],
+		Key:       fragment[2],
+	}, nil
+}
+
+// RefEncoding returns the encoding of the value the ref points to, or an empty string for values saved as-is
+func RefEncoding(ref string) string {
+	parsed, err := ParseRef(ref)
+	if err != nil {
+		return ""
+	}
+
+	return parsed.Params.Get(RefEncodingParam)
+}
+
+// setRefParam adds the query parameter to the ref, keeping the fragment
+func setRefParam(ref, key, value string) string {
+	split := strings.SplitN(ref, "#", 2)
+
+	sep := "?"
+	if strings.Contains(split[0], "?") {
+		sep = "&"
+	}
+
+	split[0] += sep + url.QueryEscape(key) + "=" + url.QueryEscape(value)
+
+	return strings.Join(split, "#")
+}
+
+// removeRefParam removes the query parameter from the ref, so that the ref can be resolved by vals
+func removeRefParam(ref, key string) string {
+	split := strings.SplitN(ref, "#", 2)
+
+	u, err := url.Parse(strings.TrimPrefix(split[0], "ref+"))
+	if err != nil {
+		return ref
+	}
+
+	q := u.Query()
+	if _, ok := q[key]; !ok {
+		return ref
+	}
+
+	q.Del(key)
+	u.RawQuery = q.Encode()
+
+	split[0] = "ref+" + u.String()
+
+	return strings.Join(split, "#")
+}
+
+var refPattern = regexp.MustCompile(`ref\+[a-z0-9]+://[^\s"']+`)
+
+// FindRefs returns all the refs contained in the content, in the order of appearance.
+// It works on any text, so that refs in YAML, JSON and even in git objects are found.
+func FindRefs(content []byte) []string {
+	var refs []string
+
+	for _, m := range refPattern.FindAll(content, -1) {
+		refs = append(refs, string(m))
+	}
+
+	return refs
+}
+
+// RefResolver resolves a ref into the original secret value
+type RefResolver interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// NewRefResolver returns a RefResolver that loads secrets with the backends configured with opts,
+// so that refs are resolved with the same options and authentication as `flux-repo write`.
+// Refs whose scheme isn't known to any backend are resolved with vals.
+func NewRefResolver(opts BackendOptions) RefResolver {
+	return &backendRefResolver{
+		opts:   opts,
+		loaded: map[string]map[string]map[string]Secret{},
+	}
+}
+
+type backendRefResolver struct {
+	opts BackendOptions
+	vals *vals.Runtime
+
+	// loaded caches secrets loaded from backends, keyed by scheme, path and version
+	loaded map[string]map[string]map[string]Secret
+}
+
+func (r *backendRefResolver) Resolve(ctx context.Context, ref string) (string, error) {
+	if !strings.HasPrefix(ref, "ref+") {
+		return "", fmt.Errorf("restoring %q: %w", ref, ErrNonRefValue)
+	}
+
+	parsed, err := ParseRef(ref)
+	if err != nil {
+		return r.resolveWithVals(ctx, ref)
+	}
+
+	v, err := r.resolveParsed(ctx, ref, parsed)
+	if err != nil {
+		return "", err
+	}
+
+	switch enc := parsed.Params.Get(RefEncodingParam); enc {
+	case "":
+		return v, nil
+	case RefEncodingBase64:
+		bs, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return "", fmt.Errorf("resolving %s: decoding base64: %w", ref, err)
+		}
+
+		return string(bs), nil
+	default:
+		return "", fmt.Errorf("resolving %s: unsupported encoding %q", ref, enc)
+	}
+}
+
+func (r *backendRefResolver) resolveParsed(ctx context.Context, ref string, parsed *Ref) (string, error) {
+	f := LookupBackendByRefScheme(parsed.Scheme)
+	if f == nil {
+		return r.resolveWithVals(ctx, removeRefParam(ref, RefEncodingParam))
+	}
+
+	var version string
+	if f.RefVersion != "" {
+		version = parsed.Params.Get(f.RefVersion)
+	}
+
+	cacheKey := fmt.Sprintf("%s://%s?%s", parsed.Scheme, parsed.Path, version)
+
+	sec, ok := r.loaded[cacheKey]
+	if !ok {
+		backend, err := f.newBackend(parsed.Path, "", r.opts)
+		if err != nil {
+			return "", err
+		}
+
+		sec, err = backend.Load(ctx, version)
+		if err != nil {
+			return "", &BackendError{Op: BackendOpLoad, Target: ref, Err: err}
+		}
+
+		r.loaded[cacheKey] = sec
+	}
+
+	v, ok := sec[parsed.Namespace][parsed.Name][parsed.Key]
+	if !ok {
+		return "", fmt.Errorf("resolving %s: no secret data found for %s/%s/%s", ref, parsed.Namespace, parsed.Name, parsed.Key)
+	}
+
+	return v, nil
+}
+
+// resolveWithVals resolves the ref with vals, which doesn't accept a context. ctx is checked only before resolving.
+func (r *backendRefResolver) resolveWithVals(ctx context.Context, ref string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	if r.vals == nil {
+		runtime, err := vals.New(vals.Options{})
+		if err != nil {
+			return "", err
+		}
+
+		r.vals = runtime
+	}
+
+	dataKey := "sec"
+	dec, err := r.vals.Eval(map[string]interface{}{dataKey: ref})
+	if err != nil {
+		return "", &BackendError{Op: BackendOpLoad, Target: ref, Err: err}
+	}
+
+	v, ok := dec[dataKey].(string)
+	if !ok {
+		return "", fmt.Errorf("resolving %s: expected a string, got %T", ref, dec[dataKey])
+	}
+
+	return v, nil
+}
@@ -0,0 +1,443 @@
+package fluxrepo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+type RotateOptions struct {
+	Generator      Generator
+	BackendOptions BackendOptions
+	// ChecksumSalt is the salt write used for the checksum annotations.
+	// It's required for rotating Secrets with the annotation, so that their checksums and the ones of the workloads referencing them are updated.
+	ChecksumSalt string
+}
+
+// rotatedSecretDoc is a sanitized Secret referencing the rotated key
+type rotatedSecretDoc struct {
+	path string
+	doc  *yaml.Node
+	// ns is the namespace in the manifest, which is empty when omitted
+	ns string
+}
+
+type RotateInfo struct {
+	// Keys is the list of rotated secret data keys
+	Keys []string
+	// Refs maps each rotated key to its new ref
+	Refs map[string]string
+	// Files is the list of files whose refs were rewritten
+	Files []string
+}
+
+// Rotate generates a new value for the secret data key referenced from the sanitized manifests under dir,
+// and saves it as a new version of the backend secret the key is stored in.
+// Every other value in the backend secret is carried over unchanged, and only the refs to the rotated keys are rewritten,
+// except that all the refs to sharded secrets are rewritten, as the keys may move across shards.
+//
+// target is in the form of NAMESPACE/NAME/KEY.
+func Rotate(ctx context.Context, dir, target string, opts RotateOptions) (*RotateInfo, error) {
+	split := strings.SplitN(target, "/", 3)
+	if len(split) != 3 || split[1] == "" || split[2] == "" {
+		return nil, fmt.Errorf("invalid secret %q: expected NAMESPACE/NAME/KEY", target)
+	}
+
+	ns, name, key := split[0], split[1], split[2]
+
+	yamlFiles, err := ReadYAMLFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for path := range yamlFiles {
+		if filepath.Ext(path) == ".enc" {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var (
+		ref     string
+		parsed  *Ref
+		targets []rotatedSecretDoc
+	)
+
+	for _, path := range paths {
+		nodes := yamlFiles[path]
+
+		for _, doc := range documentsIn(nodes) {
+			n, nm, stringData, ok := SecretStringData(doc)
+			if !ok || !secretMatches(n, nm, stringData, ns, name) {
+				continue
+			}
+
+			for j := 0; j+1 < len(stringData.Content); j += 2 {
+				if stringData.Content[j].Value != key {
+					continue
+				}
+
+				r := stringData.Content[j+1].Value
+
+				p, err := ParseRef(r)
+				if err != nil {
+					return nil, fmt.Errorf("rotating %s: %w", target, err)
+				}
+
+				// Refs in multiple backends or paths, like the ones for multiple clusters, can't be told apart by the key
+				if parsed != nil && (p.Scheme != parsed.Scheme || p.Path != parsed.Path) {
+					return nil, fmt.Errorf("rotating %s: the key is referenced from both %s and %s. Run rotate on the directory containing only one of them", target, ref, r)
+				}
+
+				ref, parsed = r, p
+
+				targets = append(targets, rotatedSecretDoc{path: path, doc: doc, ns: n})
+			}
+		}
+	}
+
+	if ref == "" {
+		return nil, fmt.Errorf("rotating %s: no secret data key found in %s", target, dir)
+	}
+
+	for _, t := range targets {
+		if opts.ChecksumSalt == "" && annotationOf(t.doc.Content[0], ChecksumAnnotation) != "" {
+			return nil, fmt.Errorf("rotating %s: the secret in %s has the %s annotation. Specify the salt of the checksums written by write to update it", target, t.path, ChecksumAnnotation)
+		}
+	}
+
+	f := LookupBackendByRefScheme(parsed.Scheme)
+	if f == nil {
+		return nil, fmt.Errorf("rotating %s: no backend supports loading refs with the scheme %q", target, parsed.Scheme)
+	}
+
+	refVersion := func(r *Ref) string {
+		if f.RefVersion == "" {
+			return ""
+		}
+
+		return r.Params.Get(f.RefVersion)
+	}
+
+	// Secrets too large for a single backend entry are sharded across paths, and the save below shards them again.
+	// Every shard referenced from the manifests is loaded, so that the keys in the other shards survive the save.
+	base := shardBasePath(parsed.Path)
+
+	versions := map[string]string{parsed.Path: refVersion(parsed)}
+
+	var conflict error
+
+	eachRef(yamlFiles, paths, func(_ string, r *Ref, _ *yaml.Node) {
+		if r.Scheme != parsed.Scheme || r.Path == parsed.Path || shardBasePath(r.Path) != base {
+			return
+		}
+
+		v := refVersion(r)
+
+		if existing, ok := versions[r.Path]; ok && existing != v && conflict == nil {
+			conflict = fmt.Errorf("rotating %s: refs point to both versions %s and %s of the shard %s. Run write to save the secrets into a single version first", target, existing, v, r.Path)
+		}
+
+		versions[r.Path] = v
+	})
+
+	if conflict != nil {
+		return nil, conflict
+	}
+
+	backend, err := NewBackend(f.Name, base, opts.BackendOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := NewSecretProvider(backend)
+
+	// Read before loading, so that the save fails instead of overwriting a write made while rotating
+	if err := secrets.ReadCurrentVersions(ctx); err != nil {
+		return nil, err
+	}
+
+	sec := map[string]map[string]Secret{}
+
+	for _, p := range sortedKeys(versions) {
+		shard, err := NewBackend(f.Name, p, opts.BackendOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		loaded, err := shard.Load(ctx, versions[p])
+		if err != nil {
+			loadTarget := ref
+			if p != parsed.Path {
+				loadTarget = p
+			}
+
+			return nil, &BackendError{Op: BackendOpLoad, Target: loadTarget, Err: err}
+		}
+
+		for n, secrets := range loaded {
+			if _, ok := sec[n]; !ok {
+				sec[n] = map[string]Secret{}
+			}
+
+			for nm, secret := range secrets {
+				if _, ok := sec[n][nm]; !ok {
+					sec[n][nm] = Secret{}
+				}
+
+				for k, v := range secret {
+					sec[n][nm][k] = v
+				}
+			}
+		}
+	}
+
+	current, ok := sec[parsed.Namespace][parsed.Name]
+	if !ok {
+		return nil, fmt.Errorf("rotating %s: no secret found for %s/%s in %s", target, parsed.Namespace, parsed.Name, ref)
+	}
+
+	generated, err := opts.Generator.Generate(name, key, current)
+	if err != nil {
+		return nil, fmt.Errorf("rotating %s: %w", target, err)
+	}
+
+	for k, v := range generated {
+		current[k] = v
+	}
+
+	secrets.Secrets = sec
+
+	if err := secrets.Save(ctx); err != nil {
+		return nil, revertOnError(secrets, err)
+	}
+
+	info := &RotateInfo{Keys: sortedKeys(generated), Refs: map[string]string{}}
+
+	for k := range generated {
+		info.Refs[k] = backend.FormatRef(parsed.Namespace, parsed.Name, k)
+	}
+
+	// Refs to the other keys are rewritten too when the secrets are sharded, as the keys may have moved across shards
+	sharded := len(versions) > 1
+
+	for n, secrets := range sec {
+		for nm, secret := range secrets {
+			for k := range secret {
+				if r, err := ParseRef(backend.FormatRef(n, nm, k)); err == nil && r.Path != base {
+					sharded = true
+				}
+			}
+		}
+	}
+
+	changed := map[string]bool{}
+
+	eachRef(yamlFiles, paths, func(path string, r *Ref, node *yaml.Node) {
+		// Refs to other backends and paths may have the same namespace, name and key
+		if r.Scheme != parsed.Scheme {
+			return
+		}
+
+		if _, ok := versions[r.Path]; !ok {
+			return
+		}
+
+		if _, ok := sec[r.Namespace][r.Name][r.Key]; !ok {
+			return
+		}
+
+		newRef, rotated := info.Refs[r.Key]
+		rotated = rotated && r.Namespace == parsed.Namespace && r.Name == parsed.Name
+
+		if !rotated {
+			if !sharded {
+				return
+			}
+
+			newRef = backend.FormatRef(r.Namespace, r.Name, r.Key)
+
+			// Values saved encoded are still saved encoded
+			if enc := r.Params.Get(RefEncodingParam); enc != "" {
+				newRef = setRefParam(newRef, RefEncodingParam, enc)
+			}
+		}
+
+		node.Value = newRef
+		changed[path] = true
+	})
+
+	if opts.ChecksumSalt != "" {
+		updateChecksums(opts.ChecksumSalt, checksum(opts.ChecksumSalt, current), name, yamlFiles, paths, targets, changed)
+	}
+
+	if err := rewriteFiles(ctx, dir, yamlFiles, paths, changed); err != nil {
+		return nil, revertOnError(secrets, err)
+	}
+
+	for _, path := range paths {
+		if changed[path] {
+			info.Files = append(info.Files, path)
+		}
+	}
+
+	return info, nil
+}
+
+// updateChecksums sets the checksum annotation of the rotated Secrets named name, when annotated by write, to newChecksum,
+// and recomputes the checksums of the pod templates referencing them in the same namespace.
+// The files containing the updated documents are marked changed.
+func updateChecksums(salt, newChecksum, name string, yamlFiles map[string][]yaml.Node, paths []string, targets []rotatedSecretDoc, changed map[string]bool) {
+	namespaces := map[string]bool{}
+
+	for _, t := range targets {
+		root := t.doc.Content[0]
+
+		if annotationOf(root, ChecksumAnnotation) == "" {
+			continue
+		}
+
+		*root = *withAnnotation(root, ChecksumAnnotation, newChecksum)
+		changed[t.path] = true
+		namespaces[t.ns] = true
+	}
+
+	if len(namespaces) == 0 {
+		return
+	}
+
+	// The checksums of the other Secrets referenced by the pod templates are the ones in the manifests
+	secretChecksums := map[string]string{}
+
+	for _, path := range paths {
+		for _, doc := range documentsIn(yamlFiles[path]) {
+			if !isSecretNode(*doc) {
+				continue
+			}
+
+			root := doc.Content[0]
+
+			meta := mapValue(root, "metadata")
+			if meta == nil || meta.Kind != yaml.MappingNode {
+				continue
+			}
+
+			if c := annotationOf(root, ChecksumAnnotation); c != "" {
+				m := stringMap(meta)
+				secretChecksums[m["namespace"]+"/"+m["name"]] = c
+			}
+		}
+	}
+
+	for _, path := range paths {
+		docs := documentsIn(yamlFiles[path])
+
+		for ns := range namespaces {
+			if updateWorkloadChecksums(salt, secretChecksums, docs, ns, name) {
+				changed[path] = true
+			}
+		}
+	}
+}
+
+// rewriteFiles replaces the changed files under dir, which may be a file itself, with the YAML documents of them.
+// All the files are staged before any of them is replaced, so that no file refers to the secrets saved by a failed rotation.
+func rewriteFiles(ctx context.Context, dir string, yamlFiles map[string][]yaml.Node, paths []string, changed map[string]bool) error {
+	root := dir
+	if stat, err := os.Stat(dir); err != nil {
+		return err
+	} else if !stat.IsDir() {
+		root = filepath.Dir(dir)
+	}
+
+	out, err := newStagedOutput(root)
+	if err != nil {
+		return err
+	}
+	defer out.cleanup()
+
+	for _, path := range paths {
+		if !changed[path] {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		data, err := EncodeYAMLDocuments(yamlFiles[path])
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", path, err)
+		}
+
+		if err := out.write(path, data); err != nil {
+			return err
+		}
+	}
+
+	return out.commit()
+}
+
+// eachRef calls fn with every ref in the stringData of the Secrets in the files, in the order of the paths
+func eachRef(yamlFiles map[string][]yaml.Node, paths []string, fn func(path string, ref *Ref, node *yaml.Node)) {
+	for _, path := range paths {
+		for _, doc := range documentsIn(yamlFiles[path]) {
+			_, _, stringData, ok := SecretStringData(doc)
+			if !ok {
+				continue
+			}
+
+			for j := 1; j < len(stringData.Content); j += 2 {
+				node := stringData.Content[j]
+
+				r, err := ParseRef(node.Value)
+				if err != nil {
+					continue
+				}
+
+				fn(path, r, node)
+			}
+		}
+	}
+}
+
+// secretMatches returns true when the Secret is the one in the namespace ns named name.
+// Secrets without metadata.namespace match the namespace they're saved under, which is recorded in their refs.
+func secretMatches(manifestNs, manifestName string, stringData *yaml.Node, ns, name string) bool {
+	if manifestName != name {
+		return false
+	}
+
+	if manifestNs == ns {
+		return true
+	}
+
+	if manifestNs != "" {
+		return false
+	}
+
+	for j := 1; j < len(stringData.Content); j += 2 {
+		if parsed, err := ParseRef(stringData.Content[j].Value); err == nil && parsed.Namespace == ns {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortedKeys returns the keys of m in the lexical order
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
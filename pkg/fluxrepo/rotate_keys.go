@@ -0,0 +1,95 @@
+package fluxrepo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mumoshu/flux-repo/pkg/encrypt"
+)
+
+type RotateKeysResult struct {
+	Path string
+
+	encrypt.RekeyResult
+}
+
+// RotateKeysWithSops re-keys every SOPS-encrypted file under fsPath in place.
+// That includes files encrypted in filter mode and the encrypted file saved by the sops backend.
+// Files that don't need any change are left untouched, so that it can be re-run after a partial failure.
+func RotateKeysWithSops(sop *encrypt.Sops, fsPath string, opts encrypt.RekeyOptions) ([]RotateKeysResult, error) {
+	var results []RotateKeysResult
+
+	err := filepath.Walk(fsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		fileContent, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading file %s: %w", path, err)
+		}
+
+		if !isSopsEncrypted(fileContent) {
+			return nil
+		}
+
+		data, res, err := sop.Rekey(path, fileContent, opts)
+		if err != nil {
+			return fmt.Errorf("re-keying %s: %w", path, err)
+		}
+
+		if res.Changed() {
+			if err := replaceFile(path, data, info.Mode()); err != nil {
+				return err
+			}
+		}
+
+		results = append(results, RotateKeysResult{Path: path, RekeyResult: *res})
+
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// replaceFile writes data to a temporary file next to path and renames it over path,
+// so that path is never left half-written.
+func replaceFile(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("creating temporary file for %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing file %s: %w", tmp.Name(), err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing file %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return fmt.Errorf("changing mode of %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing file %s: %w", path, err)
+	}
+
+	return nil
+}
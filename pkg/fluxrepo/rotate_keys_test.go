@@ -0,0 +1,118 @@
+package fluxrepo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/flux-repo/pkg/encrypt"
+)
+
+const testKMSKeyARN2 = "arn:aws:kms:us-east-1:000000000000:key/test2"
+
+func TestRotateKeysWithSops(t *testing.T) {
+	in := tempDir(t)
+	defer os.RemoveAll(in)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	secret := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\nstringData:\n  password: pass1\n"
+	configMap := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  foo: bar\n"
+
+	writeFiles(t, in, map[string]string{
+		"secret.yaml":    secret,
+		"configmap.yaml": configMap,
+	})
+
+	sop := testDecryptableSops()
+
+	if _, err := WriteContext(context.Background(), WriteOptions{Input: in, Output: dir, Sops: sop}); err != nil {
+		t.Fatal(err)
+	}
+
+	secretPath := filepath.Join(dir, "secret.yaml")
+	configMapPath := filepath.Join(dir, "configmap.yaml")
+
+	rotate := func(opts encrypt.RekeyOptions) []RotateKeysResult {
+		t.Helper()
+
+		results, err := RotateKeysWithSops(sop, dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != 1 || results[0].Path != secretPath {
+			t.Fatalf("expected only %s to be re-keyed, got %v", secretPath, results)
+		}
+
+		return results
+	}
+
+	decrypt := func() string {
+		t.Helper()
+
+		data, err := sop.Decrypt(secretPath, []byte(readFile(t, secretPath)), "yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(data)
+	}
+
+	results := rotate(encrypt.RekeyOptions{AddKMS: testKMSKeyARN2})
+
+	if want := []string{testKMSKeyARN2}; !reflect.DeepEqual(results[0].AddedKeys, want) || results[0].DataKeyRotated {
+		t.Errorf("expected only %v to be added, got %+v", want, results[0].RekeyResult)
+	}
+
+	added := readFile(t, secretPath)
+
+	if !strings.Contains(added, testKMSKeyARN) || !strings.Contains(added, testKMSKeyARN2) {
+		t.Errorf("expected both master keys, got:\n%s", added)
+	}
+
+	if got := readFile(t, configMapPath); got != configMap {
+		t.Errorf("expected the unencrypted file to be left as is, got:\n%s", got)
+	}
+
+	// Re-running is a no-op, so that it can be re-run after a partial failure
+	results = rotate(encrypt.RekeyOptions{AddKMS: testKMSKeyARN2})
+
+	if results[0].Changed() {
+		t.Errorf("expected nothing to be changed, got %+v", results[0].RekeyResult)
+	}
+
+	if got := readFile(t, secretPath); got != added {
+		t.Errorf("expected the file to be left as is:\nwant:\n%s\ngot:\n%s", added, got)
+	}
+
+	results = rotate(encrypt.RekeyOptions{RemoveKMS: testKMSKeyARN})
+
+	if want := []string{testKMSKeyARN}; !reflect.DeepEqual(results[0].RemovedKeys, want) || !results[0].DataKeyRotated {
+		t.Errorf("expected %v to be removed with the data key rotated, got %+v", want, results[0].RekeyResult)
+	}
+
+	if got := readFile(t, secretPath); strings.Contains(got, "arn: "+testKMSKeyARN+"\n") {
+		t.Errorf("expected the master key to be removed, got:\n%s", got)
+	}
+
+	if got := decrypt(); !strings.Contains(got, "password: pass1") {
+		t.Errorf("expected the re-keyed file to be decrypted, got:\n%s", got)
+	}
+
+	removed := readFile(t, secretPath)
+
+	if _, err := RotateKeysWithSops(sop, dir, encrypt.RekeyOptions{RemoveKMS: testKMSKeyARN2}); err == nil {
+		t.Fatal("expected an error on removing all the master keys")
+	} else if want := "refusing to remove all the master keys"; !strings.Contains(err.Error(), want) {
+		t.Errorf("expected the error to contain %q, got %q", want, err.Error())
+	}
+
+	if got := readFile(t, secretPath); got != removed {
+		t.Errorf("expected the file to be left as is on the error, got:\n%s", got)
+	}
+}
@@ -0,0 +1,364 @@
+package fluxrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+type fixedGenerator string
+
+func (g fixedGenerator) Generate(name, key string, current Secret) (map[string]string, error) {
+	return map[string]string{key: string(g)}, nil
+}
+
+// secretManifest returns a Secret whose stringData are the refs formatted by the backend
+func secretManifest(backend SecretProviderBackend, ns, name string, keys ...string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: %s\n  namespace: %s\nstringData:\n", name, ns)
+
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %s: %s\n", k, backend.FormatRef(ns, name, k))
+	}
+
+	return b.String()
+}
+
+// resolveMemoryRefs returns the values the refs in the stringData of the Secrets in the file point to, keyed by NAMESPACE/NAME/KEY
+func resolveMemoryRefs(t *testing.T, file string) (map[string]string, []string) {
+	t.Helper()
+
+	yamlFiles, err := ReadYAMLFiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]string{}
+
+	var refs []string
+
+	eachRef(yamlFiles, []string{file}, func(_ string, r *Ref, node *yaml.Node) {
+		refs = append(refs, node.Value)
+
+		if r.Scheme != "memory" {
+			return
+		}
+
+		sec, err := (&memoryBackend{Path: r.Path}).Load(context.Background(), r.Params.Get("version"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values[shardKey(r.Namespace, r.Name, r.Key)] = sec[r.Namespace][r.Name][r.Key]
+	})
+
+	return values, refs
+}
+
+func TestRotate(t *testing.T) {
+	resetMemoryStore()
+
+	ctx := context.Background()
+
+	backend := &memoryBackend{Path: "app"}
+
+	if err := backend.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass1", "user": "user1"}}, "ns2": {"db": {"password": "pass3"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"db.yaml":  secretManifest(backend, "ns1", "db", "password", "user"),
+		"db2.yaml": secretManifest(backend, "ns2", "db", "password"),
+	})
+
+	info, err := Rotate(ctx, dir, "ns1/db/password", RotateOptions{Generator: fixedGenerator("pass2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Files) != 1 || filepath.Base(info.Files[0]) != "db.yaml" {
+		t.Errorf("expected only db.yaml to be rewritten, got %v", info.Files)
+	}
+
+	values, refs := resolveMemoryRefs(t, filepath.Join(dir, "db.yaml"))
+
+	if values["ns1/db/password"] != "pass2" || values["ns1/db/user"] != "user1" {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	// The ref to the key that isn't rotated still points to the previous version
+	if want := "ref+memory://app?version=1#/ns1/db/user"; refs[1] != want {
+		t.Errorf("unexpected ref to the key that isn't rotated: want %s, got %s", want, refs[1])
+	}
+
+	// The same name and key in another namespace is left as-is
+	if _, refs := resolveMemoryRefs(t, filepath.Join(dir, "db2.yaml")); refs[0] != "ref+memory://app?version=1#/ns2/db/password" {
+		t.Errorf("unexpected ref in another namespace: %s", refs[0])
+	}
+}
+
+func TestRotateAmbiguous(t *testing.T) {
+	resetMemoryStore()
+
+	ctx := context.Background()
+
+	backend := &memoryBackend{Path: "app"}
+
+	if err := backend.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"db.yaml": secretManifest(backend, "ns1", "db", "password"),
+		// The same namespace, name and key in another backend, like the one for another cluster
+		"other.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+  namespace: ns1
+stringData:
+  password: ref+vault://secret/data/other?version=1#/ns1/db/password
+`,
+	})
+
+	_, err := Rotate(ctx, dir, "ns1/db/password", RotateOptions{Generator: fixedGenerator("pass2")})
+	if err == nil || !strings.Contains(err.Error(), "referenced from both") {
+		t.Fatalf("expected an error for the ambiguous key, got %v", err)
+	}
+
+	if len(memoryStore["app"]) != 1 {
+		t.Errorf("expected nothing to be saved")
+	}
+}
+
+func TestRotateSharded(t *testing.T) {
+	resetMemoryStore()
+
+	ctx := context.Background()
+
+	sec := map[string]map[string]Secret{"ns1": {}}
+
+	var names []string
+
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("secret%d", i)
+		names = append(names, name)
+		sec["ns1"][name] = Secret{"password": strings.Repeat(fmt.Sprintf("%d", i), 40)}
+	}
+
+	backend := &memoryBackend{Path: "app"}
+
+	if err := backend.Save(ctx, sec); err != nil {
+		t.Fatal(err)
+	}
+
+	if backend.shards == nil || len(backend.shards.shards) < 3 {
+		t.Fatalf("expected the secrets to be sharded")
+	}
+
+	var manifests []string
+	for _, name := range names {
+		manifests = append(manifests, secretManifest(backend, "ns1", name, "password"))
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{"secrets.yaml": strings.Join(manifests, "---\n")})
+
+	// Rotated into a longer value, which moves the keys after it to the next shards
+	if _, err := Rotate(ctx, dir, "ns1/secret0/password", RotateOptions{Generator: fixedGenerator(strings.Repeat("x", 120))}); err != nil {
+		t.Fatal(err)
+	}
+
+	values, refs := resolveMemoryRefs(t, filepath.Join(dir, "secrets.yaml"))
+
+	for i, name := range names {
+		want := sec["ns1"][name]["password"]
+		if i == 0 {
+			want = strings.Repeat("x", 120)
+		}
+
+		if got := values["ns1/"+name+"/password"]; got != want {
+			t.Errorf("unexpected value of %s: want %q, got %q", name, want, got)
+		}
+	}
+
+	// Every ref points to the versions saved by the rotation, so that the next rotation loads consistent shards
+	var versions []string
+	for _, r := range refs {
+		parsed, _ := ParseRef(r)
+		versions = append(versions, parsed.Path+"@"+parsed.Params.Get("version"))
+	}
+	sort.Strings(versions)
+
+	for _, v := range versions {
+		if strings.HasSuffix(v, "@1") {
+			t.Errorf("expected all the refs to be rewritten, found %s", v)
+		}
+	}
+
+	if _, err := Rotate(ctx, dir, "ns1/secret7/password", RotateOptions{Generator: fixedGenerator("y")}); err != nil {
+		t.Fatalf("rotating again: %v", err)
+	}
+
+	values, _ = resolveMemoryRefs(t, filepath.Join(dir, "secrets.yaml"))
+
+	if values["ns1/secret0/password"] != strings.Repeat("x", 120) || values["ns1/secret7/password"] != "y" || values["ns1/secret3/password"] != sec["ns1"]["secret3"]["password"] {
+		t.Errorf("unexpected values after rotating again: %v", values)
+	}
+}
+
+// generatorFunc generates values with the function, to run code while rotating
+type generatorFunc func(name, key string, current Secret) (map[string]string, error)
+
+func (g generatorFunc) Generate(name, key string, current Secret) (map[string]string, error) {
+	return g(name, key, current)
+}
+
+func TestRotateConflict(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	backend := &memoryBackend{Path: "app"}
+
+	if err := backend.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest := secretManifest(backend, "ns1", "db", "password")
+
+	writeFiles(t, dir, map[string]string{"db.yaml": manifest})
+
+	// Another write saves into the same path while rotating
+	concurrentWrite := generatorFunc(func(name, key string, current Secret) (map[string]string, error) {
+		if err := (&memoryBackend{Path: "app"}).Save(ctx, map[string]map[string]Secret{"ns1": {"other": {"token": "tok"}}}); err != nil {
+			return nil, err
+		}
+
+		return map[string]string{key: "pass2"}, nil
+	})
+
+	_, err := Rotate(ctx, dir, "ns1/db/password", RotateOptions{Generator: concurrentWrite})
+
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected a ConflictError, got %v", err)
+	}
+
+	if got := len(memoryStore["app"]); got != 2 {
+		t.Errorf("expected the version saved by the other write to be the latest, got %d versions", got)
+	}
+
+	if got := readFile(t, filepath.Join(dir, "db.yaml")); got != manifest {
+		t.Errorf("expected the manifest to be left unchanged, got:\n%s", got)
+	}
+}
+
+func TestRotateRevertsOnFailure(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := &memoryBackend{Path: "app"}
+
+	if err := backend.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest := secretManifest(backend, "ns1", "db", "password")
+
+	writeFiles(t, dir, map[string]string{"db.yaml": manifest})
+
+	// Cancelled after saving and before rewriting the files
+	cancelling := generatorFunc(func(name, key string, current Secret) (map[string]string, error) {
+		cancel()
+
+		return map[string]string{key: "pass2"}, nil
+	})
+
+	_, err := Rotate(ctx, dir, "ns1/db/password", RotateOptions{Generator: cancelling})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the rotation to be cancelled, got %v", err)
+	}
+
+	if got := len(memoryStore["app"]); got != 1 {
+		t.Errorf("expected the saved version to be reverted, got %d versions", got)
+	}
+
+	if got := readFile(t, filepath.Join(dir, "db.yaml")); got != manifest {
+		t.Errorf("expected the manifest to be left unchanged, got:\n%s", got)
+	}
+}
+
+func TestRotateUpdatesChecksums(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	written := writeWithChecksums(t, map[string]string{
+		"secret.yaml":   appSecretManifest("pass1"),
+		"workload.yaml": workloadManifest(t, "Deployment"),
+	})
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, written)
+
+	if _, err := Rotate(context.Background(), dir, "ns1/app/password", RotateOptions{Generator: fixedGenerator("pass2")}); err == nil {
+		t.Fatal("expected an error without the checksum salt")
+	} else if !strings.Contains(err.Error(), ChecksumAnnotation) {
+		t.Errorf("expected the error to mention the annotation, got %q", err.Error())
+	}
+
+	if got := len(memoryStore["app"]); got != 1 {
+		t.Fatalf("expected nothing to be saved without the checksum salt, got %d versions", got)
+	}
+
+	info, err := Rotate(context.Background(), dir, "ns1/app/password", RotateOptions{Generator: fixedGenerator("pass2"), ChecksumSalt: testChecksumSalt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{filepath.Join(dir, "secret.yaml"), filepath.Join(dir, "workload.yaml")}; !reflect.DeepEqual(info.Files, want) {
+		t.Errorf("unexpected rewritten files: want %v, got %v", want, info.Files)
+	}
+
+	// The same checksums as the ones written from the new value
+	secretChecksum := checksum(testChecksumSalt, Secret{"password": "pass2"})
+
+	if got := annotationAt(t, readFile(t, filepath.Join(dir, "secret.yaml"))); got != secretChecksum {
+		t.Errorf("unexpected checksum of the secret: want %s, got %s", secretChecksum, got)
+	}
+
+	want := checksum(testChecksumSalt, map[string]string{"app": secretChecksum})
+
+	if got := annotationAt(t, readFile(t, filepath.Join(dir, "workload.yaml")), "spec", "template"); got != want {
+		t.Errorf("unexpected checksum of the pod template: want %s, got %s", want, got)
+	}
+}
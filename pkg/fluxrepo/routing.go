@@ -0,0 +1,275 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// RoutingConfig maps secrets to backends by their namespaces, labels and annotations.
+//
+//	routes:
+//	- match:
+//	    namespaces: ["kube-system", "platform-*"]
+//	  backend: vault
+//	  path: secret/data/{{.Namespace}}
+//	  options:
+//	    vault-address: https://vault.example.com
+//	- backend: awssecrets
+//	  path: teams/{{index .Labels "team"}}
+//	  options:
+//	    aws-profile: apps
+type RoutingConfig struct {
+	// Routes are evaluated in order, and the first matching route is used
+	Routes []Route `yaml:"routes"`
+
+	// Environment is exposed to the path templates as .Environment. Set from the `-env` of the project config
+	Environment string `yaml:"-"`
+}
+
+type Route struct {
+	// Match selects secrets routed to the backend. An empty match selects all the secrets
+	Match RouteMatch `yaml:"match"`
+
+	Backend string `yaml:"backend"`
+	// Path is a Go template for the path of the secret in the backend.
+	// It is rendered with .Namespace, .Name, .Labels and .Annotations of each secret, and .Environment.
+	// It's an error for the rendered path to have an empty segment, like the one of a missing label.
+	Path string `yaml:"path"`
+	// Options override the backend options given to the command
+	Options BackendOptions `yaml:"options"`
+}
+
+type RouteMatch struct {
+	// Namespaces is the list of glob patterns of namespaces. Any of them must match
+	Namespaces []string `yaml:"namespaces"`
+	// Labels and Annotations are glob patterns of label and annotation values. All of them must match
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// LoadRoutingConfig reads the routing config from the YAML file
+func LoadRoutingConfig(file string) (*RoutingConfig, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading routing config %s: %w", file, err)
+	}
+
+	var config RoutingConfig
+
+	if err := yaml.Unmarshal(bs, &config); err != nil {
+		return nil, fmt.Errorf("decoding routing config %s: %w", file, err)
+	}
+
+	return &config, nil
+}
+
+// Router selects the backend for each secret according to the routing config
+type Router struct {
+	routes []compiledRoute
+	opts   BackendOptions
+	env    string
+
+	// backends are keyed by the backend name and the rendered path, so that routes saving into the same store share the backend
+	backends map[string]SecretProviderBackend
+	// backendOpts are the options the backends are created with, keyed like backends
+	backendOpts map[string]BackendOptions
+	// order is the keys of backends in the order of creation
+	order []string
+}
+
+type compiledRoute struct {
+	Route
+	path *template.Template
+}
+
+type routeData struct {
+	Namespace, Name     string
+	Labels, Annotations map[string]string
+	Environment         string
+}
+
+// NewRouter validates the routing config and returns the router.
+// opts are the backend options shared by all the routes.
+func NewRouter(config *RoutingConfig, opts BackendOptions) (*Router, error) {
+	if len(config.Routes) == 0 {
+		return nil, fmt.Errorf("validating routing config: no routes defined")
+	}
+
+	r := &Router{
+		opts:        opts,
+		env:         config.Environment,
+		backends:    map[string]SecretProviderBackend{},
+		backendOpts: map[string]BackendOptions{},
+	}
+
+	for i, route := range config.Routes {
+		if _, _, err := LookupBackend(route.Backend); err != nil {
+			return nil, fmt.Errorf("validating routes[%d]: %w", i, err)
+		}
+
+		if route.Path == "" {
+			return nil, fmt.Errorf("validating routes[%d]: missing path", i)
+		}
+
+		tmpl, err := template.New("path").Option("missingkey=error").Parse(route.Path)
+		if err != nil {
+			return nil, fmt.Errorf("validating routes[%d]: parsing path: %w", i, err)
+		}
+
+		for _, pattern := range route.Match.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("validating routes[%d]: invalid namespace pattern %q: %w", i, pattern, err)
+			}
+		}
+
+		r.routes = append(r.routes, compiledRoute{Route: route, path: tmpl})
+	}
+
+	return r, nil
+}
+
+// Route returns the backend for the secret.
+// Secrets routed to the same backend and path share the backend instance, even when they are matched by different routes,
+// so that they are saved together into a single version rather than overwriting each other.
+// It's an error for such routes to have different options.
+func (r *Router) Route(ns, name string, labels, annotations map[string]string) (SecretProviderBackend, error) {
+	for i, route := range r.routes {
+		if !route.Match.matches(ns, labels, annotations) {
+			continue
+		}
+
+		var buf bytes.Buffer
+
+		if err := route.path.Execute(&buf, routeData{Namespace: ns, Name: name, Labels: labels, Annotations: annotations, Environment: r.env}); err != nil {
+			return nil, fmt.Errorf("rendering path of routes[%d] for %s/%s: %w", i, ns, name, err)
+		}
+
+		p := buf.String()
+
+		// Missing labels and annotations referenced with `index` render empty, which would route secrets of different teams into the same path.
+		// A leading slash is allowed for backends like awsssm whose paths start with it
+		if p == "" || strings.Contains(p, "//") || strings.HasSuffix(p, "/") {
+			return nil, fmt.Errorf("rendering path of routes[%d] for %s/%s: %q has an empty segment. Make sure the labels and annotations in the path are set", i, ns, name, p)
+		}
+
+		f, arg, err := LookupBackend(route.Backend)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d] for %s/%s: %w", i, ns, name, err)
+		}
+
+		// The canonical name, so that aliases of the same backend share the instance
+		key := fmt.Sprintf("%s:%s\x00%s", f.Name, arg, p)
+
+		opts := BackendOptions{}
+		for k, vs := range r.opts {
+			opts[k] = vs
+		}
+		for k, vs := range route.Options {
+			opts[k] = vs
+		}
+
+		if backend, ok := r.backends[key]; ok {
+			if !reflect.DeepEqual(r.backendOpts[key], opts) {
+				return nil, fmt.Errorf("routes[%d] for %s/%s: %s backend at %s is used by another route with different options", i, ns, name, f.Name, p)
+			}
+
+			return backend, nil
+		}
+
+		backend, err := NewBackend(route.Backend, p, opts)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d] for %s/%s: %w", i, ns, name, err)
+		}
+
+		r.backends[key] = backend
+		r.backendOpts[key] = opts
+		r.order = append(r.order, key)
+
+		return backend, nil
+	}
+
+	return nil, fmt.Errorf("no route matched secret %s/%s", ns, name)
+}
+
+// Backends returns all the backends created so far, in the order of creation
+func (r *Router) Backends() []SecretProviderBackend {
+	var res []SecretProviderBackend
+
+	for _, k := range r.order {
+		res = append(res, r.backends[k])
+	}
+
+	return res
+}
+
+func (m RouteMatch) matches(ns string, labels, annotations map[string]string) bool {
+	if len(m.Namespaces) > 0 {
+		var matched bool
+
+		for _, pattern := range m.Namespaces {
+			if ok, _ := path.Match(pattern, ns); ok {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return matchesAll(m.Labels, labels) && matchesAll(m.Annotations, annotations)
+}
+
+func matchesAll(patterns, values map[string]string) bool {
+	for k, pattern := range patterns {
+		v, ok := values[k]
+		if !ok {
+			return false
+		}
+
+		if matched, _ := path.Match(pattern, v); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// UnmarshalYAML allows each option to be either a scalar or a sequence of scalars
+func (o *BackendOptions) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: backend options must be a mapping", node.Line)
+	}
+
+	res := BackendOptions{}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i].Value, node.Content[i+1]
+
+		switch v.Kind {
+		case yaml.ScalarNode:
+			res.Set(k, v.Value)
+		case yaml.SequenceNode:
+			for _, item := range v.Content {
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("line %d: values of backend option %q must be scalars", item.Line, k)
+				}
+				res.Add(k, item.Value)
+			}
+		default:
+			return fmt.Errorf("line %d: backend option %q must be either a scalar or a sequence", v.Line, k)
+		}
+	}
+
+	*o = res
+
+	return nil
+}
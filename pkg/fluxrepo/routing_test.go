@@ -0,0 +1,153 @@
+package fluxrepo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRouterRoute(t *testing.T) {
+	config := &RoutingConfig{
+		Routes: []Route{
+			{
+				Match:   RouteMatch{Namespaces: []string{"platform-*"}},
+				Backend: "s3",
+				Path:    "bucket/platform",
+			},
+			{
+				Match:   RouteMatch{Labels: map[string]string{"team": "*"}},
+				Backend: "awss3",
+				Path:    `bucket/{{index .Labels "team"}}`,
+			},
+			{
+				Backend: "s3",
+				Path:    "bucket/{{.Namespace}}",
+			},
+		},
+	}
+
+	r, err := NewRouter(config, BackendOptions{"aws-region": {"us-east-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route := func(ns string, labels map[string]string) *S3Backend {
+		t.Helper()
+
+		backend, err := r.Route(ns, "foo", labels, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return backend.(*S3Backend)
+	}
+
+	platform := route("platform-a", nil)
+	if platform.Key != "bucket/platform" {
+		t.Errorf("unexpected path: %s", platform.Key)
+	}
+
+	if route("platform-b", nil) != platform {
+		t.Error("expected secrets routed to the same path to share the backend")
+	}
+
+	// Matched by the second route, which renders the same backend and path as the first one under an alias
+	if route("apps", map[string]string{"team": "platform"}) != platform {
+		t.Error("expected secrets routed to the same backend and path by different routes to share the backend")
+	}
+
+	team := route("apps", map[string]string{"team": "a"})
+	if team.Key != "bucket/a" {
+		t.Errorf("unexpected path: %s", team.Key)
+	}
+
+	// Matched by the last route, which renders the same path as the second one
+	if route("a", nil) != team {
+		t.Error("expected secrets routed to the same backend and path by different routes to share the backend")
+	}
+
+	if other := route("b", nil); other.Key != "bucket/b" || other == team {
+		t.Errorf("expected a separate backend for bucket/b, got %s", other.Key)
+	}
+
+	if got := len(r.Backends()); got != 3 {
+		t.Errorf("expected 3 backends, got %d", got)
+	}
+}
+
+func TestRouterRouteConflictingOptions(t *testing.T) {
+	config := &RoutingConfig{
+		Routes: []Route{
+			{
+				Match:   RouteMatch{Namespaces: []string{"a"}},
+				Backend: "s3",
+				Path:    "bucket/shared",
+				Options: BackendOptions{"aws-region": {"us-west-2"}},
+			},
+			{
+				Backend: "s3",
+				Path:    "bucket/shared",
+			},
+		},
+	}
+
+	r, err := NewRouter(config, BackendOptions{"aws-region": {"us-east-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Route("a", "foo", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Route("b", "foo", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "different options") {
+		t.Errorf("expected an error for the conflicting options, got %v", err)
+	}
+}
+
+func TestRouterRouteNoMatch(t *testing.T) {
+	r, err := NewRouter(&RoutingConfig{Routes: []Route{{Match: RouteMatch{Namespaces: []string{"a"}}, Backend: "s3", Path: "bucket/a"}}}, BackendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Route("b", "foo", nil, nil); err == nil {
+		t.Error("expected an error when no route matches")
+	}
+}
+
+func TestRouterRouteEmptySegment(t *testing.T) {
+	testcases := []struct {
+		path string
+		err  string
+	}{
+		{path: `bucket/{{.Labels.team}}/app`, err: `map has no entry for key "team"`},
+		{path: `bucket/{{index .Labels "team"}}/app`, err: `"bucket//app" has an empty segment`},
+		{path: `bucket/{{index .Annotations "team"}}`, err: `"bucket/" has an empty segment`},
+		{path: `{{.Environment}}`, err: `"" has an empty segment`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.path, func(t *testing.T) {
+			r, err := NewRouter(&RoutingConfig{Routes: []Route{{Backend: "s3", Path: tc.path}}}, BackendOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = r.Route("ns1", "foo", map[string]string{"app": "web"}, nil)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+
+	// A leading slash isn't an empty segment, as the paths of awsssm start with it
+	r, err := NewRouter(&RoutingConfig{Routes: []Route{{Backend: "awsssm", Path: `/{{index .Labels "team"}}/app`}}}, BackendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Route("ns1", "foo", map[string]string{"team": "a"}, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,580 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Rules reported by Scan
+const (
+	// ScanRulePlaintextSecret is a Secret data value that is neither a ref nor SOPS-encrypted
+	ScanRulePlaintextSecret = "plaintext-secret"
+	// ScanRuleTokenFormat is a value in a well-known token format, like an AWS access key ID
+	ScanRuleTokenFormat = "token-format"
+	// ScanRuleSecretName is a value of a field or an env var whose name suggests it's a secret, like DB_PASSWORD
+	ScanRuleSecretName = "secret-name"
+	// ScanRuleHighEntropy is a random-looking string
+	ScanRuleHighEntropy = "high-entropy"
+	// ScanRuleUnparsable is a manifest file that can't be parsed, like a Helm chart template.
+	// Documents from the one that fails to be parsed are not scanned
+	ScanRuleUnparsable = "unparsable"
+)
+
+// ScanAllowComment is the comment that suppresses findings on the line it's put on
+const ScanAllowComment = "flux-repo:allow"
+
+var scanRuleDescriptions = map[string]string{
+	ScanRulePlaintextSecret: "Secret data value is neither a ref nor SOPS-encrypted",
+	ScanRuleTokenFormat:     "Value looks like a well-known token or key",
+	ScanRuleSecretName:      "Value of a field or an env var whose name suggests a secret is in plaintext",
+	ScanRuleHighEntropy:     "Value is a random-looking string",
+	ScanRuleUnparsable:      "File can't be parsed, so it's not fully scanned",
+}
+
+var scanTokenFormats = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"AWS access key ID", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"GitLab token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"Stripe secret key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN ([A-Z]+ )*PRIVATE KEY-----`)},
+	{"JSON web token", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+}
+
+var (
+	scanSecretNamePattern = regexp.MustCompile(`(?i)(passw(or)?d|secret|token|api[-_]?key|private[-_]?key|access[-_]?key|credentials?)$`)
+	// scanNotSecretNamePattern matches names that only point to secrets, like `secretName` and `existingSecret`
+	scanNotSecretNamePattern = regexp.MustCompile(`(?i)(^existing|name$|ref$|file$|path$)`)
+	scanTokenCharsPattern    = regexp.MustCompile(`^[A-Za-z0-9+/=_-]+$`)
+	scanPlaceholderPattern   = regexp.MustCompile(`^(\$\{.*\}|\$\(.*\)|\{\{.*\}\}|<.*>)$`)
+	// scanErrorLinePattern extracts the line number from YAML parse errors like `yaml: line 7: could not find expected ':'`
+	scanErrorLinePattern = regexp.MustCompile(`line (\d+)`)
+)
+
+type ScanOptions struct {
+	// Allowlist suppresses findings
+	Allowlist *ScanAllowlist
+	// MinEntropy is the Shannon entropy in bits per character above which a string is reported as high-entropy
+	MinEntropy float64
+	// MinLength is the length of strings below which they are never reported as high-entropy
+	MinLength int
+}
+
+// ScanFinding is a likely secret found in a manifest. It never contains the value itself.
+type ScanFinding struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	// Path is the path to the value in the document, like `spec.template.spec.containers[0].env[1].value`
+	Path string `json:"path"`
+	Kind string `json:"kind,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// ScanAllowlist suppresses findings matching any of the entries.
+//
+//	allow:
+//	- file: charts/*/values.yaml
+//	  rule: high-entropy
+//	- path: spec.values.image.digest
+type ScanAllowlist struct {
+	Allow []ScanAllowlistEntry `yaml:"allow"`
+}
+
+// ScanAllowlistEntry matches findings by glob patterns. Empty fields match anything.
+type ScanAllowlistEntry struct {
+	Rule string `yaml:"rule"`
+	File string `yaml:"file"`
+	Path string `yaml:"path"`
+	Kind string `yaml:"kind"`
+	Name string `yaml:"name"`
+}
+
+// LoadScanAllowlist reads the allowlist from the YAML file
+func LoadScanAllowlist(file string) (*ScanAllowlist, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading allowlist %s: %w", file, err)
+	}
+
+	var allowlist ScanAllowlist
+
+	if err := yaml.Unmarshal(bs, &allowlist); err != nil {
+		return nil, fmt.Errorf("parsing allowlist %s: %w", file, err)
+	}
+
+	for _, e := range allowlist.Allow {
+		for _, p := range []string{e.Rule, e.File, e.Path, e.Kind, e.Name} {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("parsing allowlist %s: invalid pattern %q: %w", file, p, err)
+			}
+		}
+	}
+
+	return &allowlist, nil
+}
+
+// Allows returns true when the finding is matched by any of the entries
+func (a *ScanAllowlist) Allows(f ScanFinding) bool {
+	if a == nil {
+		return false
+	}
+
+	match := func(pattern, s string) bool {
+		if pattern == "" {
+			return true
+		}
+		ok, _ := path.Match(pattern, s)
+		return ok
+	}
+
+	for _, e := range a.Allow {
+		if match(e.Rule, f.Rule) && match(e.File, filepath.ToSlash(f.File)) && match(e.Path, f.Path) && match(e.Kind, f.Kind) && match(e.Name, f.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Scan parses every YAML and JSON manifest under dir and reports likely plaintext secrets.
+// The files in the findings are the paths under dir, like `dir/charts/app/values.yaml`.
+// The allowlist matches either them or the paths relative to dir, like `charts/app/values.yaml`.
+func Scan(dir string, opts ScanOptions) ([]ScanFinding, error) {
+	var findings []ScanFinding
+
+	root := dir
+	if stat, err := os.Stat(dir); err == nil && !stat.IsDir() {
+		// A file is matched by the path as given
+		root = ""
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !isManifestFile(path) {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading file %s: %w", path, err)
+		}
+
+		rel := path
+		if root != "" {
+			if rel, err = filepath.Rel(root, path); err != nil {
+				return err
+			}
+		}
+
+		findings = append(findings, scanContent(path, rel, content, opts)...)
+
+		return nil
+	})
+	if err != nil {
+		return findings, err
+	}
+
+	return findings, nil
+}
+
+func isManifestFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+
+	return false
+}
+
+// ScanContent reports likely plaintext secrets in the content of the manifest file.
+// It's separated from Scan so that content not on the filesystem, like staged git blobs, can be scanned.
+//
+// Content that can't be parsed is reported as ScanRuleUnparsable along with the findings in the documents before it,
+// rather than as an error, so that one template among manifests doesn't stop scanning the others.
+func ScanContent(file string, content []byte, opts ScanOptions) []ScanFinding {
+	return scanContent(file, file, content, opts)
+}
+
+// scanContent is ScanContent that also allows the findings matching the allowlist by rel, the path relative to the scanned directory
+func scanContent(file, rel string, content []byte, opts ScanOptions) []ScanFinding {
+	if opts.MinEntropy == 0 {
+		opts.MinEntropy = 4.0
+	}
+
+	if opts.MinLength == 0 {
+		opts.MinLength = 20
+	}
+
+	s := &scanner{file: file, rel: rel, opts: opts}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			s.reportUnparsable(err)
+
+			break
+		}
+
+		for _, d := range documentsIn([]yaml.Node{doc}) {
+			if len(d.Content) == 0 || d.Content[0].Kind != yaml.MappingNode {
+				continue
+			}
+
+			// Items of Lists are scanned as documents on their own, so that Secrets in them are recognized
+			if _, ok := listItems(*d); ok {
+				continue
+			}
+
+			s.scanDocument(d.Content[0])
+		}
+	}
+
+	return s.findings
+}
+
+type scanner struct {
+	file string
+	// rel is the path to the file relative to the scanned directory, which the allowlist matches too
+	rel      string
+	opts     ScanOptions
+	findings []ScanFinding
+
+	kind, name string
+}
+
+func (s *scanner) scanDocument(root *yaml.Node) {
+	top := stringMap(root)
+	s.kind = top["kind"]
+	s.name = ""
+
+	var secretData []*yaml.Node
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+
+		switch {
+		case k.Value == "metadata":
+			s.name = stringMap(v)["name"]
+		case k.Value == "sops":
+			// The metadata of SOPS-encrypted files contain encrypted data keys
+		case s.kind == "Secret" && (k.Value == "data" || k.Value == "stringData"):
+			secretData = append(secretData, k, v)
+		default:
+			s.scanNode(k.Value, k, v)
+		}
+	}
+
+	for i := 0; i+1 < len(secretData); i += 2 {
+		k, v := secretData[i], secretData[i+1]
+
+		for j := 0; j+1 < len(v.Content); j += 2 {
+			kk, vv := v.Content[j], v.Content[j+1]
+
+			if vv.Kind != yaml.ScalarNode || vv.Value == "" || isEncryptedValue(vv.Value) {
+				continue
+			}
+
+			s.report(ScanRulePlaintextSecret, fmt.Sprintf("Secret %s has plaintext %s.%s", s.name, k.Value, kk.Value), k.Value+"."+kk.Value, kk, vv)
+		}
+	}
+}
+
+func (s *scanner) scanNode(path string, keyNode, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		m := stringMap(node)
+
+		// Env vars like `{name: DB_PASSWORD, value: foo}`
+		envName, hasName := m["name"]
+		_, hasValue := m["value"]
+		isEnv := hasName && hasValue && isSecretName(envName)
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+
+			p := k.Value
+			if path != "" {
+				p = path + "." + k.Value
+			}
+
+			if isEnv && k.Value == "value" {
+				if v.Kind == yaml.ScalarNode && isPlaintextValue(v) {
+					s.report(ScanRuleSecretName, fmt.Sprintf("Env var %s has a plaintext value", envName), p, k, v)
+				}
+				continue
+			}
+
+			s.scanNode(p, k, v)
+		}
+	case yaml.SequenceNode:
+		for i, v := range node.Content {
+			s.scanNode(fmt.Sprintf("%s[%d]", path, i), keyNode, v)
+		}
+	case yaml.ScalarNode:
+		s.scanScalar(path, keyNode, node)
+	}
+}
+
+func (s *scanner) scanScalar(path string, keyNode, node *yaml.Node) {
+	if !isPlaintextValue(node) {
+		return
+	}
+
+	for _, f := range scanTokenFormats {
+		if f.pattern.MatchString(node.Value) {
+			s.report(ScanRuleTokenFormat, fmt.Sprintf("Value matches the %s format", f.name), path, keyNode, node)
+			return
+		}
+	}
+
+	if keyNode != nil && isSecretName(keyNode.Value) {
+		s.report(ScanRuleSecretName, fmt.Sprintf("Field %s has a plaintext value", keyNode.Value), path, keyNode, node)
+		return
+	}
+
+	if len(node.Value) >= s.opts.MinLength && scanTokenCharsPattern.MatchString(node.Value) && shannonEntropy(node.Value) >= s.opts.MinEntropy {
+		s.report(ScanRuleHighEntropy, "Value is a random-looking string", path, keyNode, node)
+	}
+}
+
+func (s *scanner) report(rule, msg, path string, keyNode, node *yaml.Node) {
+	// Allow `# flux-repo:allow` either on the line of the key or the value
+	for _, n := range []*yaml.Node{keyNode, node} {
+		if n != nil && strings.Contains(n.LineComment, ScanAllowComment) {
+			return
+		}
+	}
+
+	f := ScanFinding{
+		Rule:    rule,
+		Message: msg,
+		File:    s.file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path,
+		Kind:    s.kind,
+		Name:    s.name,
+	}
+
+	if s.allows(f) {
+		return
+	}
+
+	s.findings = append(s.findings, f)
+}
+
+// reportUnparsable reports the file as unparsable, at the line the error occurred when it's known
+func (s *scanner) reportUnparsable(err error) {
+	f := ScanFinding{
+		Rule:    ScanRuleUnparsable,
+		Message: fmt.Sprintf("File can't be parsed, so it's not scanned from here: %v", err),
+		File:    s.file,
+		Line:    1,
+		Column:  1,
+	}
+
+	if m := scanErrorLinePattern.FindStringSubmatch(err.Error()); m != nil {
+		f.Line, _ = strconv.Atoi(m[1])
+	}
+
+	if s.allows(f) {
+		return
+	}
+
+	s.findings = append(s.findings, f)
+}
+
+// allows returns true when the allowlist matches the finding by either the path to the file or the relative one
+func (s *scanner) allows(f ScanFinding) bool {
+	if s.opts.Allowlist.Allows(f) {
+		return true
+	}
+
+	relative := f
+	relative.File = s.rel
+
+	return s.rel != f.File && s.opts.Allowlist.Allows(relative)
+}
+
+func isSecretName(name string) bool {
+	return scanSecretNamePattern.MatchString(name) && !scanNotSecretNamePattern.MatchString(name)
+}
+
+// isEncryptedValue returns true for refs and values encrypted by SOPS
+func isEncryptedValue(v string) bool {
+	return strings.HasPrefix(v, "ref+") || strings.HasPrefix(v, "ENC[")
+}
+
+// isPlaintextValue returns true for non-empty strings that are neither encrypted nor placeholders
+func isPlaintextValue(node *yaml.Node) bool {
+	v := strings.TrimSpace(node.Value)
+
+	return node.Tag == "!!str" && v != "" && !isEncryptedValue(v) && !scanPlaceholderPattern.MatchString(v)
+}
+
+// shannonEntropy returns the Shannon entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	var e float64
+
+	n := float64(len([]rune(s)))
+	for _, c := range counts {
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+
+	return e
+}
+
+// WriteScanFindingsText writes the findings in the `FILE:LINE:COLUMN: RULE: MESSAGE (PATH)` format.
+// `(PATH)` is omitted for findings about whole files.
+func WriteScanFindingsText(w io.Writer, findings []ScanFinding) error {
+	for _, f := range findings {
+		var path string
+		if f.Path != "" {
+			path = fmt.Sprintf(" (%s)", f.Path)
+		}
+
+		if _, err := fmt.Fprintf(w, "%s:%d:%d: %s: %s%s\n", f.File, f.Line, f.Column, f.Rule, f.Message, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteScanFindingsJSON writes the findings as a JSON array
+func WriteScanFindingsJSON(w io.Writer, findings []ScanFinding) error {
+	if findings == nil {
+		findings = []ScanFinding{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(findings)
+}
+
+// WriteScanFindingsSARIF writes the findings in SARIF 2.1.0, so that they can be uploaded to code scanning services
+func WriteScanFindingsSARIF(w io.Writer, findings []ScanFinding) error {
+	type message struct {
+		Text string `json:"text"`
+	}
+
+	type rule struct {
+		ID               string  `json:"id"`
+		ShortDescription message `json:"shortDescription"`
+	}
+
+	type region struct {
+		StartLine   int `json:"startLine"`
+		StartColumn int `json:"startColumn"`
+	}
+
+	type physicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region region `json:"region"`
+	}
+
+	type location struct {
+		PhysicalLocation physicalLocation `json:"physicalLocation"`
+	}
+
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   message    `json:"message"`
+		Locations []location `json:"locations"`
+	}
+
+	var ruleIDs []string
+	for id := range scanRuleDescriptions {
+		ruleIDs = append(ruleIDs, id)
+	}
+	sort.Strings(ruleIDs)
+
+	var rules []rule
+	for _, id := range ruleIDs {
+		rules = append(rules, rule{ID: id, ShortDescription: message{Text: scanRuleDescriptions[id]}})
+	}
+
+	results := []result{}
+
+	for _, f := range findings {
+		var loc location
+		loc.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(f.File)
+		loc.PhysicalLocation.Region = region{StartLine: f.Line, StartColumn: f.Column}
+
+		results = append(results, result{
+			RuleID:    f.Rule,
+			Level:     "error",
+			Message:   message{Text: fmt.Sprintf("%s (%s)", f.Message, f.Path)},
+			Locations: []location{loc},
+		})
+	}
+
+	log := map[string]interface{}{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs": []interface{}{
+			map[string]interface{}{
+				"tool": map[string]interface{}{
+					"driver": map[string]interface{}{
+						"name":           "flux-repo",
+						"informationUri": "https://github.com/mumoshu/flux-repo",
+						"rules":          rules,
+					},
+				},
+				"results": results,
+			},
+		},
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(log)
+}
@@ -1,11 +1,96 @@
 package fluxrepo
 
-import "fmt"
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
 
 type SecretProvider struct {
 	Secrets map[string]map[string]Secret
 
+	// Warnings are problems found in the manifests that don't prevent them from being sanitized
+	Warnings []string
+
+	// DefaultNamespace is the namespace of Secrets without metadata.namespace. DefaultNamespace is used when empty.
+	// It can be changed before sanitizing each file, e.g. to the namespace set by the kustomization of the file.
+	DefaultNamespace string
+
+	// ChecksumSalt enables ChecksumAnnotation on sanitized Secrets when non-empty
+	ChecksumSalt string
+
 	backend SecretProviderBackend
+
+	router *Router
+	// routed is the backend each secret is routed to, keyed by namespace and name
+	routed map[string]SecretProviderBackend
+
+	// saved is the list of backends the last Save saved secrets into.
+	// It includes the failed one when it reports a partial save, like some of the shards saved.
+	saved []SecretProviderBackend
+
+	// encoded is the set of data keys whose values are saved base64-encoded, keyed by namespace, name and key
+	encoded map[string]bool
+}
+
+// NewSecretProvider returns a SecretProvider that saves all the secrets into the backend
+func NewSecretProvider(backend SecretProviderBackend) *SecretProvider {
+	return &SecretProvider{
+		backend: backend,
+		Secrets: map[string]map[string]Secret{},
+	}
+}
+
+// NewRoutedSecretProvider returns a SecretProvider that saves each secret into the backend selected by the router
+func NewRoutedSecretProvider(router *Router) *SecretProvider {
+	return &SecretProvider{
+		router:  router,
+		routed:  map[string]SecretProviderBackend{},
+		Secrets: map[string]map[string]Secret{},
+	}
+}
+
+func (s *SecretProvider) namespaceOr(ns string) string {
+	if ns != "" {
+		return ns
+	}
+
+	if s.DefaultNamespace != "" {
+		return s.DefaultNamespace
+	}
+
+	return DefaultNamespace
+}
+
+// checksum returns the salted checksum of the data of the secret, which is false when the secret isn't added
+func (s *SecretProvider) checksum(ns, name string) (string, bool) {
+	sec, ok := s.Secrets[ns][name]
+	if !ok {
+		return "", false
+	}
+
+	return checksum(s.ChecksumSalt, sec), true
+}
+
+// Route selects the backend for the secret by its namespace, labels and annotations.
+// It's a no-op unless the provider was created with a router.
+func (s *SecretProvider) Route(ns, name string, labels, annotations map[string]string) error {
+	if s.router == nil {
+		return nil
+	}
+
+	backend, err := s.router.Route(ns, name, labels, annotations)
+	if err != nil {
+		return err
+	}
+
+	s.routed[ns+"/"+name] = backend
+
+	return nil
 }
 
 func (s *SecretProvider) Add(ns string, name string, dataKey string, dataValue string) {
@@ -23,6 +108,20 @@ func (s *SecretProvider) Add(ns string, name string, dataKey string, dataValue s
 		nsSec[name] = sec
 	}
 
+	k := ns + "/" + name + "/" + dataKey
+
+	// Values that aren't valid UTF-8, like keystores and keytabs, can't be saved in YAML and JSON as-is
+	if !utf8.ValidString(dataValue) {
+		if s.encoded == nil {
+			s.encoded = map[string]bool{}
+		}
+
+		s.encoded[k] = true
+		dataValue = base64.StdEncoding.EncodeToString([]byte(dataValue))
+	} else {
+		delete(s.encoded, k)
+	}
+
 	sec[dataKey] = dataValue
 }
 
@@ -32,9 +131,190 @@ func (s *SecretProvider) GetRef(ns string, name string, dataKey string) (string,
 		return "", fmt.Errorf("BUG: no secret registered for %s/%s/%s", ns, name, dataKey)
 	}
 
-	return s.backend.FormatRef(ns, name, dataKey), nil
+	backend, err := s.backendFor(ns, name)
+	if err != nil {
+		return "", err
+	}
+
+	ref := backend.FormatRef(ns, name, dataKey)
+	if ref == "" {
+		return "", fmt.Errorf("formatting ref for %s/%s/%s: the backend returned no ref. Secrets must be saved before formatting refs", ns, name, dataKey)
+	}
+
+	if s.encoded[ns+"/"+name+"/"+dataKey] {
+		ref = setRefParam(ref, RefEncodingParam, RefEncodingBase64)
+	}
+
+	return ref, nil
+}
+
+func (s *SecretProvider) backendFor(ns, name string) (SecretProviderBackend, error) {
+	if s.router == nil {
+		return s.backend, nil
+	}
+
+	backend, ok := s.routed[ns+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("BUG: no backend routed for %s/%s", ns, name)
+	}
+
+	return backend, nil
+}
+
+// Save saves all the added secrets into their backends.
+// Failures of backends are reported as *BackendError.
+func (s *SecretProvider) Save(ctx context.Context) error {
+	s.saved = nil
+
+	if s.router == nil {
+		return s.save(ctx, s.backend, s.Secrets)
+	}
+
+	// Partition the secrets by the backends they are routed to
+	partitions := map[SecretProviderBackend]map[string]map[string]Secret{}
+
+	for ns, nsSecrets := range s.Secrets {
+		for name, sec := range nsSecrets {
+			backend, err := s.backendFor(ns, name)
+			if err != nil {
+				return err
+			}
+
+			p, ok := partitions[backend]
+			if !ok {
+				p = map[string]map[string]Secret{}
+				partitions[backend] = p
+			}
+
+			if _, ok := p[ns]; !ok {
+				p[ns] = map[string]Secret{}
+			}
+
+			p[ns][name] = sec
+		}
+	}
+
+	// Save in the order the backends were created, so that failures are reproducible
+	for _, backend := range s.router.Backends() {
+		p, ok := partitions[backend]
+		if !ok {
+			continue
+		}
+
+		if err := s.save(ctx, backend, p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SecretProvider) save(ctx context.Context, backend SecretProviderBackend, sec map[string]map[string]Secret) error {
+	if err := backend.Save(ctx, sec); err != nil {
+		// A failed Save is reverted only when it saved a part, as the versions of the backend may be the ones saved before
+		if p, ok := backend.(PartialSaver); ok && p.SavedPartially() {
+			s.saved = append(s.saved, backend)
+		}
+
+		// Backends may return BackendError themselves to give the target
+		var be *BackendError
+		if errors.As(err, &be) {
+			return err
+		}
+
+		return &BackendError{Op: BackendOpSave, Err: err}
+	}
+
+	s.saved = append(s.saved, backend)
+
+	return nil
+}
+
+// ReadCurrentVersions reads the current versions of the backends that support conditional saves,
+// so that Save fails with *ConflictError when another writer saves into any of them in the meantime.
+func (s *SecretProvider) ReadCurrentVersions(ctx context.Context) error {
+	backends := []SecretProviderBackend{s.backend}
+	if s.router != nil {
+		backends = s.router.Backends()
+	}
+
+	for _, backend := range backends {
+		c, ok := backend.(ConditionalSaver)
+		if !ok {
+			continue
+		}
+
+		if err := c.ReadCurrentVersion(ctx); err != nil {
+			return &BackendError{Op: BackendOpReadCurrentVersion, Target: s.savedTarget(backend), Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Revert reverts the last Save in the backends that support it, so that the versions it created aren't left unreferenced
+// when the sanitized manifests fail to be written.
+// Failures and backends unable to revert, which are reported with ErrRevertUnsupported, are returned as *BackendError.
+// Every backend is tried even after a failure.
+func (s *SecretProvider) Revert(ctx context.Context) error {
+	var errs []error
+
+	for i := len(s.saved) - 1; i >= 0; i-- {
+		backend := s.saved[i]
+
+		var err error
+
+		if r, ok := backend.(SaveReverter); ok {
+			err = r.RevertSave(ctx)
+		} else {
+			err = ErrRevertUnsupported
+		}
+
+		if err != nil {
+			errs = append(errs, &BackendError{Op: BackendOpRevert, Target: s.savedTarget(backend), Err: err})
+		}
+	}
+
+	s.saved = nil
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Errorf("%w. Additionally: %s", errs[0], strings.Join(msgs[1:], "; "))
 }
 
-func (s *SecretProvider) Save() error {
-	return s.backend.Save(s.Secrets)
+// savedTarget returns the ref of the first secret saved into the backend, without the fragment, to be reported in errors
+func (s *SecretProvider) savedTarget(backend SecretProviderBackend) string {
+	var keys []string
+
+	for ns, nsSecrets := range s.Secrets {
+		for name, sec := range nsSecrets {
+			if b, err := s.backendFor(ns, name); err != nil || b != backend {
+				continue
+			}
+
+			for key := range sec {
+				keys = append(keys, ns+"/"+name+"/"+key)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return ""
+	}
+
+	sort.Strings(keys)
+
+	k := strings.SplitN(keys[0], "/", 3)
+
+	return strings.SplitN(backend.FormatRef(k[0], k[1], k[2]), "#", 2)[0]
 }
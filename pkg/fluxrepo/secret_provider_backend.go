@@ -1,6 +1,87 @@
 package fluxrepo
 
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// SecretProviderBackend saves and loads secrets to and from a secrets store.
+// The context passed to Save and Load cancels the API calls to the secrets store.
 type SecretProviderBackend interface {
 	FormatRef(ns, name, dataKey string) string
-	Save(map[string]map[string]Secret) error
+	Save(ctx context.Context, sec map[string]map[string]Secret) error
+	// Load returns the secrets saved in the specified version.
+	// An empty version means the latest one.
+	Load(ctx context.Context, version string) (map[string]map[string]Secret, error)
+}
+
+// BackendVersion is a version of the secrets saved in a versioned backend
+type BackendVersion struct {
+	ID      string
+	Created time.Time
+	// Current is true for the latest version, which is never pruned
+	Current bool
+}
+
+// VersionPruner is implemented by backends that are able to delete or deprecate their old versions
+type VersionPruner interface {
+	ListVersions(ctx context.Context) ([]BackendVersion, error)
+	DeleteVersion(ctx context.Context, version string) error
+}
+
+// SaveReverter is implemented by backends that are able to revert their last Save,
+// so that a write failing after saving secrets doesn't leave behind versions that nothing references.
+type SaveReverter interface {
+	// RevertSave deletes or deprecates the versions created by the last Save
+	RevertSave(ctx context.Context) error
+}
+
+// PartialSaver is implemented by reverting backends whose Save may fail after saving some of the secrets,
+// like the shards of the AWS backends, so that the part saved by the failed Save is reverted too.
+type PartialSaver interface {
+	// SavedPartially returns true when the last Save failed after saving some of the secrets
+	SavedPartially() bool
+}
+
+// ConditionalSaver is implemented by backends that are able to save only when nobody else saved in the meantime,
+// so that concurrent writes to the same path fail instead of overwriting each other.
+type ConditionalSaver interface {
+	// ReadCurrentVersion reads the current version of the path.
+	// The next Save fails with *ConflictError when the version is no longer the current one.
+	ReadCurrentVersion(ctx context.Context) error
+}
+
+// versionPrecondition is the version that ConditionalSaver expects to be current on the next Save
+type versionPrecondition struct {
+	// read is true after ReadCurrentVersion. Save is unconditional otherwise
+	read bool
+	// version is empty when nothing is saved at the path yet
+	version string
+}
+
+func encodeSecrets(sec map[string]map[string]Secret) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(sec); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeSecrets(data []byte) (map[string]map[string]Secret, error) {
+	sec := map[string]map[string]Secret{}
+
+	if err := yaml.Unmarshal(data, &sec); err != nil {
+		return nil, fmt.Errorf("decoding secrets: %w", err)
+	}
+
+	return sec, nil
 }
@@ -1,65 +1,528 @@
 package fluxrepo
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/variantdev/vals/pkg/awsclicompat"
-	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	secretsManagerCurrentStage  = "AWSCURRENT"
+	secretsManagerPreviousStage = "AWSPREVIOUS"
+
+	// secretsManagerMaxSecretStringSize is the maximum size of a secret value in bytes.
+	// Larger secrets are sharded across multiple secrets.
+	secretsManagerMaxSecretStringSize = 65536
 )
 
 type AWSSecretsBackend struct {
 	Path      string
 	VersionID string
 	AWSOptions
+	AWSResourceOptions
+
+	// ResourcePolicy is the JSON resource policy attached to the secret
+	ResourcePolicy string
+
+	shards *secretShards
+
+	// saved is the list of secret versions created by the last Save, to be reverted by RevertSave
+	saved []savedSecretVersion
+
+	precondition versionPrecondition
+}
+
+type savedSecretVersion struct {
+	path, version string
+	// created is true when the secret itself is created by the save
+	created bool
+}
+
+func init() {
+	RegisterBackend(BackendFactory{
+		Name:        "awssecrets",
+		Description: "AWS Secrets Manager",
+		RefScheme:   "awssecrets",
+		RefVersion:  "version_id",
+		Options: append(append(append([]BackendOption{}, awsBackendOptions...), awsResourceBackendOptions...),
+			BackendOption{Name: "aws-secrets-resource-policy-file", Usage: "Path to the JSON file of the resource policy attached to the Secrets Manager secret"},
+		),
+		New: func(path string, opts BackendOptions) (SecretProviderBackend, error) {
+			resOpts, err := awsResourceOptionsFrom(opts)
+			if err != nil {
+				return nil, err
+			}
+
+			var policy string
+
+			if f := opts.Get("aws-secrets-resource-policy-file"); f != "" {
+				bs, err := ioutil.ReadFile(f)
+				if err != nil {
+					return nil, fmt.Errorf("reading resource policy file: %w", err)
+				}
+
+				policy = string(bs)
+			}
+
+			return &AWSSecretsBackend{
+				Path:               path,
+				AWSOptions:         awsOptionsFrom(opts),
+				AWSResourceOptions: resOpts,
+				ResourcePolicy:     policy,
+			}, nil
+		},
+	})
 }
 
 func (s *AWSSecretsBackend) FormatRef(ns, name, dataKey string) string {
-	return fmt.Sprintf("ref+awssecrets://%s?version_id=%s#/%s/%s/%s", s.Path, s.VersionID, ns, name, dataKey)
+	path, version := s.Path, s.VersionID
+
+	if s.shards != nil {
+		path, version = s.shards.lookup(ns, name, dataKey)
+	}
+
+	return fmt.Sprintf("ref+awssecrets://%s?version_id=%s#/%s/%s/%s", path, version, ns, name, dataKey)
 }
 
-func (s *AWSSecretsBackend) Save(sec map[string]map[string]Secret) error {
+func (s *AWSSecretsBackend) Save(ctx context.Context, sec map[string]map[string]Secret) error {
 	m := secretsmanager.New(awsclicompat.NewSession(s.Region, s.Profile))
 
-	var buf bytes.Buffer
+	data, err := encodeSecrets(sec)
+	if err != nil {
+		return err
+	}
+
+	s.shards = nil
+	s.saved = nil
 
-	enc := yaml.NewEncoder(&buf)
-	enc.SetIndent(2)
+	precondition := s.precondition
+	s.precondition = versionPrecondition{}
 
-	if err := enc.Encode(sec); err != nil {
+	saveShard := func(path string, data []byte) (string, error) {
+		return s.saveSecretString(ctx, m, path, data, versionPrecondition{})
+	}
+
+	currentShard := func(path string) ([]byte, bool, error) {
+		return currentSecretString(ctx, m, path)
+	}
+
+	if len(data) <= secretsManagerMaxSecretStringSize {
+		s.VersionID, err = s.saveSecretString(ctx, m, s.Path, data, precondition)
+		if err != nil {
+			return err
+		}
+
+		return clearStaleShards(s.Path, 1, currentShard, saveShard)
+	}
+
+	shards, err := shardSecrets(sec, secretsManagerMaxSecretStringSize)
+	if err != nil {
+		return err
+	}
+
+	if err := shards.save(s.Path, func(path string, data []byte) (string, error) {
+		// Only the first shard, which is saved first at the original path, is saved conditionally.
+		// A conflict there stops the save before the other shards are saved.
+		if path != s.Path {
+			return saveShard(path, data)
+		}
+
+		return s.saveSecretString(ctx, m, path, data, precondition)
+	}); err != nil {
 		return err
 	}
 
-	secretString := buf.String()
+	s.VersionID = shards.versions[0]
+	s.shards = shards
+
+	return clearStaleShards(s.Path, len(shards.shards), currentShard, saveShard)
+}
 
-	createdSecret, createErr := m.CreateSecret(&secretsmanager.CreateSecretInput{
-		Description:  aws.String("flux-repo secret"),
-		Name:         aws.String(s.Path),
-		SecretString: aws.String(secretString),
-		Tags: []*secretsmanager.Tag{{
-			Key:   aws.String("flux-repo"),
-			Value: aws.String("managed"),
-		}},
+// currentSecretString returns the value of the version with AWSCURRENT, and false when the secret doesn't exist
+func currentSecretString(ctx context.Context, m *secretsmanager.SecretsManager, path string) ([]byte, bool, error) {
+	out, err := m.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(path),
 	})
+	if err != nil {
+		var notFound *secretsmanager.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return nil, false, nil
+		}
 
-	if createErr != nil {
-		if _, exists := createErr.(*secretsmanager.ResourceExistsException); exists {
-			r, putErr := m.PutSecretValue(&secretsmanager.PutSecretValueInput{
-				SecretId:     aws.String(s.Path),
+		return nil, false, fmt.Errorf("getting secret value: %w", err)
+	}
+
+	return []byte(*out.SecretString), true, nil
+}
+
+func (s *AWSSecretsBackend) saveSecretString(ctx context.Context, m *secretsmanager.SecretsManager, path string, data []byte, precondition versionPrecondition) (string, error) {
+	secretString := string(data)
+
+	var kmsKeyID *string
+	if s.KMSKeyID != "" {
+		kmsKeyID = aws.String(s.KMSKeyID)
+	}
+
+	var tags []*secretsmanager.Tag
+	for _, t := range s.allTags() {
+		tags = append(tags, &secretsmanager.Tag{Key: aws.String(t[0]), Value: aws.String(t[1])})
+	}
+
+	var versionID string
+	var created bool
+
+	if precondition.read && precondition.version != "" {
+		v, err := s.putSecretStringIfCurrent(ctx, m, path, secretString, kmsKeyID, precondition.version)
+		if err != nil {
+			return "", err
+		}
+
+		if err := tagSecret(ctx, m, path, tags); err != nil {
+			return "", err
+		}
+
+		versionID = v
+	} else {
+		createdSecret, createErr := m.CreateSecretWithContext(ctx, &secretsmanager.CreateSecretInput{
+			Description:  aws.String("flux-repo secret"),
+			KmsKeyId:     kmsKeyID,
+			Name:         aws.String(path),
+			SecretString: aws.String(secretString),
+			Tags:         tags,
+		})
+
+		if createErr != nil {
+			if _, exists := createErr.(*secretsmanager.ResourceExistsException); !exists {
+				return "", createErr
+			}
+
+			if precondition.read {
+				// Another writer created the secret after ReadCurrentVersion
+				conflict := &ConflictError{Path: path}
+				conflict.Actual, _ = currentSecretVersion(ctx, m, path)
+
+				return "", conflict
+			}
+
+			// UpdateSecret creates a new version like PutSecretValue, while also updating the KMS key
+			r, updateErr := m.UpdateSecretWithContext(ctx, &secretsmanager.UpdateSecretInput{
+				KmsKeyId:     kmsKeyID,
+				SecretId:     aws.String(path),
 				SecretString: aws.String(secretString),
 			})
+			if updateErr != nil {
+				return "", updateErr
+			}
 
-			s.VersionID = *r.VersionId
+			if err := tagSecret(ctx, m, path, tags); err != nil {
+				return "", err
+			}
 
-			return putErr
+			versionID = *r.VersionId
+		} else {
+			versionID = *createdSecret.VersionId
+			created = true
 		}
+	}
 
-		return createErr
-	} else {
-		s.VersionID = *createdSecret.VersionId
+	s.saved = append(s.saved, savedSecretVersion{path: path, version: versionID, created: created})
+
+	if s.ResourcePolicy != "" {
+		if _, err := m.PutResourcePolicyWithContext(ctx, &secretsmanager.PutResourcePolicyInput{
+			SecretId:       aws.String(path),
+			ResourcePolicy: aws.String(s.ResourcePolicy),
+		}); err != nil {
+			return "", fmt.Errorf("putting resource policy: %w", err)
+		}
+	}
+
+	return versionID, nil
+}
+
+// putSecretStringIfCurrent creates a new version of the secret, and makes it current only when expected is still the current version.
+// Secrets Manager has no conditional put. Instead, the new version is created with a staging label unique to the write,
+// and then AWSCURRENT is moved to it with RemoveFromVersionId, which fails when AWSCURRENT is attached to another version.
+func (s *AWSSecretsBackend) putSecretStringIfCurrent(ctx context.Context, m *secretsmanager.SecretsManager, path, secretString string, kmsKeyID *string, expected string) (string, error) {
+	if kmsKeyID != nil {
+		// PutSecretValue doesn't accept the KMS key. Updating it beforehand makes the new version encrypted with it
+		if _, err := m.UpdateSecretWithContext(ctx, &secretsmanager.UpdateSecretInput{
+			KmsKeyId: kmsKeyID,
+			SecretId: aws.String(path),
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	// The token makes retries of the request by aws-sdk-go idempotent, and becomes the ID of the new version
+	token, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+
+	pendingStage := "flux-repo-pending-" + token
+
+	put, err := m.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{
+		ClientRequestToken: aws.String(token),
+		SecretId:           aws.String(path),
+		SecretString:       aws.String(secretString),
+		VersionStages:      []*string{aws.String(pendingStage)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	versionID := *put.VersionId
+
+	_, moveErr := m.UpdateSecretVersionStageWithContext(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+		SecretId:            aws.String(path),
+		VersionStage:        aws.String(secretsManagerCurrentStage),
+		MoveToVersionId:     aws.String(versionID),
+		RemoveFromVersionId: aws.String(expected),
+	})
+
+	// The pending label is removed either way, so that the new version is deprecated on conflicts
+	if err := deprecateSecretVersion(ctx, m, path, versionID, []*string{aws.String(pendingStage)}); err != nil {
+		return "", err
+	}
+
+	if moveErr != nil {
+		if actual, err := currentSecretVersion(ctx, m, path); err == nil && actual != expected {
+			return "", &ConflictError{Path: path, Expected: expected, Actual: actual}
+		}
+
+		return "", fmt.Errorf("moving staging label %s to version %s: %w", secretsManagerCurrentStage, versionID, moveErr)
+	}
+
+	return versionID, nil
+}
+
+func tagSecret(ctx context.Context, m *secretsmanager.SecretsManager, path string, tags []*secretsmanager.Tag) error {
+	if _, err := m.TagResourceWithContext(ctx, &secretsmanager.TagResourceInput{
+		SecretId: aws.String(path),
+		Tags:     tags,
+	}); err != nil {
+		return fmt.Errorf("tagging secret: %w", err)
 	}
 
 	return nil
 }
+
+// ReadCurrentVersion reads the version with AWSCURRENT, which the next Save requires to be still current when moving AWSCURRENT to the new version.
+// When the secret doesn't exist yet, the next Save fails if another writer creates it in the meantime.
+func (s *AWSSecretsBackend) ReadCurrentVersion(ctx context.Context) error {
+	m := secretsmanager.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	version, err := currentSecretVersion(ctx, m, s.Path)
+	if err != nil {
+		return err
+	}
+
+	s.precondition = versionPrecondition{read: true, version: version}
+
+	return nil
+}
+
+// currentSecretVersion returns the ID of the version with AWSCURRENT, or an empty string when the secret doesn't exist
+func currentSecretVersion(ctx context.Context, m *secretsmanager.SecretsManager, path string) (string, error) {
+	stages, err := secretVersionStages(ctx, m, path)
+	if err != nil {
+		var notFound *secretsmanager.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	for id, ss := range stages {
+		if hasStage(ss, secretsManagerCurrentStage) {
+			return id, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (s *AWSSecretsBackend) Load(ctx context.Context, version string) (map[string]map[string]Secret, error) {
+	m := secretsmanager.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	in := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(s.Path),
+	}
+
+	if version != "" {
+		in.VersionId = aws.String(version)
+	}
+
+	out, err := m.GetSecretValueWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("getting secret value: %w", err)
+	}
+
+	return decodeSecrets([]byte(*out.SecretString))
+}
+
+func (s *AWSSecretsBackend) ListVersions(ctx context.Context) ([]BackendVersion, error) {
+	m := secretsmanager.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	var versions []BackendVersion
+
+	err := m.ListSecretVersionIdsPagesWithContext(ctx, &secretsmanager.ListSecretVersionIdsInput{
+		SecretId: aws.String(s.Path),
+	}, func(out *secretsmanager.ListSecretVersionIdsOutput, lastPage bool) bool {
+		for _, v := range out.Versions {
+			var current bool
+			for _, stage := range v.VersionStages {
+				if *stage == secretsManagerCurrentStage {
+					current = true
+				}
+			}
+
+			versions = append(versions, BackendVersion{
+				ID:      *v.VersionId,
+				Created: aws.TimeValue(v.CreatedDate),
+				Current: current,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing secret versions: %w", err)
+	}
+
+	return versions, nil
+}
+
+// DeleteVersion deprecates the version by removing all its staging labels.
+// Secrets Manager has no API to delete a single version. Instead, it deletes deprecated versions on its own.
+func (s *AWSSecretsBackend) DeleteVersion(ctx context.Context, version string) error {
+	m := secretsmanager.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	stages, err := secretVersionStages(ctx, m, s.Path)
+	if err != nil {
+		return err
+	}
+
+	if hasStage(stages[version], secretsManagerCurrentStage) {
+		return fmt.Errorf("refusing to deprecate the current version %s", version)
+	}
+
+	return deprecateSecretVersion(ctx, m, s.Path, version, stages[version])
+}
+
+// SavedPartially returns true when the last Save failed after saving some of the shards
+func (s *AWSSecretsBackend) SavedPartially() bool {
+	return len(s.saved) > 0
+}
+
+// RevertSave reverts the versions created by the last Save.
+// AWSCURRENT is moved back to the previous version, and the new version is deprecated like DeleteVersion does.
+// Secrets created by the last Save are deleted without a recovery window instead, so that the next write can create them again
+// rather than failing while they are scheduled for deletion.
+func (s *AWSSecretsBackend) RevertSave(ctx context.Context) error {
+	m := secretsmanager.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	for i := len(s.saved) - 1; i >= 0; i-- {
+		v := s.saved[i]
+
+		if v.created {
+			if _, err := m.DeleteSecretWithContext(ctx, &secretsmanager.DeleteSecretInput{
+				SecretId:                   aws.String(v.path),
+				ForceDeleteWithoutRecovery: aws.Bool(true),
+			}); err != nil {
+				return fmt.Errorf("deleting secret %s: %w", v.path, err)
+			}
+
+			s.saved = s.saved[:i]
+			continue
+		}
+
+		stages, err := secretVersionStages(ctx, m, v.path)
+		if err != nil {
+			return err
+		}
+
+		if hasStage(stages[v.version], secretsManagerCurrentStage) {
+			var previous string
+			for id, ss := range stages {
+				if hasStage(ss, secretsManagerPreviousStage) {
+					previous = id
+				}
+			}
+
+			if previous == "" {
+				return fmt.Errorf("reverting version %s of %s: no previous version found", v.version, v.path)
+			}
+
+			if _, err := m.UpdateSecretVersionStageWithContext(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+				SecretId:            aws.String(v.path),
+				VersionStage:        aws.String(secretsManagerCurrentStage),
+				MoveToVersionId:     aws.String(previous),
+				RemoveFromVersionId: aws.String(v.version),
+			}); err != nil {
+				return fmt.Errorf("moving staging label %s back to version %s of %s: %w", secretsManagerCurrentStage, previous, v.path, err)
+			}
+
+			// Secrets Manager moves AWSPREVIOUS to the version AWSCURRENT is removed from
+			stages[v.version] = []*string{aws.String(secretsManagerPreviousStage)}
+		}
+
+		if err := deprecateSecretVersion(ctx, m, v.path, v.version, stages[v.version]); err != nil {
+			return err
+		}
+
+		s.saved = s.saved[:i]
+	}
+
+	return nil
+}
+
+// secretVersionStages returns the staging labels of every version of the secret, keyed by version ID
+func secretVersionStages(ctx context.Context, m *secretsmanager.SecretsManager, path string) (map[string][]*string, error) {
+	stages := map[string][]*string{}
+
+	err := m.ListSecretVersionIdsPagesWithContext(ctx, &secretsmanager.ListSecretVersionIdsInput{
+		SecretId: aws.String(path),
+	}, func(out *secretsmanager.ListSecretVersionIdsOutput, lastPage bool) bool {
+		for _, v := range out.Versions {
+			stages[*v.VersionId] = v.VersionStages
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing secret versions: %w", err)
+	}
+
+	return stages, nil
+}
+
+// deprecateSecretVersion removes the staging labels from the version
+func deprecateSecretVersion(ctx context.Context, m *secretsmanager.SecretsManager, path, version string, stages []*string) error {
+	for _, stage := range stages {
+		_, err := m.UpdateSecretVersionStageWithContext(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+			SecretId:            aws.String(path),
+			VersionStage:        stage,
+			RemoveFromVersionId: aws.String(version),
+		})
+		if err != nil {
+			return fmt.Errorf("removing staging label %s from version %s: %w", *stage, version, err)
+		}
+	}
+
+	return nil
+}
+
+func hasStage(stages []*string, stage string) bool {
+	for _, s := range stages {
+		if *s == stage {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,14 +1,15 @@
 package fluxrepo
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"sort"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go/service/ssm"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/variantdev/vals/pkg/awsclicompat"
-	yaml "gopkg.in/yaml.v3"
 )
 
 type AWSOptions struct {
@@ -16,67 +17,354 @@ type AWSOptions struct {
 	Profile string
 }
 
+var awsBackendOptions = []BackendOption{
+	{Name: "aws-region", Usage: "AWS region to be used in aws-sdk"},
+	{Name: "aws-profile", Usage: "AWS profile to be used in aws-sdk"},
+}
+
+func awsOptionsFrom(opts BackendOptions) AWSOptions {
+	return AWSOptions{
+		Region:  opts.Get("aws-region"),
+		Profile: opts.Get("aws-profile"),
+	}
+}
+
+// AWSResourceOptions configures the encryption and tags of the resources created by AWS backends
+type AWSResourceOptions struct {
+	// KMSKeyID is the ID, ARN or alias of the customer-managed KMS key used for encryption.
+	// The AWS-managed key is used when empty.
+	KMSKeyID string
+	// Tags are added to the resources in addition to the `flux-repo: managed` tag
+	Tags map[string]string
+}
+
+var awsResourceBackendOptions = []BackendOption{
+	{Name: "aws-kms-key-id", Usage: "ID, ARN or alias of the customer-managed KMS key to encrypt secrets with"},
+	{Name: "aws-tag", Usage: "KEY=VALUE tag added to the AWS resources storing secrets. Can be specified multiple times", Multi: true},
+}
+
+func awsResourceOptionsFrom(opts BackendOptions) (AWSResourceOptions, error) {
+	tags, err := opts.KeyValues("aws-tag")
+	if err != nil {
+		return AWSResourceOptions{}, err
+	}
+
+	return AWSResourceOptions{
+		KMSKeyID: opts.Get("aws-kms-key-id"),
+		Tags:     tags,
+	}, nil
+}
+
+// allTags returns the tags to be added to the AWS resources, sorted by key
+func (o AWSResourceOptions) allTags() [][2]string {
+	tags := map[string]string{"flux-repo": "managed"}
+	for k, v := range o.Tags {
+		tags[k] = v
+	}
+
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var res [][2]string
+	for _, k := range keys {
+		res = append(res, [2]string{k, tags[k]})
+	}
+
+	return res
+}
+
+func init() {
+	RegisterBackend(BackendFactory{
+		Name:        "awsssm",
+		Description: "AWS SSM Parameter Store",
+		RefScheme:   "awsssm",
+		RefVersion:  "version",
+		Options:     append(append([]BackendOption{}, awsBackendOptions...), awsResourceBackendOptions...),
+		New: func(path string, opts BackendOptions) (SecretProviderBackend, error) {
+			resOpts, err := awsResourceOptionsFrom(opts)
+			if err != nil {
+				return nil, err
+			}
+
+			return &AWSSSMBackend{Path: path, AWSOptions: awsOptionsFrom(opts), AWSResourceOptions: resOpts}, nil
+		},
+	})
+}
+
+const (
+	// ssmStandardTierMaxValueSize is the maximum size of a standard tier parameter value in bytes.
+	// Larger values are saved in the advanced tier.
+	ssmStandardTierMaxValueSize = 4096
+	// ssmAdvancedTierMaxValueSize is the maximum size of an advanced tier parameter value in bytes.
+	// Larger secrets are sharded across multiple parameters.
+	ssmAdvancedTierMaxValueSize = 8192
+)
+
+// ssmConflictLabel is the label attached to the parameter version saved despite a conflict.
+// SSM moves the label when it's attached to another version, so it marks the latest one.
+const ssmConflictLabel = "flux-repo-conflict"
+
 type AWSSSMBackend struct {
 	Path    string
 	Version string
 
 	AWSOptions
+	AWSResourceOptions
+
+	shards *secretShards
+
+	precondition versionPrecondition
 }
 
 func (s *AWSSSMBackend) FormatRef(ns, name, dataKey string) string {
-	return fmt.Sprintf("ref+awsssm://%s?mode=singleparam&version=%s#/%s/%s/%s", s.Path, s.Version, ns, name, dataKey)
+	path, version := s.Path, s.Version
+
+	if s.shards != nil {
+		path, version = s.shards.lookup(ns, name, dataKey)
+	}
+
+	return fmt.Sprintf("ref+awsssm://%s?mode=singleparam&version=%s#/%s/%s/%s", path, version, ns, name, dataKey)
 }
 
-func (s *AWSSSMBackend) Save(sec map[string]map[string]Secret) error {
+func (s *AWSSSMBackend) Save(ctx context.Context, sec map[string]map[string]Secret) error {
 	m := ssm.New(awsclicompat.NewSession(s.Region, s.Profile))
 
-	var buf bytes.Buffer
+	data, err := encodeSecrets(sec)
+	if err != nil {
+		return err
+	}
+
+	s.shards = nil
+
+	precondition := s.precondition
+	s.precondition = versionPrecondition{}
+
+	saveShard := func(path string, data []byte) (string, error) {
+		return s.putParameter(ctx, m, path, data, versionPrecondition{})
+	}
+
+	currentShard := func(path string) ([]byte, bool, error) {
+		return currentParameterValue(ctx, m, path)
+	}
+
+	if len(data) <= ssmAdvancedTierMaxValueSize {
+		s.Version, err = s.putParameter(ctx, m, s.Path, data, precondition)
+		if err != nil {
+			return err
+		}
+
+		return clearStaleShards(s.Path, 1, currentShard, saveShard)
+	}
+
+	shards, err := shardSecrets(sec, ssmAdvancedTierMaxValueSize)
+	if err != nil {
+		return err
+	}
 
-	enc := yaml.NewEncoder(&buf)
-	enc.SetIndent(2)
+	if err := shards.save(s.Path, func(path string, data []byte) (string, error) {
+		// Only the first shard, which is saved first at the original path, is checked for conflicts
+		if path != s.Path {
+			return saveShard(path, data)
+		}
 
-	if err := enc.Encode(sec); err != nil {
+		return s.putParameter(ctx, m, path, data, precondition)
+	}); err != nil {
 		return err
 	}
 
-	secretString := buf.String()
+	s.Version = shards.versions[0]
+	s.shards = shards
 
-	path := s.Path
+	return clearStaleShards(s.Path, len(shards.shards), currentShard, saveShard)
+}
+
+func (s *AWSSSMBackend) putParameter(ctx context.Context, m *ssm.SSM, path string, data []byte, precondition versionPrecondition) (string, error) {
+	secretString := string(data)
 
 	if path[0] != '/' {
 		path = "/" + path
 	}
 
-	createdParam, putErr := m.PutParameter(&ssm.PutParameterInput{
+	// Values too large for the standard tier are saved in the advanced tier.
+	// The tier is otherwise left unspecified to keep the default tier of the account.
+	var tier *string
+	if len(data) > ssmStandardTierMaxValueSize {
+		tier = aws.String(ssm.ParameterTierAdvanced)
+	}
+
+	var keyID *string
+	if s.KMSKeyID != "" {
+		keyID = aws.String(s.KMSKeyID)
+	}
+
+	var tags []*ssm.Tag
+	for _, t := range s.allTags() {
+		tags = append(tags, &ssm.Tag{Key: aws.String(t[0]), Value: aws.String(t[1])})
+	}
+
+	createdParam, putErr := m.PutParameterWithContext(ctx, &ssm.PutParameterInput{
 		Description: aws.String("flux-repo secret"),
+		KeyId:       keyID,
 		Name:        aws.String(path),
-		Tags: []*ssm.Tag{{
-			Key:   aws.String("flux-repo"),
-			Value: aws.String("managed"),
-		}},
-		Type:  aws.String(ssm.ParameterTypeSecureString),
-		Value: aws.String(secretString),
+		Tags:        tags,
+		Tier:        tier,
+		Type:        aws.String(ssm.ParameterTypeSecureString),
+		Value:       aws.String(secretString),
 	})
 	if putErr != nil {
 		switch putErr.(type) {
 		case *ssm.ParameterAlreadyExists:
-			createdParam, putErr = m.PutParameter(&ssm.PutParameterInput{
+			if precondition.read && precondition.version == "" {
+				// Another writer created the parameter after ReadCurrentVersion
+				conflict := &ConflictError{Path: path}
+				conflict.Actual, _ = currentParameterVersion(ctx, m, path)
+
+				return "", conflict
+			}
+
+			createdParam, putErr = m.PutParameterWithContext(ctx, &ssm.PutParameterInput{
 				Description: aws.String("flux-repo secret"),
+				KeyId:       keyID,
 				Name:        aws.String(path),
 				Overwrite:   aws.Bool(true),
+				Tier:        tier,
 				Type:        aws.String(ssm.ParameterTypeSecureString),
 				Value:       aws.String(secretString),
 			})
 
 			if putErr != nil {
-				return fmt.Errorf("overwriting ssm parameter: %w", putErr)
+				return "", fmt.Errorf("overwriting ssm parameter: %w", putErr)
+			}
+
+			// PutParameter doesn't accept tags when overwriting
+			_, tagErr := m.AddTagsToResourceWithContext(ctx, &ssm.AddTagsToResourceInput{
+				ResourceId:   aws.String(path),
+				ResourceType: aws.String(ssm.ResourceTypeForTaggingParameter),
+				Tags:         tags,
+			})
+			if tagErr != nil {
+				return "", fmt.Errorf("tagging ssm parameter: %w", tagErr)
 			}
 		default:
-			return fmt.Errorf("putting ssm parameter: %w", putErr)
+			return "", fmt.Errorf("putting ssm parameter: %w", putErr)
+		}
+	}
+
+	version := fmt.Sprintf("%d", *createdParam.Version)
+
+	// SSM has no conditional put, so unlike the cas of Vault or If-Match of S3, this doesn't prevent the write.
+	// Conflicts are detected only after saving, from the version number, which increments by one on every put.
+	// The version saved by the other writer stays intact as SSM keeps all the versions, but the one saved here becomes
+	// the latest version without being referenced, so it's labeled to be found and cleaned up.
+	if precondition.read && precondition.version != "" {
+		expected, err := strconv.ParseInt(precondition.version, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("parsing version %q: %w", precondition.version, err)
+		}
+
+		if *createdParam.Version != expected+1 {
+			conflict := &ConflictError{
+				Path:     path,
+				Expected: precondition.version,
+				Actual:   fmt.Sprintf("%d", *createdParam.Version-1),
+				Orphaned: version,
+			}
+
+			if _, err := m.LabelParameterVersionWithContext(ctx, &ssm.LabelParameterVersionInput{
+				Name:             aws.String(path),
+				ParameterVersion: createdParam.Version,
+				Labels:           []*string{aws.String(ssmConflictLabel)},
+			}); err == nil {
+				conflict.OrphanedLabel = ssmConflictLabel
+			}
+
+			return "", conflict
 		}
 	}
 
-	s.Version = fmt.Sprintf("%d", *createdParam.Version)
+	return version, nil
+}
+
+// ReadCurrentVersion reads the current version of the parameter.
+// SSM has no conditional put, so this doesn't prevent overwriting. Instead, the next Save fails after saving
+// when it finds a version saved by another writer in the meantime, leaving its own version unreferenced.
+func (s *AWSSSMBackend) ReadCurrentVersion(ctx context.Context) error {
+	m := ssm.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	version, err := currentParameterVersion(ctx, m, s.Path)
+	if err != nil {
+		return err
+	}
+
+	s.precondition = versionPrecondition{read: true, version: version}
 
 	return nil
 }
+
+// currentParameterVersion returns the current version of the parameter, or an empty string when the parameter doesn't exist
+func currentParameterVersion(ctx context.Context, m *ssm.SSM, path string) (string, error) {
+	if path[0] != '/' {
+		path = "/" + path
+	}
+
+	out, err := m.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name: aws.String(path),
+	})
+	if err != nil {
+		if _, ok := err.(*ssm.ParameterNotFound); ok {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("getting ssm parameter: %w", err)
+	}
+
+	return fmt.Sprintf("%d", *out.Parameter.Version), nil
+}
+
+// currentParameterValue returns the decrypted value of the latest version of the parameter, and false when the parameter doesn't exist
+func currentParameterValue(ctx context.Context, m *ssm.SSM, path string) ([]byte, bool, error) {
+	if path[0] != '/' {
+		path = "/" + path
+	}
+
+	out, err := m.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(path),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		if _, ok := err.(*ssm.ParameterNotFound); ok {
+			return nil, false, nil
+		}
+
+		return nil, false, fmt.Errorf("getting ssm parameter: %w", err)
+	}
+
+	return []byte(*out.Parameter.Value), true, nil
+}
+
+func (s *AWSSSMBackend) Load(ctx context.Context, version string) (map[string]map[string]Secret, error) {
+	m := ssm.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	path := s.Path
+
+	if path[0] != '/' {
+		path = "/" + path
+	}
+
+	if version != "" {
+		path = path + ":" + version
+	}
+
+	out, err := m.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(path),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting ssm parameter: %w", err)
+	}
+
+	return decodeSecrets([]byte(*out.Parameter.Value))
+}
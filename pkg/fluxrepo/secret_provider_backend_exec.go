@@ -0,0 +1,234 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// ExecProtocolVersion is the version of the protocol spoken between flux-repo and external backend plugins.
+// It is sent in every request, and the plugin must echo it back in the response.
+const ExecProtocolVersion = "flux-repo.exec/v1"
+
+// ExecRequest is written as JSON to the stdin of the plugin
+type ExecRequest struct {
+	ProtocolVersion string `json:"protocolVersion"`
+	// Operation is the name of the SecretProviderBackend method being invoked. Either "save" or "load".
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	// Version is the version to be loaded. Set only for the "load" operation
+	Version string                       `json:"version,omitempty"`
+	Options map[string]string            `json:"options,omitempty"`
+	Secrets map[string]map[string]Secret `json:"secrets,omitempty"`
+}
+
+// ExecResponse is read as JSON from the stdout of the plugin
+type ExecResponse struct {
+	ProtocolVersion string `json:"protocolVersion"`
+	// Version is the version ID of the saved secrets, if the plugin's secrets store is versioned
+	Version string `json:"version,omitempty"`
+	// RefTemplate is a Go text/template for the ref of every secret data key.
+	// It is rendered with .Namespace, .Name, .Key, .Path and .Version, like `ref+foo://{{.Path}}?version={{.Version}}#/{{.Namespace}}/{{.Name}}/{{.Key}}`.
+	RefTemplate string `json:"refTemplate,omitempty"`
+	// Secrets is the loaded secrets. Set only for the "load" operation
+	Secrets map[string]map[string]Secret `json:"secrets,omitempty"`
+	// Error is set by the plugin to report a failure
+	Error string `json:"error,omitempty"`
+}
+
+// ExecBackend delegates saving secrets to an external plugin binary, so that in-house secret stores
+// can be integrated without forking flux-repo.
+type ExecBackend struct {
+	Command string
+	Path    string
+	Options map[string]string
+
+	Version string
+
+	refTemplate *template.Template
+	// refs are the refs rendered by Save, keyed by namespace, name and key
+	refs map[string]string
+}
+
+func init() {
+	RegisterBackend(BackendFactory{
+		Name:        "exec",
+		Description: "External plugin. Specify it as \"exec:PATH\"",
+		ArgOption:   "exec-plugin",
+		Options: []BackendOption{
+			{Name: "exec-plugin", Usage: "Path to the plugin. Usually set via \"-b exec:PATH\""},
+			{Name: "exec-opt", Usage: "KEY=VALUE option passed to the plugin. Can be specified multiple times", Multi: true},
+		},
+		New: func(path string, opts BackendOptions) (SecretProviderBackend, error) {
+			pluginOpts, err := opts.KeyValues("exec-opt")
+			if err != nil {
+				return nil, err
+			}
+
+			return &ExecBackend{Command: opts.Get("exec-plugin"), Path: path, Options: pluginOpts}, nil
+		},
+		Validate: func(backend SecretProviderBackend) error {
+			return backend.(*ExecBackend).Validate()
+		},
+	})
+}
+
+type execRefData struct {
+	Namespace, Name, Key string
+	Path, Version        string
+}
+
+// FormatRef returns the ref rendered with the refTemplate returned by the plugin.
+// It returns an empty string before Save, or when the template fails to render, which SecretProvider.GetRef reports as an error.
+func (s *ExecBackend) FormatRef(ns, name, dataKey string) string {
+	if ref, ok := s.refs[ns+"/"+name+"/"+dataKey]; ok {
+		return ref
+	}
+
+	if s.refTemplate == nil {
+		return ""
+	}
+
+	ref, err := s.renderRef(s.refTemplate, ns, name, dataKey)
+	if err != nil {
+		return ""
+	}
+
+	return ref
+}
+
+func (s *ExecBackend) renderRef(tmpl *template.Template, ns, name, dataKey string) (string, error) {
+	var buf bytes.Buffer
+
+	if err := tmpl.Execute(&buf, execRefData{Namespace: ns, Name: name, Key: dataKey, Path: s.Path, Version: s.Version}); err != nil {
+		return "", fmt.Errorf("plugin %s: rendering refTemplate for %s/%s/%s: %w", s.Command, ns, name, dataKey, err)
+	}
+
+	return buf.String(), nil
+}
+
+func (s *ExecBackend) Save(ctx context.Context, sec map[string]map[string]Secret) error {
+	req := ExecRequest{
+		ProtocolVersion: ExecProtocolVersion,
+		Operation:       "save",
+		Path:            s.Path,
+		Options:         s.Options,
+		Secrets:         sec,
+	}
+
+	var res ExecResponse
+
+	if err := s.invoke(ctx, req, &res); err != nil {
+		return err
+	}
+
+	if res.ProtocolVersion != ExecProtocolVersion {
+		return fmt.Errorf("plugin %s: unsupported protocol version %q: expected %q", s.Command, res.ProtocolVersion, ExecProtocolVersion)
+	}
+
+	if res.Error != "" {
+		return fmt.Errorf("plugin %s: %s", s.Command, res.Error)
+	}
+
+	if !strings.HasPrefix(res.RefTemplate, "ref+") {
+		return fmt.Errorf("plugin %s: refTemplate must start with ref+: got %q", s.Command, res.RefTemplate)
+	}
+
+	tmpl, err := template.New("ref").Option("missingkey=error").Parse(res.RefTemplate)
+	if err != nil {
+		return fmt.Errorf("plugin %s: parsing refTemplate: %w", s.Command, err)
+	}
+
+	s.Version = res.Version
+	s.refTemplate = nil
+	s.refs = map[string]string{}
+
+	// Every ref is rendered here, so that a broken template fails the save rather than producing broken refs
+	for ns, nsSecrets := range sec {
+		for name, secret := range nsSecrets {
+			for k := range secret {
+				ref, err := s.renderRef(tmpl, ns, name, k)
+				if err != nil {
+					return err
+				}
+
+				if !strings.HasPrefix(ref, "ref+") {
+					return fmt.Errorf("plugin %s: refTemplate rendered %q for %s/%s/%s, which doesn't start with ref+", s.Command, ref, ns, name, k)
+				}
+
+				s.refs[ns+"/"+name+"/"+k] = ref
+			}
+		}
+	}
+
+	s.refTemplate = tmpl
+
+	return nil
+}
+
+func (s *ExecBackend) Load(ctx context.Context, version string) (map[string]map[string]Secret, error) {
+	req := ExecRequest{
+		ProtocolVersion: ExecProtocolVersion,
+		Operation:       "load",
+		Path:            s.Path,
+		Version:         version,
+		Options:         s.Options,
+	}
+
+	var res ExecResponse
+
+	if err := s.invoke(ctx, req, &res); err != nil {
+		return nil, err
+	}
+
+	if res.ProtocolVersion != ExecProtocolVersion {
+		return nil, fmt.Errorf("plugin %s: unsupported protocol version %q: expected %q", s.Command, res.ProtocolVersion, ExecProtocolVersion)
+	}
+
+	if res.Error != "" {
+		return nil, fmt.Errorf("plugin %s: %s", s.Command, res.Error)
+	}
+
+	return res.Secrets, nil
+}
+
+func (s *ExecBackend) invoke(ctx context.Context, req ExecRequest, res *ExecResponse) error {
+	in, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, s.Command)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running plugin %s: %w", s.Command, err)
+	}
+
+	if err := json.Unmarshal(out.Bytes(), res); err != nil {
+		return fmt.Errorf("decoding response from plugin %s: %w", s.Command, err)
+	}
+
+	return nil
+}
+
+func (s *ExecBackend) Validate() error {
+	if s.Command == "" {
+		return fmt.Errorf("missing path to the plugin. Specify it like `-b exec:PATH`")
+	}
+
+	if _, err := exec.LookPath(s.Command); err != nil {
+		return fmt.Errorf("looking up plugin %s: %w", s.Command, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package fluxrepo
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExecBackendSaveLoad(t *testing.T) {
+	backend, cleanup := useTestPlugin(t, "store", "app/secrets")
+	defer cleanup()
+
+	ctx := context.Background()
+
+	sec := map[string]map[string]Secret{
+		"ns1": {"foo": {"password": "pass1", "token": "tok1"}},
+	}
+
+	if err := backend.Save(ctx, sec); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	if backend.Version != "1" {
+		t.Errorf("unexpected version: %q", backend.Version)
+	}
+
+	if got, want := backend.FormatRef("ns1", "foo", "password"), "ref+test://app/secrets?version=1#/ns1/foo/password"; got != want {
+		t.Errorf("unexpected ref: want %q, got %q", want, got)
+	}
+
+	if err := backend.Save(ctx, map[string]map[string]Secret{"ns1": {"foo": {"password": "pass2"}}}); err != nil {
+		t.Fatalf("second save: %v", err)
+	}
+
+	if got, want := backend.FormatRef("ns1", "foo", "password"), "ref+test://app/secrets?version=2#/ns1/foo/password"; got != want {
+		t.Errorf("unexpected ref after the second save: want %q, got %q", want, got)
+	}
+
+	loaded, err := backend.Load(ctx, "1")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded, sec) {
+		t.Errorf("unexpected secrets loaded: want %v, got %v", sec, loaded)
+	}
+
+	if _, err := backend.Load(ctx, "3"); err == nil {
+		t.Error("expected an error for a nonexistent version")
+	}
+}
+
+func TestExecBackendFormatRefBeforeSave(t *testing.T) {
+	backend := &ExecBackend{Command: "plugin", Path: "app/secrets"}
+
+	if got := backend.FormatRef("ns1", "foo", "password"); got != "" {
+		t.Errorf("expected no ref before save, got %q", got)
+	}
+
+	secrets := NewSecretProvider(backend)
+	secrets.Add("ns1", "foo", "password", "pass1")
+
+	if _, err := secrets.GetRef("ns1", "foo", "password"); err == nil {
+		t.Error("expected GetRef to fail before save")
+	}
+}
+
+func TestExecBackendErrors(t *testing.T) {
+	testcases := []struct {
+		mode string
+		err  string
+	}{
+		{mode: "version-mismatch", err: `unsupported protocol version "flux-repo.exec/v0"`},
+		{mode: "error", err: "the store is unavailable"},
+		{mode: "malformed", err: "decoding response from plugin"},
+		{mode: "bad-template", err: "rendering refTemplate for ns1/foo/password"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.mode, func(t *testing.T) {
+			backend, cleanup := useTestPlugin(t, tc.mode, "app/secrets")
+			defer cleanup()
+
+			err := backend.Save(context.Background(), map[string]map[string]Secret{"ns1": {"foo": {"password": "pass1"}}})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected the error to contain %q, got %q", tc.err, err.Error())
+			}
+
+			if got := backend.FormatRef("ns1", "foo", "password"); got != "" {
+				t.Errorf("expected no ref after the failed save, got %q", got)
+			}
+
+			if tc.mode == "bad-template" {
+				return
+			}
+
+			if _, err := backend.Load(context.Background(), "1"); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected load to fail with %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestExecExamplePlugin(t *testing.T) {
+	if _, err := exec.LookPath("jq"); err != nil {
+		t.Skip("the example plugin requires jq")
+	}
+
+	plugin, err := filepath.Abs(filepath.Join("..", "..", "examples", "exec", "local-file-plugin.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The refs are relative to the directory flux-repo read runs in
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	ctx := context.Background()
+
+	backend := &ExecBackend{Command: plugin, Path: "app/secrets"}
+
+	if _, err := backend.Load(ctx, ""); err == nil || !strings.Contains(err.Error(), "no secrets saved") {
+		t.Errorf("expected an error before saving anything, got %v", err)
+	}
+
+	sec1 := map[string]map[string]Secret{"ns1": {"foo": {"password": "pass1"}}}
+
+	if err := backend.Save(ctx, sec1); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	version1 := backend.Version
+
+	v, err := NewRefResolver(nil).Resolve(ctx, backend.FormatRef("ns1", "foo", "password"))
+	if err != nil {
+		t.Fatalf("resolving the ref: %v", err)
+	}
+
+	if v != "pass1" {
+		t.Errorf("unexpected value resolved from the ref: %q", v)
+	}
+
+	sec2 := map[string]map[string]Secret{"ns1": {"foo": {"password": "pass2"}}}
+
+	if err := backend.Save(ctx, sec2); err != nil {
+		t.Fatalf("second save: %v", err)
+	}
+
+	for version, want := range map[string]map[string]map[string]Secret{version1: sec1, "": sec2} {
+		loaded, err := backend.Load(ctx, version)
+		if err != nil {
+			t.Fatalf("loading version %q: %v", version, err)
+		}
+
+		if !reflect.DeepEqual(loaded, want) {
+			t.Errorf("unexpected secrets loaded from version %q: want %v, got %v", version, want, loaded)
+		}
+	}
+
+	if _, err := backend.Load(ctx, "1"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected an error for a nonexistent version, got %v", err)
+	}
+}
@@ -2,11 +2,18 @@ package fluxrepo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/variantdev/vals/pkg/awsclicompat"
 	yaml "gopkg.in/yaml.v3"
 )
@@ -16,13 +23,71 @@ type S3Backend struct {
 	Version string
 
 	AWSOptions
+	AWSResourceOptions
+
+	// ServerSideEncryption is either "aws:kms" or "AES256".
+	// Defaults to "aws:kms" when KMSKeyID is set.
+	ServerSideEncryption string
+	// BucketKeyEnabled enables S3 Bucket Keys for SSE-KMS
+	BucketKeyEnabled bool
+	// ACL is the canned ACL of the object
+	ACL string
+
+	precondition versionPrecondition
+	// etag is the ETag of the current version read by ReadCurrentVersion
+	etag string
+}
+
+func init() {
+	RegisterBackend(BackendFactory{
+		Name:        "s3",
+		Aliases:     []string{"awss3"},
+		Description: "AWS S3",
+		RefScheme:   "s3",
+		RefVersion:  "version",
+		Options: append(append(append([]BackendOption{}, awsBackendOptions...), awsResourceBackendOptions...),
+			BackendOption{Name: "s3-sse", Usage: "Server-side encryption of the S3 object. Either \"aws:kms\" or \"AES256\". Defaults to \"aws:kms\" when -aws-kms-key-id is set"},
+			BackendOption{Name: "s3-bucket-key-enabled", Usage: "Set \"true\" to use S3 Bucket Keys for SSE-KMS"},
+			BackendOption{Name: "s3-acl", Usage: "Canned ACL of the S3 object, like \"private\" or \"bucket-owner-full-control\""},
+		),
+		New: func(path string, opts BackendOptions) (SecretProviderBackend, error) {
+			resOpts, err := awsResourceOptionsFrom(opts)
+			if err != nil {
+				return nil, err
+			}
+
+			var bucketKeyEnabled bool
+
+			if v := opts.Get("s3-bucket-key-enabled"); v != "" {
+				bucketKeyEnabled, err = strconv.ParseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("parsing s3-bucket-key-enabled: %w", err)
+				}
+			}
+
+			return &S3Backend{
+				Key:                  path,
+				AWSOptions:           awsOptionsFrom(opts),
+				AWSResourceOptions:   resOpts,
+				ServerSideEncryption: opts.Get("s3-sse"),
+				BucketKeyEnabled:     bucketKeyEnabled,
+				ACL:                  opts.Get("s3-acl"),
+			}, nil
+		},
+		Validate: func(backend SecretProviderBackend) error {
+			return backend.(*S3Backend).Validate()
+		},
+	})
 }
 
 func (s *S3Backend) FormatRef(ns, name, dataKey string) string {
 	return fmt.Sprintf("ref+s3://%s?version=%s#/%s/%s/%s", s.Key, s.Version, ns, name, dataKey)
 }
 
-func (s *S3Backend) Save(sec map[string]map[string]Secret) error {
+func (s *S3Backend) Save(ctx context.Context, sec map[string]map[string]Secret) error {
+	// Cleared first, so that RevertSave after a failed Save doesn't delete the version saved before
+	s.Version = ""
+
 	m := s3.New(awsclicompat.NewSession(s.Region, s.Profile))
 
 	var buf bytes.Buffer
@@ -34,16 +99,73 @@ func (s *S3Backend) Save(sec map[string]map[string]Secret) error {
 		return err
 	}
 
-	split := strings.SplitN(s.Key, "/", 2)
-	bucket := split[0]
-	key := split[1]
+	bucket, key := s.bucketAndKey()
 
-	putObj, putErr := m.PutObject(&s3.PutObjectInput{
+	in := &s3.PutObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 		Body:   bytes.NewReader(buf.Bytes()),
-	})
-	if putErr != nil {
+	}
+
+	sse := s.ServerSideEncryption
+	if sse == "" && s.KMSKeyID != "" {
+		sse = s3.ServerSideEncryptionAwsKms
+	}
+
+	if sse != "" {
+		in.ServerSideEncryption = aws.String(sse)
+	}
+
+	if s.KMSKeyID != "" {
+		in.SSEKMSKeyId = aws.String(s.KMSKeyID)
+	}
+
+	if s.ACL != "" {
+		in.ACL = aws.String(s.ACL)
+	}
+
+	tagging := url.Values{}
+	for _, t := range s.allTags() {
+		tagging.Add(t[0], t[1])
+	}
+	in.Tagging = aws.String(tagging.Encode())
+
+	req, putObj := m.PutObjectRequest(in)
+	req.SetContext(ctx)
+
+	if s.BucketKeyEnabled {
+		// Set the header directly, as the version of aws-sdk-go in use predates S3 Bucket Keys
+		req.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("x-amz-server-side-encryption-bucket-key-enabled", "true")
+		})
+	}
+
+	precondition, etag := s.precondition, s.etag
+	s.precondition, s.etag = versionPrecondition{}, ""
+
+	if precondition.read {
+		// Set the headers directly, as the version of aws-sdk-go in use predates S3 conditional writes
+		req.Handlers.Build.PushBack(func(r *request.Request) {
+			if precondition.version == "" {
+				r.HTTPRequest.Header.Set("If-None-Match", "*")
+			} else {
+				r.HTTPRequest.Header.Set("If-Match", etag)
+			}
+		})
+	}
+
+	if putErr := req.Send(); putErr != nil {
+		if reqErr, ok := putErr.(awserr.RequestFailure); ok && precondition.read {
+			// 409 is returned when a concurrent conditional write wins the race
+			switch reqErr.StatusCode() {
+			case http.StatusPreconditionFailed, http.StatusConflict:
+				conflict := &ConflictError{Path: s.Key, Expected: precondition.version}
+				conflict.Actual, _, _ = s.currentVersion(ctx, m)
+
+				return conflict
+			}
+		}
+
 		return fmt.Errorf("putting s3 object: %w", putErr)
 	}
 
@@ -51,3 +173,160 @@ func (s *S3Backend) Save(sec map[string]map[string]Secret) error {
 
 	return nil
 }
+
+// ReadCurrentVersion reads the ETag of the latest version of the object, which the next Save sends as `If-Match`,
+// so that S3 rejects the put when another writer saved a newer version in the meantime.
+// `If-None-Match: *` is sent instead when the object doesn't exist yet.
+func (s *S3Backend) ReadCurrentVersion(ctx context.Context) error {
+	m := s3.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	version, etag, err := s.currentVersion(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	s.precondition = versionPrecondition{read: true, version: version}
+	s.etag = etag
+
+	return nil
+}
+
+// currentVersion returns the version ID and the ETag of the latest version of the object, or empty strings when there's none
+func (s *S3Backend) currentVersion(ctx context.Context, m *s3.S3) (string, string, error) {
+	bucket, key := s.bucketAndKey()
+
+	head, err := m.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+			return "", "", nil
+		}
+
+		return "", "", fmt.Errorf("getting s3 object metadata: %w", err)
+	}
+
+	version := aws.StringValue(head.VersionId)
+	if version == "" {
+		// Unversioned buckets have no version IDs
+		version = aws.StringValue(head.ETag)
+	}
+
+	return version, aws.StringValue(head.ETag), nil
+}
+
+func (s *S3Backend) Load(ctx context.Context, version string) (map[string]map[string]Secret, error) {
+	m := s3.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	bucket, key := s.bucketAndKey()
+
+	in := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	if version != "" {
+		in.VersionId = aws.String(version)
+	}
+
+	obj, err := m.GetObjectWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("getting s3 object: %w", err)
+	}
+	defer obj.Body.Close()
+
+	data, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading s3 object: %w", err)
+	}
+
+	return decodeSecrets(data)
+}
+
+func (s *S3Backend) Validate() error {
+	switch s.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAwsKms, s3.ServerSideEncryptionAes256:
+	default:
+		return fmt.Errorf("validating `-s3-sse %q`: it must be either %q or %q", s.ServerSideEncryption, s3.ServerSideEncryptionAwsKms, s3.ServerSideEncryptionAes256)
+	}
+
+	if s.ServerSideEncryption == s3.ServerSideEncryptionAes256 && (s.KMSKeyID != "" || s.BucketKeyEnabled) {
+		return fmt.Errorf("validating `-s3-sse %q`: -aws-kms-key-id and -s3-bucket-key-enabled require \"aws:kms\"", s.ServerSideEncryption)
+	}
+
+	return nil
+}
+
+func (s *S3Backend) bucketAndKey() (string, string) {
+	split := strings.SplitN(s.Key, "/", 2)
+	if len(split) != 2 {
+		return split[0], ""
+	}
+
+	return split[0], split[1]
+}
+
+func (s *S3Backend) ListVersions(ctx context.Context) ([]BackendVersion, error) {
+	m := s3.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	bucket, key := s.bucketAndKey()
+
+	var versions []BackendVersion
+
+	err := m.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	}, func(out *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range out.Versions {
+			// Prefix matches other keys sharing the prefix, too
+			if *v.Key != key {
+				continue
+			}
+
+			versions = append(versions, BackendVersion{
+				ID:      *v.VersionId,
+				Created: aws.TimeValue(v.LastModified),
+				Current: aws.BoolValue(v.IsLatest),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing s3 object versions: %w", err)
+	}
+
+	return versions, nil
+}
+
+func (s *S3Backend) DeleteVersion(ctx context.Context, version string) error {
+	m := s3.New(awsclicompat.NewSession(s.Region, s.Profile))
+
+	bucket, key := s.bucketAndKey()
+
+	_, err := m.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(key),
+		VersionId: aws.String(version),
+	})
+	if err != nil {
+		return fmt.Errorf("deleting s3 object version %s: %w", version, err)
+	}
+
+	return nil
+}
+
+// RevertSave deletes the object version created by the last Save, which makes the previous version the latest one again.
+func (s *S3Backend) RevertSave(ctx context.Context) error {
+	if s.Version == "" {
+		return nil
+	}
+
+	if err := s.DeleteVersion(ctx, s.Version); err != nil {
+		return err
+	}
+
+	s.Version = ""
+
+	return nil
+}
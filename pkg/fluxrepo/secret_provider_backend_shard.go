@@ -0,0 +1,211 @@
+package fluxrepo
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// secretShards is the result of splitting secrets across multiple backend entries,
+// so that each entry fits in the size limit of the backend.
+type secretShards struct {
+	shards []map[string]map[string]Secret
+	// paths and versions are the backend paths and version IDs of the saved shards
+	paths    []string
+	versions []string
+
+	index map[string]int
+}
+
+// shardPath returns the backend path of the i-th shard.
+// The first shard is saved at the original path, so that unsharded and sharded secrets look the same for small writes.
+func shardPath(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+
+	return fmt.Sprintf("%s-shard%d", path, i)
+}
+
+var shardPathSuffixPattern = regexp.MustCompile(`-shard[1-9][0-9]*$`)
+
+// shardBasePath returns the original path of the shard at path, which is path itself for the first shard and unsharded secrets
+func shardBasePath(path string) string {
+	return shardPathSuffixPattern.ReplaceAllString(path, "")
+}
+
+func shardKey(ns, name, dataKey string) string {
+	return ns + "/" + name + "/" + dataKey
+}
+
+// shardSecrets splits sec into shards whose encoded sizes don't exceed limit bytes.
+// Data keys are packed into shards in the sorted order, so that the same input produces the same shards.
+func shardSecrets(sec map[string]map[string]Secret, limit int) (*secretShards, error) {
+	type entry struct {
+		ns, name, key string
+	}
+
+	var entries []entry
+
+	for ns, nsSecrets := range sec {
+		for name, secret := range nsSecrets {
+			for k := range secret {
+				entries = append(entries, entry{ns: ns, name: name, key: k})
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return shardKey(entries[i].ns, entries[i].name, entries[i].key) < shardKey(entries[j].ns, entries[j].name, entries[j].key)
+	})
+
+	res := &secretShards{index: map[string]int{}}
+
+	current := map[string]map[string]Secret{}
+
+	add := func(m map[string]map[string]Secret, e entry) {
+		if _, ok := m[e.ns]; !ok {
+			m[e.ns] = map[string]Secret{}
+		}
+		if _, ok := m[e.ns][e.name]; !ok {
+			m[e.ns][e.name] = Secret{}
+		}
+		m[e.ns][e.name][e.key] = sec[e.ns][e.name][e.key]
+	}
+
+	remove := func(m map[string]map[string]Secret, e entry) {
+		delete(m[e.ns][e.name], e.key)
+		if len(m[e.ns][e.name]) == 0 {
+			delete(m[e.ns], e.name)
+		}
+		if len(m[e.ns]) == 0 {
+			delete(m, e.ns)
+		}
+	}
+
+	// estimate is an upper bound of the encoded size of current.
+	// Adding a data key grows the encoding by at most the size of the key encoded on its own, which also contains
+	// the lines of the namespace and the name shared with the other keys. So current is re-encoded only when the
+	// estimate exceeds the limit, which then becomes exact, instead of after adding every key.
+	var estimate int
+
+	for _, e := range entries {
+		single := map[string]map[string]Secret{}
+		add(single, e)
+
+		size, err := encodedSize(single)
+		if err != nil {
+			return nil, err
+		}
+
+		if size > limit {
+			return nil, fmt.Errorf("secret data %s/%s/%s is too large to be saved: it exceeds %d bytes even on its own", e.ns, e.name, e.key, limit)
+		}
+
+		add(current, e)
+
+		estimate += size
+
+		if estimate > limit {
+			estimate, err = encodedSize(current)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if estimate > limit {
+			remove(current, e)
+
+			res.shards = append(res.shards, current)
+			current = map[string]map[string]Secret{}
+
+			add(current, e)
+
+			estimate = size
+		}
+
+		res.index[shardKey(e.ns, e.name, e.key)] = len(res.shards)
+	}
+
+	res.shards = append(res.shards, current)
+
+	return res, nil
+}
+
+func encodedSize(sec map[string]map[string]Secret) (int, error) {
+	data, err := encodeSecrets(sec)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// save saves every shard with saveShard and records the resulting path and version of each shard.
+func (s *secretShards) save(path string, saveShard func(path string, data []byte) (string, error)) error {
+	s.paths = nil
+	s.versions = nil
+
+	for i, shard := range s.shards {
+		p := shardPath(path, i)
+
+		data, err := encodeSecrets(shard)
+		if err != nil {
+			return err
+		}
+
+		v, err := saveShard(p, data)
+		if err != nil {
+			return fmt.Errorf("saving shard %d to %s: %w", i, p, err)
+		}
+
+		s.paths = append(s.paths, p)
+		s.versions = append(s.versions, v)
+	}
+
+	return nil
+}
+
+// clearStaleShards empties the shards left at path by a previous save that had more shards than the last one,
+// starting from the n-th shard, so that they don't keep the secrets that were removed or moved to other shards.
+// They are overwritten with no secrets instead of being deleted, so that the refs to their previous versions
+// still work until the versions are pruned. current returns the latest data of the shard and false when it doesn't exist.
+func clearStaleShards(path string, n int, current func(path string) ([]byte, bool, error), saveShard func(path string, data []byte) (string, error)) error {
+	empty, err := encodeSecrets(map[string]map[string]Secret{})
+	if err != nil {
+		return err
+	}
+
+	for i := n; ; i++ {
+		p := shardPath(path, i)
+
+		data, ok, err := current(p)
+		if err != nil {
+			return fmt.Errorf("reading shard %d at %s: %w", i, p, err)
+		}
+
+		if !ok {
+			return nil
+		}
+
+		sec, err := decodeSecrets(data)
+		if err != nil {
+			return fmt.Errorf("reading shard %d at %s: %w", i, p, err)
+		}
+
+		if len(sec) == 0 {
+			continue
+		}
+
+		if _, err := saveShard(p, empty); err != nil {
+			return fmt.Errorf("clearing stale shard %d at %s: %w", i, p, err)
+		}
+	}
+}
+
+// lookup returns the path and version of the shard that contains the data key
+func (s *secretShards) lookup(ns, name, dataKey string) (string, string) {
+	i := s.index[shardKey(ns, name, dataKey)]
+
+	return s.paths[i], s.versions[i]
+}
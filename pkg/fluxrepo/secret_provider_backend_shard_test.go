@@ -0,0 +1,244 @@
+package fluxrepo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testShardSecrets() map[string]map[string]Secret {
+	sec := map[string]map[string]Secret{}
+
+	for i, ns := range []string{"default", "kube-system", "ns-with-a-long-name"} {
+		sec[ns] = map[string]Secret{}
+
+		for j := 0; j < 4; j++ {
+			secret := Secret{}
+
+			for k := 0; k < 5; k++ {
+				v := strings.Repeat(fmt.Sprintf("%d", k), 10*(i+j+k))
+				if k == 3 {
+					v = "multi\nline\n" + v
+				}
+
+				secret[fmt.Sprintf("key%d", k)] = v
+			}
+
+			sec[ns][fmt.Sprintf("secret%d", j)] = secret
+		}
+	}
+
+	return sec
+}
+
+// shardSecretsNaively is the reference of shardSecrets that encodes the current shard after adding every key
+func shardSecretsNaively(t *testing.T, sec map[string]map[string]Secret, limit int) []map[string]map[string]Secret {
+	t.Helper()
+
+	var keys []string
+
+	for ns, nsSecrets := range sec {
+		for name, secret := range nsSecrets {
+			for k := range secret {
+				keys = append(keys, shardKey(ns, name, k))
+			}
+		}
+	}
+
+	sort.Strings(keys)
+
+	var shards []map[string]map[string]Secret
+
+	current := map[string]map[string]Secret{}
+
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 3)
+		ns, name, k := parts[0], parts[1], parts[2]
+
+		next := map[string]map[string]Secret{}
+		for n, s := range current {
+			next[n] = map[string]Secret{}
+			for m, d := range s {
+				next[n][m] = Secret{}
+				for dk, dv := range d {
+					next[n][m][dk] = dv
+				}
+			}
+		}
+
+		if next[ns] == nil {
+			next[ns] = map[string]Secret{}
+		}
+		if next[ns][name] == nil {
+			next[ns][name] = Secret{}
+		}
+		next[ns][name][k] = sec[ns][name][k]
+
+		size, err := encodedSize(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size > limit {
+			shards = append(shards, current)
+			current = map[string]map[string]Secret{ns: {name: {k: sec[ns][name][k]}}}
+		} else {
+			current = next
+		}
+	}
+
+	return append(shards, current)
+}
+
+func TestShardSecrets(t *testing.T) {
+	sec := testShardSecrets()
+
+	total, err := encodedSize(sec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{256, 300, 512, 1000, 2048, total - 1, total} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			shards, err := shardSecrets(sec, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := shardSecretsNaively(t, sec, limit)
+
+			if !reflect.DeepEqual(shards.shards, want) {
+				t.Fatalf("unexpected shards: want %d shards, got %d", len(want), len(shards.shards))
+			}
+
+			for i, shard := range shards.shards {
+				size, err := encodedSize(shard)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if size > limit {
+					t.Errorf("shard %d is %d bytes, exceeding the limit %d", i, size, limit)
+				}
+
+				for ns, nsSecrets := range shard {
+					for name, secret := range nsSecrets {
+						for k := range secret {
+							if got := shards.index[shardKey(ns, name, k)]; got != i {
+								t.Errorf("%s/%s/%s is indexed to shard %d, but it's in shard %d", ns, name, k, got, i)
+							}
+						}
+					}
+				}
+			}
+
+			if limit == total && len(shards.shards) != 1 {
+				t.Errorf("expected a single shard at the exact size, got %d", len(shards.shards))
+			}
+
+			if limit == total-1 && len(shards.shards) != 2 {
+				t.Errorf("expected two shards one byte below the size, got %d", len(shards.shards))
+			}
+		})
+	}
+}
+
+func TestShardSecretsOversizedKey(t *testing.T) {
+	single := map[string]map[string]Secret{"default": {"foo": {"big": strings.Repeat("x", 100)}}}
+
+	size, err := encodedSize(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := shardSecrets(single, size); err != nil {
+		t.Fatalf("expected a key of the exact limit to fit: %v", err)
+	}
+
+	sec := map[string]map[string]Secret{
+		"default": {
+			"foo": {"a": "A", "big": strings.Repeat("x", 100), "c": "C"},
+		},
+	}
+
+	_, err = shardSecrets(sec, size-1)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if want := "secret data default/foo/big is too large to be saved"; !strings.Contains(err.Error(), want) {
+		t.Errorf("expected the error to contain %q, got %q", want, err.Error())
+	}
+}
+
+func TestMemoryBackendClearsStaleShards(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	backend := &memoryBackend{Path: "app"}
+
+	large := testShardSecrets()
+
+	if err := backend.Save(ctx, large); err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(backend.shards.shards)
+	if n < 3 {
+		t.Fatalf("expected the secrets to be sharded into 3 or more shards, got %d", n)
+	}
+
+	stalePath, staleVersion := backend.shards.lookup("ns-with-a-long-name", "secret3", "key4")
+	if stalePath == "app" {
+		t.Fatalf("expected the key to be in a shard other than the first one")
+	}
+
+	small := map[string]map[string]Secret{"default": {"foo": {"a": "A"}}}
+
+	if err := backend.Save(ctx, small); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < n; i++ {
+		versions := memoryStore[shardPath("app", i)]
+
+		if len(versions) != 2 {
+			t.Fatalf("expected shard %d to be cleared with a new version, got %d versions", i, len(versions))
+		}
+
+		sec, err := decodeSecrets(versions[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sec) != 0 {
+			t.Errorf("expected shard %d to be empty, got %v", i, sec)
+		}
+	}
+
+	// The previous versions are kept for the refs to them
+	stale, err := (&memoryBackend{Path: stalePath}).Load(ctx, staleVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := stale["ns-with-a-long-name"]["secret3"]["key4"], large["ns-with-a-long-name"]["secret3"]["key4"]; got != want {
+		t.Errorf("unexpected value of the stale ref: want %q, got %q", want, got)
+	}
+
+	// Shards already cleared aren't saved again
+	if err := backend.Save(ctx, small); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < n; i++ {
+		if got := len(memoryStore[shardPath("app", i)]); got != 2 {
+			t.Errorf("expected shard %d to be left as is, got %d versions", i, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package fluxrepo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/mumoshu/flux-repo/pkg/encrypt"
 	yaml "gopkg.in/yaml.v3"
@@ -18,11 +19,40 @@ type SOPSBackend struct {
 	AWSOptions
 }
 
+func init() {
+	RegisterBackend(BackendFactory{
+		Name:        "sops",
+		Description: "SOPS-encrypted file (AWS KMS)",
+		RefScheme:   "sops",
+		Options: append([]BackendOption{
+			{Name: "aws-kms-key-arn", Usage: "Comma-separated list of KMS Key ARNs to the list of master keys on the given file"},
+			{Name: "aws-kms-encryption-context", Usage: "Comma-separated list of KMS encryption context key:value pairs"},
+		}, awsBackendOptions...),
+		New: func(path string, opts BackendOptions) (SecretProviderBackend, error) {
+			return &SOPSBackend{
+				FilePath:          path,
+				KMSKeyARN:         opts.Get("aws-kms-key-arn"),
+				EncryptionContext: opts.Get("aws-kms-encryption-context"),
+				AWSOptions:        awsOptionsFrom(opts),
+			}, nil
+		},
+		Validate: func(backend SecretProviderBackend) error {
+			return backend.(*SOPSBackend).Validate()
+		},
+	})
+}
+
 func (s *SOPSBackend) FormatRef(ns, name, dataKey string) string {
 	return fmt.Sprintf("ref+sops://%s#/%s/%s/%s", s.FilePath, ns, name, dataKey)
 }
 
-func (s *SOPSBackend) Save(sec map[string]map[string]Secret) error {
+// Save encrypts the secrets into the file at FilePath.
+// The SOPS library doesn't accept a context, so ctx is checked only before the encryption starts.
+func (s *SOPSBackend) Save(ctx context.Context, sec map[string]map[string]Secret) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	var buf bytes.Buffer
 
 	enc := yaml.NewEncoder(&buf)
@@ -50,6 +80,29 @@ func (s *SOPSBackend) Save(sec map[string]map[string]Secret) error {
 	return nil
 }
 
+// Load decrypts the file at FilePath. The sops backend isn't versioned, so version is ignored.
+func (s *SOPSBackend) Load(ctx context.Context, version string) (map[string]map[string]Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	encryptedData, err := ioutil.ReadFile(s.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading file %s: %w", s.FilePath, err)
+	}
+
+	sop := &encrypt.Sops{
+		AWSProfile: s.AWSOptions.Profile,
+	}
+
+	data, err := sop.Decrypt(s.FilePath, encryptedData, "yaml")
+	if err != nil {
+		return nil, fmt.Errorf("decrypting secrets from %s: %w", s.FilePath, err)
+	}
+
+	return decodeSecrets(data)
+}
+
 func (s *SOPSBackend) Validate() error {
 	if s.KMSKeyARN == "" {
 		return fmt.Errorf("-aws-kms-key-arn must be provided when using sops backend")
@@ -1,12 +1,17 @@
 package fluxrepo
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 )
@@ -18,14 +23,47 @@ type VaultBackend struct {
 
 	Path      string
 	VersionID string
+
+	precondition versionPrecondition
+}
+
+func init() {
+	RegisterBackend(BackendFactory{
+		Name:        "vault",
+		Description: "Vault (kv v2)",
+		RefScheme:   "vault",
+		RefVersion:  "version",
+		Options: []BackendOption{
+			{Name: "vault-auth-method", Usage: "Auth method for Vault. Use \"token\" or \"approle\""},
+			{Name: "vault-address", Usage: "The address of Vault API server"},
+			{Name: "vault-token-file", Usage: "The Vault token file for authentication"},
+			{Name: "vault-token-env", Usage: "The name of envvar to obtain Vault token from", Default: "VAULT_TOKEN"},
+			{Name: "vault-approle-role-id", Usage: "Vault role_id for \"appauth\" authentication. Used only when -vault-auth-method is \"approle\""},
+			{Name: "vault-approle-secret-id", Usage: "Vault secret_id for \"appauth\" authentication. Used only when -vault-auth-method is \"approle\""},
+		},
+		New: func(path string, opts BackendOptions) (SecretProviderBackend, error) {
+			return &VaultBackend{
+				Path:       path,
+				AuthMethod: opts.Get("vault-auth-method"),
+				Address:    opts.Get("vault-address"),
+				TokenFile:  opts.Get("vault-token-file"),
+				TokenEnv:   opts.Get("vault-token-env"),
+				RoleID:     opts.Get("vault-approle-role-id"),
+				SecretID:   opts.Get("vault-approle-secret-id"),
+			}, nil
+		},
+	})
 }
 
 func (s *VaultBackend) FormatRef(ns, name, dataKey string) string {
 	return fmt.Sprintf("ref+vault://%s?version=%s#/%s/%s/%s", s.Path, s.VersionID, ns, name, dataKey)
 }
 
-func (s *VaultBackend) Save(sec map[string]map[string]Secret) error {
-	vc, err := s.createVaultClient()
+func (s *VaultBackend) Save(ctx context.Context, sec map[string]map[string]Secret) error {
+	// Cleared first, so that RevertSave after a failed Save doesn't delete the version saved before
+	s.VersionID = ""
+
+	vc, err := s.createVaultClient(ctx)
 	if err != nil {
 		return err
 	}
@@ -66,20 +104,227 @@ func (s *VaultBackend) Save(sec map[string]map[string]Secret) error {
 	}
 
 	// We need the data to be put in the "data" field for Vault kv v2
-	wrote, writeErr := vc.Logical().Write(s.Path, map[string]interface{}{"data": data})
+	body := map[string]interface{}{"data": data}
+
+	precondition := s.precondition
+	s.precondition = versionPrecondition{}
+
+	if precondition.read {
+		// cas=0 allows the write only when the secret doesn't exist yet
+		cas := precondition.version
+		if cas == "" {
+			cas = "0"
+		}
+
+		body["options"] = map[string]interface{}{"cas": json.Number(cas)}
+	}
+
+	wrote, writeErr := vaultWrite(ctx, vc, s.Path, body)
 
 	if writeErr != nil {
+		if precondition.read && strings.Contains(writeErr.Error(), "check-and-set") {
+			conflict := &ConflictError{Path: s.Path, Expected: precondition.version}
+			conflict.Actual, _ = s.currentVersion(ctx, vc)
+
+			return conflict
+		}
+
 		return writeErr
 	}
 
-	versionJson := wrote.Data["version"].(json.Number)
+	if wrote == nil {
+		return &BackendError{Op: BackendOpSave, Target: s.Path, Err: errors.New("no version returned. Make sure it's a kv v2 path")}
+	}
+
+	// The version is a json.Number as the vault client decodes responses with UseNumber
+	version, ok := wrote.Data["version"].(json.Number)
+	if !ok {
+		return &BackendError{Op: BackendOpSave, Target: s.Path, Err: fmt.Errorf("unexpected version %#v returned. Make sure it's a kv v2 path", wrote.Data["version"])}
+	}
 
-	s.VersionID = versionJson.String()
+	s.VersionID = version.String()
 
 	return nil
 }
 
-func (p *VaultBackend) createVaultClient() (*vault.Client, error) {
+// ReadCurrentVersion reads the current version of the secret, which the next Save passes as the `cas` option,
+// so that Vault rejects the write when another writer saved a newer version in the meantime.
+func (s *VaultBackend) ReadCurrentVersion(ctx context.Context) error {
+	vc, err := s.createVaultClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	version, err := s.currentVersion(ctx, vc)
+	if err != nil {
+		return err
+	}
+
+	s.precondition = versionPrecondition{read: true, version: version}
+
+	return nil
+}
+
+// currentVersion returns the current version of the secret, or an empty string when the secret doesn't exist
+func (s *VaultBackend) currentVersion(ctx context.Context, vc *vault.Client) (string, error) {
+	metadataPath, err := s.kvV2Path("metadata")
+	if err != nil {
+		return "", err
+	}
+
+	read, err := vaultRead(ctx, vc, metadataPath, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if read == nil {
+		return "", nil
+	}
+
+	current := fmt.Sprintf("%v", read.Data["current_version"])
+	if current == "0" {
+		return "", nil
+	}
+
+	return current, nil
+}
+
+func (s *VaultBackend) Load(ctx context.Context, version string) (map[string]map[string]Secret, error) {
+	vc, err := s.createVaultClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var params url.Values
+
+	if version != "" {
+		params = url.Values{"version": {version}}
+	}
+
+	read, err := vaultRead(ctx, vc, s.Path, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if read == nil {
+		return nil, fmt.Errorf("no secret found at %s", s.Path)
+	}
+
+	// The actual data is nested in the "data" field for Vault kv v2
+	data, ok := read.Data["data"]
+	if !ok || data == nil {
+		return nil, fmt.Errorf("no data found in the secret at %s version %q. It may have been deleted", s.Path, version)
+	}
+
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeSecrets(bs)
+}
+
+func (s *VaultBackend) ListVersions(ctx context.Context) ([]BackendVersion, error) {
+	metadataPath, err := s.kvV2Path("metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	vc, err := s.createVaultClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	read, err := vaultRead(ctx, vc, metadataPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if read == nil {
+		return nil, fmt.Errorf("no secret metadata found at %s", metadataPath)
+	}
+
+	current := fmt.Sprintf("%v", read.Data["current_version"])
+
+	versionsData, _ := read.Data["versions"].(map[string]interface{})
+
+	var versions []BackendVersion
+
+	for id, v := range versionsData {
+		meta, _ := v.(map[string]interface{})
+
+		// Already deleted or destroyed versions are excluded so that they are not pruned again
+		if deletionTime, _ := meta["deletion_time"].(string); deletionTime != "" {
+			continue
+		}
+		if destroyed, _ := meta["destroyed"].(bool); destroyed {
+			continue
+		}
+
+		createdTime, _ := meta["created_time"].(string)
+
+		created, err := time.Parse(time.RFC3339Nano, createdTime)
+		if err != nil {
+			return nil, fmt.Errorf("parsing created_time of version %s: %w", id, err)
+		}
+
+		versions = append(versions, BackendVersion{
+			ID:      id,
+			Created: created,
+			Current: id == current,
+		})
+	}
+
+	return versions, nil
+}
+
+// DeleteVersion soft-deletes the version so that it can still be undeleted with `vault kv undelete`.
+func (s *VaultBackend) DeleteVersion(ctx context.Context, version string) error {
+	deletePath, err := s.kvV2Path("delete")
+	if err != nil {
+		return err
+	}
+
+	vc, err := s.createVaultClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := vaultWrite(ctx, vc, deletePath, map[string]interface{}{"versions": []string{version}}); err != nil {
+		return fmt.Errorf("deleting version %s of %s: %w", version, s.Path, err)
+	}
+
+	return nil
+}
+
+// RevertSave soft-deletes the version created by the last Save.
+// kv v2 has no API to make the previous version the current one without writing yet another version,
+// so the deleted version stays as the current one until the next write.
+func (s *VaultBackend) RevertSave(ctx context.Context) error {
+	if s.VersionID == "" {
+		return nil
+	}
+
+	if err := s.DeleteVersion(ctx, s.VersionID); err != nil {
+		return err
+	}
+
+	s.VersionID = ""
+
+	return nil
+}
+
+// kvV2Path turns the data path like `foo/bar/data/baz` into another kv v2 API path like `foo/bar/metadata/baz`
+func (s *VaultBackend) kvV2Path(api string) (string, error) {
+	split := strings.SplitN(s.Path, "/data/", 2)
+	if len(split) != 2 {
+		return "", fmt.Errorf("unexpected path %q: it must contain /data/ for kv v2", s.Path)
+	}
+
+	return split[0] + "/" + api + "/" + split[1], nil
+}
+
+func (p *VaultBackend) createVaultClient(ctx context.Context) (*vault.Client, error) {
 	cfg := vault.DefaultConfig()
 	if p.Address != "" {
 		cfg.Address = p.Address
@@ -135,12 +380,12 @@ func (p *VaultBackend) createVaultClient() (*vault.Client, error) {
 			"secret_id": p.SecretID,
 		}
 
-		resp, err := cli.Logical().Write("auth/approle/login", data)
+		resp, err := vaultWrite(ctx, cli, "auth/approle/login", data)
 		if err != nil {
 			return nil, err
 		}
 
-		if resp.Auth == nil {
+		if resp == nil || resp.Auth == nil {
 			return nil, fmt.Errorf("no auth info returned")
 		}
 
@@ -149,6 +394,51 @@ func (p *VaultBackend) createVaultClient() (*vault.Client, error) {
 	return cli, nil
 }
 
+// vaultRead is the same as vc.Logical().ReadWithData, except that the request is cancelled with ctx.
+// It returns nil when nothing is found at the path.
+func vaultRead(ctx context.Context, vc *vault.Client, path string, params url.Values) (*vault.Secret, error) {
+	r := vc.NewRequest(http.MethodGet, "/v1/"+path)
+	if params != nil {
+		r.Params = params
+	}
+
+	resp, err := vc.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return vault.ParseSecret(resp.Body)
+}
+
+// vaultWrite is the same as vc.Logical().Write, except that the request is cancelled with ctx.
+// It returns nil when the response has no body.
+func vaultWrite(ctx context.Context, vc *vault.Client, path string, data map[string]interface{}) (*vault.Secret, error) {
+	r := vc.NewRequest(http.MethodPut, "/v1/"+path)
+	if err := r.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+
+	resp, err := vc.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	return vault.ParseSecret(resp.Body)
+}
+
 func (p *VaultBackend) readTokenFile(path string) (string, error) {
 	homeDir := os.Getenv("HOME")
 	if homeDir != "" {
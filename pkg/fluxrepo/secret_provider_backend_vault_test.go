@@ -0,0 +1,118 @@
+package fluxrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVaultBackendSaveVersion(t *testing.T) {
+	testcases := []struct {
+		name     string
+		response string
+		version  string
+		err      bool
+	}{
+		{name: "number", response: `{"data": {"version": 3}}`, version: "3"},
+		{name: "string", response: `{"data": {"version": "3"}}`, err: true},
+		{name: "missing", response: `{"data": {}}`, err: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut || r.URL.Path != "/v1/secret/data/app" {
+					http.NotFound(w, r)
+					return
+				}
+
+				fmt.Fprint(w, tc.response)
+			}))
+			defer server.Close()
+
+			backend := &VaultBackend{Address: server.URL, Path: "secret/data/app"}
+
+			err := NewSecretProvider(backend).save(context.Background(), backend, map[string]map[string]Secret{"ns1": {"foo": {"password": "pass1"}}})
+
+			if !tc.err {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if backend.VersionID != tc.version {
+					t.Errorf("unexpected version: want %q, got %q", tc.version, backend.VersionID)
+				}
+
+				return
+			}
+
+			var be *BackendError
+			if !errors.As(err, &be) || be.Op != BackendOpSave || be.Target != "secret/data/app" {
+				t.Fatalf("expected a BackendError for the path, got %v", err)
+			}
+
+			if want := "backend failed to save secret/data/app: unexpected version"; !strings.HasPrefix(err.Error(), want) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestVaultBackendRevertAfterFailedSave(t *testing.T) {
+	var puts int
+	var others []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/v1/secret/data/app" {
+			others = append(others, r.Method+" "+r.URL.Path)
+			fmt.Fprint(w, `{}`)
+			return
+		}
+
+		puts++
+		if puts > 1 {
+			http.Error(w, `{"errors": ["invalid request"]}`, http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprint(w, `{"data": {"version": 3}}`)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	// The backend is reused across writes, like opts.Backend of library callers
+	backend := &VaultBackend{Address: server.URL, Path: "secret/data/app"}
+
+	sec := map[string]map[string]Secret{"ns1": {"foo": {"password": "pass1"}}}
+
+	previous := NewSecretProvider(backend)
+	previous.Secrets = sec
+
+	if err := previous.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := NewSecretProvider(backend)
+	secrets.Secrets = sec
+
+	if err := secrets.Save(ctx); err == nil {
+		t.Fatal("expected the second save to fail")
+	}
+
+	if err := secrets.Revert(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(others) != 0 {
+		t.Errorf("expected the version saved before to be left alone, got requests %v", others)
+	}
+
+	if backend.VersionID != "" {
+		t.Errorf("expected the version to be cleared by the failed save, got %q", backend.VersionID)
+	}
+}
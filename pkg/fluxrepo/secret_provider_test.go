@@ -0,0 +1,55 @@
+package fluxrepo
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// failingBackend fails to save, after saving a part of the secrets when partial is true
+type failingBackend struct {
+	memoryBackend
+
+	partial  bool
+	reverted int
+}
+
+func (s *failingBackend) Save(ctx context.Context, sec map[string]map[string]Secret) error {
+	return errors.New("failed")
+}
+
+func (s *failingBackend) SavedPartially() bool {
+	return s.partial
+}
+
+func (s *failingBackend) RevertSave(ctx context.Context) error {
+	s.reverted++
+
+	return nil
+}
+
+func TestSecretProviderRevertsOnlyPartialSaves(t *testing.T) {
+	for _, partial := range []bool{false, true} {
+		backend := &failingBackend{memoryBackend: memoryBackend{Path: "app"}, partial: partial}
+
+		secrets := NewSecretProvider(backend)
+		secrets.Add("ns1", "foo", "password", "pass1")
+
+		if err := secrets.Save(context.Background()); err == nil {
+			t.Fatal("expected an error")
+		}
+
+		if err := secrets.Revert(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		want := 0
+		if partial {
+			want = 1
+		}
+
+		if backend.reverted != want {
+			t.Errorf("partial=%v: expected %d reverts, got %d", partial, want, backend.reverted)
+		}
+	}
+}
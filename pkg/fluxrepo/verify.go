@@ -0,0 +1,193 @@
+package fluxrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+type VerifyOptions struct {
+	// Resolver resolves refs to check that they exist. Defaults to the one returned by NewRefResolver(BackendOptions)
+	Resolver RefResolver
+	// BackendOptions configures the backends used by the default resolver
+	BackendOptions BackendOptions
+}
+
+// VerifyFailure is a Secret data value in a sanitized manifest that `flux-repo read` would fail to restore.
+// It never contains the secret value itself.
+type VerifyFailure struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	// Namespace and Name are the metadata of the Secret
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Key is the data key in the form of `stringData.KEY` or `data.KEY`
+	Key string `json:"key"`
+	// Ref is empty when the value isn't a ref
+	Ref     string `json:"ref,omitempty"`
+	Message string `json:"message"`
+}
+
+// Verify parses the sanitized manifests under dir and checks that every ref in Secrets is well-formed,
+// and that the referenced backend, path and version exist and contain the key.
+// It returns all the failures found. The returned error is non-nil only when the manifests can't be read.
+func Verify(ctx context.Context, dir string, opts VerifyOptions) ([]VerifyFailure, error) {
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = NewRefResolver(opts.BackendOptions)
+	}
+
+	yamlFiles, err := ReadYAMLFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for path := range yamlFiles {
+		// Skipped for consistency with `flux-repo read`
+		if filepath.Ext(path) == ".enc" {
+			continue
+		}
+
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	v := &verifier{ctx: ctx, resolver: resolver, failedLoads: map[string]error{}}
+
+	for _, path := range paths {
+		for _, doc := range documentsIn(yamlFiles[path]) {
+			if err := ctx.Err(); err != nil {
+				return v.failures, err
+			}
+
+			v.verifyDocument(path, doc)
+		}
+	}
+
+	return v.failures, nil
+}
+
+type verifier struct {
+	ctx      context.Context
+	resolver RefResolver
+	failures []VerifyFailure
+
+	// failedLoads caches the failures of loading backend secrets keyed by the ref without the fragment,
+	// so that a missing path or version is loaded and reported only once per key
+	failedLoads map[string]error
+}
+
+func (v *verifier) verifyDocument(file string, doc *yaml.Node) {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || !isSecretNode(*doc) {
+		return
+	}
+
+	root := doc.Content[0]
+
+	var ns, name string
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "metadata" {
+			m := stringMap(root.Content[i+1])
+			ns, name = m["namespace"], m["name"]
+		}
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		field, data := root.Content[i].Value, root.Content[i+1]
+
+		if field != "data" && field != "stringData" {
+			continue
+		}
+
+		for j := 0; j+1 < len(data.Content); j += 2 {
+			k, val := data.Content[j], data.Content[j+1]
+
+			f := VerifyFailure{
+				File:      file,
+				Line:      val.Line,
+				Column:    val.Column,
+				Namespace: ns,
+				Name:      name,
+				Key:       field + "." + k.Value,
+			}
+
+			if !strings.HasPrefix(val.Value, "ref+") {
+				// `data` is emitted as-is by `flux-repo read`, whereas non-ref values in stringData make it fail
+				if field == "stringData" {
+					f.Message = "value is not a ref"
+					v.failures = append(v.failures, f)
+				}
+				continue
+			}
+
+			f.Ref = val.Value
+
+			if msg := v.verifyRef(val.Value); msg != "" {
+				f.Message = msg
+				v.failures = append(v.failures, f)
+			}
+		}
+	}
+}
+
+// verifyRef returns the reason the ref can't be resolved, or an empty string when it can
+func (v *verifier) verifyRef(ref string) string {
+	u, err := url.Parse(strings.TrimPrefix(ref, "ref+"))
+	if err != nil || u.Scheme == "" || u.Host+u.Path == "" {
+		return "malformed ref: it must be in the form of ref+SCHEME://PATH"
+	}
+
+	builtin := LookupBackendByRefScheme(u.Scheme) != nil
+
+	if builtin {
+		// Refs to the built-in backends must be the ones produced by FormatRef
+		if _, err := ParseRef(ref); err != nil {
+			return fmt.Sprintf("malformed ref: %v", err)
+		}
+	}
+
+	u.Fragment = ""
+	target := u.String()
+
+	if err, ok := v.failedLoads[target]; ok {
+		return (&BackendError{Op: BackendOpLoad, Target: ref, Err: err}).Error()
+	}
+
+	if _, err := v.resolver.Resolve(v.ctx, ref); err != nil {
+		// Backend errors for refs resolved with vals can be about the missing key, which differs per ref
+		var backendErr *BackendError
+		if builtin && errors.As(err, &backendErr) && backendErr.Op == BackendOpLoad {
+			v.failedLoads[target] = backendErr.Err
+		}
+
+		return err.Error()
+	}
+
+	return ""
+}
+
+// WriteVerifyFailuresText writes the failures in the `FILE:LINE:COLUMN: NAMESPACE/NAME KEY: MESSAGE` format
+func WriteVerifyFailuresText(w io.Writer, failures []VerifyFailure) error {
+	for _, f := range failures {
+		secret := f.Name
+		if f.Namespace != "" {
+			secret = f.Namespace + "/" + f.Name
+		}
+
+		if _, err := fmt.Fprintf(w, "%s:%d:%d: %s %s: %s\n", f.File, f.Line, f.Column, secret, f.Key, f.Message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package fluxrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	ctx := context.Background()
+
+	backend := &memoryBackend{Path: "app"}
+
+	if err := backend.Save(ctx, map[string]map[string]Secret{"ns1": {"db": {"password": "pass1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"ok.yaml": secretManifest(backend, "ns1", "db", "password"),
+		"broken.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+  namespace: ns1
+data:
+  cert: Y2VydA==
+stringData:
+  password: ref+memory://app?version=1#/ns1/db/password
+  user: ref+memory://app?version=1#/ns1/db/user
+  token: ref+memory://app?version=2#/ns1/db/token
+  malformed: ref+memory://app#ns1
+  plain: plaintext1
+`,
+		"configmap.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  foo: ref+memory://missing\n",
+	})
+
+	failures, err := Verify(ctx, dir, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "broken.yaml")
+
+	type location struct {
+		File string
+		Line int
+		Key  string
+		Ref  string
+	}
+
+	var got []location
+	for _, f := range failures {
+		got = append(got, location{File: f.File, Line: f.Line, Key: f.Key, Ref: f.Ref})
+	}
+
+	want := []location{
+		{File: file, Line: 10, Key: "stringData.user", Ref: "ref+memory://app?version=1#/ns1/db/user"},
+		{File: file, Line: 11, Key: "stringData.token", Ref: "ref+memory://app?version=2#/ns1/db/token"},
+		{File: file, Line: 12, Key: "stringData.malformed", Ref: "ref+memory://app#ns1"},
+		{File: file, Line: 13, Key: "stringData.plain"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected failures:\nwant: %+v\ngot:  %+v", want, failures)
+	}
+
+	for i, msg := range []string{"user", "version", "malformed ref", "value is not a ref"} {
+		if !strings.Contains(failures[i].Message, msg) {
+			t.Errorf("expected the message of %s to contain %q, got %q", failures[i].Key, msg, failures[i].Message)
+		}
+	}
+
+	var text bytes.Buffer
+	if err := WriteVerifyFailuresText(&text, failures); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := file + ":13:10: ns1/db stringData.plain: value is not a ref\n"; !strings.HasSuffix(text.String(), want) {
+		t.Errorf("expected the text output to end with %q, got:\n%s", want, text.String())
+	}
+
+	bs, err := json.Marshal(failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither the resolved nor the plaintext values are reported
+	for _, value := range []string{"pass1", "plaintext1", "Y2VydA=="} {
+		for _, out := range []string{text.String(), string(bs)} {
+			if strings.Contains(out, value) {
+				t.Errorf("expected the output to contain no secret values, got:\n%s", out)
+			}
+		}
+	}
+}
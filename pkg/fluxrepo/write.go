@@ -1,97 +1,354 @@
 package fluxrepo
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/mumoshu/flux-repo/pkg/encrypt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	yaml "gopkg.in/yaml.v3"
 )
 
+// WriteInfo describes what Write and FilterWithSops did. It's serializable to JSON for use in CI.
 type WriteInfo struct {
-	Dir string
+	Dir string `json:"dir"`
+	// Files is the list of written files in the lexical order of the input files
+	Files []WrittenFile `json:"files"`
+	// Secrets is the list of secret data keys replaced with refs, sorted by namespace, name and key.
+	// Empty for FilterWithSops.
+	Secrets []SanitizedSecret `json:"secrets"`
+	// Warnings are problems found in the input manifests that didn't prevent them from being sanitized
+	Warnings []string `json:"warnings,omitempty"`
 }
 
+type WrittenFile struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+// SanitizedSecret is a secret data key whose value is saved in the backend and replaced with Ref
+type SanitizedSecret struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+	Ref       string `json:"ref"`
+	// Backend is the name of the backend that produced the ref, or the scheme of the ref when it's produced by a plugin
+	Backend string `json:"backend"`
+	Path    string `json:"path"`
+	// Version is the ID of the backend version created by the write. Empty for unversioned backends
+	Version string `json:"version,omitempty"`
+}
+
+func newSanitizedSecret(ns, name, key, ref string) SanitizedSecret {
+	s := SanitizedSecret{Namespace: ns, Name: name, Key: key, Ref: ref}
+
+	parsed, err := ParseRef(ref)
+	if err != nil {
+		return s
+	}
+
+	s.Backend, s.Path = parsed.Scheme, parsed.Path
+
+	versionParam := "version"
+	if f := LookupBackendByRefScheme(parsed.Scheme); f != nil {
+		s.Backend, versionParam = f.Name, f.RefVersion
+	}
+
+	if versionParam != "" {
+		s.Version = parsed.Params.Get(versionParam)
+	}
+
+	return s
+}
+
+// WriteOptions configures WriteContext.
+// One of Backend, Router and Sops must be set. They take precedence in the reverse order.
+type WriteOptions struct {
+	// Input is the manifest file or the directory containing manifests to be sanitized
+	Input string
+	// Output is the directory the sanitized manifests are written to. A temporary directory is created when empty
+	Output string
+
+	// Backend saves every secret
+	Backend SecretProviderBackend
+	// Router selects the backend for each secret
+	Router *Router
+	// Sops encrypts secrets in the manifests instead of saving them into a backend
+	Sops *encrypt.Sops
+
+	// DefaultNamespace is the namespace Secrets without metadata.namespace are saved under. Defaults to DefaultNamespace
+	DefaultNamespace string
+	// NamespaceFromKustomization makes Secrets without metadata.namespace saved under the namespace set by
+	// the nearest kustomization in the directory of the manifest or its parents up to Input.
+	// DefaultNamespace is used when there's none.
+	NamespaceFromKustomization bool
+
+	// ChecksumSalt enables ChecksumAnnotation on sanitized Secrets when non-empty.
+	// It must be kept secret and unchanged across writes, so that the checksums change only when the data changes.
+	ChecksumSalt string
+	// ChecksumWorkloads annotates the pod templates of the workloads referencing the sanitized Secrets with the checksum of their data,
+	// so that the workloads are rolled out when it changes. Requires ChecksumSalt
+	ChecksumWorkloads bool
+}
+
+// WriteContext sanitizes the manifests in opts.Input and writes them to opts.Output.
+// Cancelling ctx aborts the API calls to the secrets store.
+func WriteContext(ctx context.Context, opts WriteOptions) (*WriteInfo, error) {
+	if opts.Input == "" {
+		return nil, errors.New("writing: no input specified")
+	}
+
+	if opts.ChecksumWorkloads && opts.ChecksumSalt == "" {
+		return nil, errors.New("writing: checksum salt must be specified to annotate workloads with checksums")
+	}
+
+	if opts.Sops != nil && opts.ChecksumSalt != "" {
+		return nil, errors.New("writing: checksums aren't supported with sops")
+	}
+
+	switch {
+	case opts.Sops != nil:
+		return filterWithSops(ctx, opts.Sops, opts.Output, opts.Input)
+	case opts.Router != nil:
+		return write(ctx, NewRoutedSecretProvider(opts.Router), opts)
+	case opts.Backend != nil:
+		return write(ctx, NewSecretProvider(opts.Backend), opts)
+	}
+
+	return nil, errors.New("writing: one of backend, router and sops must be specified")
+}
+
+// FilterWithSops is the same as WriteContext with Sops set.
+//
+// Deprecated: Use WriteContext.
 func FilterWithSops(sop *encrypt.Sops, outputDir *string, fsPath *string) (*WriteInfo, error) {
+	return filterWithSops(context.Background(), sop, derefString(outputDir), derefString(fsPath))
+}
+
+func filterWithSops(ctx context.Context, sop *encrypt.Sops, outputDir, fsPath string) (*WriteInfo, error) {
 	dir, err := fallbackToTempDir(outputDir)
 	if err != nil {
 		return nil, err
 	}
 
-	yamlFiles, err := FindFiles(*fsPath)
+	yamlFiles, err := FindFiles(fsPath)
 	if err != nil {
 		return nil, err
 	}
 
+	sort.Strings(yamlFiles)
+
+	info := &WriteInfo{Dir: dir, Files: []WrittenFile{}, Secrets: []SanitizedSecret{}}
+
+	out, err := newStagedOutput(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer out.cleanup()
+
 	for _, path := range yamlFiles {
-		file, err := os.Open(path)
-		if err != nil {
-			return nil, fmt.Errorf("opening file %s: %w", file, err)
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		fileContent, err := ioutil.ReadAll(file)
+		fileContent, err := ioutil.ReadFile(path)
 		if err != nil {
 			return nil, fmt.Errorf("reading file %s: %w", path, err)
 		}
 
-		dec := yaml.NewDecoder(bytes.NewReader(fileContent))
-		type objectMeta struct {
-			Kind string `yaml:"kind"`
+		var relpath string
+		if path != fsPath {
+			relpath = strings.TrimPrefix(path, fsPath)
+		} else {
+			relpath = path
+		}
+
+		outputs, err := filterFileWithSops(sop, path, filepath.Join(dir, relpath), fileContent)
+		if err != nil {
+			return nil, err
 		}
 
-		var objMeta objectMeta
-		if err := dec.Decode(&objMeta); err != nil {
+		for _, o := range outputs {
+			if err := out.write(o.dest, o.data); err != nil {
+				return nil, err
+			}
+
+			info.Files = append(info.Files, WrittenFile{Input: path, Output: o.dest})
+		}
+	}
+
+	if err := out.commit(); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+type filteredFile struct {
+	dest string
+	data []byte
+}
+
+// filterFileWithSops encrypts every Secret contained in the file at path, including Secrets in List kinds.
+//
+// A file whose documents all contain Secrets is encrypted as a whole, so that it can be decrypted with `sops -d` as usual.
+// A file that mixes Secrets and other resources is split into one output file per document,
+// because SOPS applies the same encryption rule to every document in a file, which would either leave Secrets
+// unencrypted or encrypt e.g. ConfigMap data too.
+func filterFileWithSops(sop *encrypt.Sops, path, dest string, fileContent []byte) ([]filteredFile, error) {
+	var docs []yaml.Node
+
+	dec := yaml.NewDecoder(bytes.NewReader(fileContent))
+	for {
+		var node yaml.Node
+		if err := dec.Decode(&node); err != nil {
+			if err == io.EOF {
+				break
+			}
 			return nil, fmt.Errorf("decoding yaml file %s: %w", path, err)
 		}
 
-		var data []byte
+		if isEmptyDocument(node) {
+			continue
+		}
 
-		if objMeta.Kind != "Secret" {
-			data = fileContent
-		} else {
-			enc, err := sop.Data(path, fileContent, strings.TrimPrefix(filepath.Ext(path), "."))
+		docs = append(docs, node)
+	}
+
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+
+	var numSecrets int
+
+	for _, doc := range docs {
+		if containsSecret(doc) {
+			numSecrets++
+		}
+	}
+
+	if numSecrets == 0 {
+		return []filteredFile{{dest: dest, data: fileContent}}, nil
+	}
+
+	if numSecrets == len(docs) {
+		enc, err := sop.Data(path, fileContent, format)
+		if err != nil {
+			return nil, fmt.Errorf("encryptiong %s: %w", path, err)
+		}
+
+		return []filteredFile{{dest: dest, data: enc}}, nil
+	}
+
+	ext := filepath.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+
+	var res []filteredFile
+
+	for i, doc := range docs {
+		var buf bytes.Buffer
+
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+
+		if err := enc.Encode(&doc); err != nil {
+			return nil, fmt.Errorf("encoding document %d of %s: %w", i, path, err)
+		}
+
+		enc.Close()
+
+		data := buf.Bytes()
+
+		if containsSecret(doc) {
+			encrypted, err := sop.Data(path, data, "yaml")
 			if err != nil {
-				return nil, fmt.Errorf("encryptiong %s: %w", path, err)
+				return nil, fmt.Errorf("encryptiong document %d of %s: %w", i, path, err)
 			}
 
-			data = enc
+			data = encrypted
 		}
 
-		var relpath string
-		if path != *fsPath {
-			relpath = strings.TrimPrefix(path, *fsPath)
-		} else {
-			relpath = path
+		res = append(res, filteredFile{
+			dest: fmt.Sprintf("%s.%d%s", base, i, ext),
+			data: data,
+		})
+	}
+
+	return res, nil
+}
+
+// containsSecret returns true when the document is a Secret or a List kind containing Secrets
+func containsSecret(doc yaml.Node) bool {
+	for _, d := range documentsIn([]yaml.Node{doc}) {
+		if isSecretNode(*d) {
+			return true
 		}
+	}
 
-		dest := filepath.Join(dir, relpath)
+	return false
+}
+
+func isSecretNode(doc yaml.Node) bool {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return false
+	}
 
-		destDir := filepath.Dir(dest)
-		if err := os.MkdirAll(destDir, 0755); err != nil {
-			return nil, fmt.Errorf("creating directory %s: %w", destDir, err)
+	mappings := doc.Content[0].Content
+	for i := 0; i+1 < len(mappings); i += 2 {
+		if mappings[i].Value == "kind" && mappings[i+1].Value == "Secret" {
+			return true
 		}
+	}
+
+	return false
+}
+
+// defaultNamespaces returns the namespace of Secrets without metadata.namespace for each file
+func defaultNamespaces(yamlFiles map[string][]yaml.Node, opts WriteOptions) (map[string]string, error) {
+	namespaces := map[string]string{}
+
+	root := opts.Input
+	if info, err := os.Stat(root); err == nil && !info.IsDir() {
+		root = filepath.Dir(root)
+	}
+
+	for path := range yamlFiles {
+		namespaces[path] = opts.DefaultNamespace
 
-		if err := ioutil.WriteFile(dest, data, 0644); err != nil {
-			return nil, fmt.Errorf("writing file %s: %w", dest, err)
+		if !opts.NamespaceFromKustomization || path == "-" {
+			continue
 		}
 
+		ns, err := KustomizationNamespace(filepath.Dir(path), root)
 		if err != nil {
-			return nil, fmt.Errorf("writing file to %s: %w", dest, err)
+			return nil, err
+		}
+
+		if ns != "" {
+			namespaces[path] = ns
 		}
 	}
 
-	return &WriteInfo{Dir: dir}, nil
+	return namespaces, nil
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
 }
 
-func fallbackToTempDir(outputDir *string) (string, error) {
-	var dir string
+func fallbackToTempDir(outputDir string) (string, error) {
+	dir := outputDir
 
-	if outputDir == nil || *outputDir == "" {
+	if dir == "" {
 		tmpfile, err := ioutil.TempFile("", "flux-repo-")
 		if err != nil {
 			return "", err
@@ -100,8 +357,6 @@ func fallbackToTempDir(outputDir *string) (string, error) {
 		os.Remove(tmpfile.Name())
 
 		dir = tmpfile.Name()
-	} else {
-		dir = *outputDir
 	}
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -111,23 +366,43 @@ func fallbackToTempDir(outputDir *string) (string, error) {
 	return dir, nil
 }
 
+// Write is the same as WriteContext with Backend set.
+//
+// Deprecated: Use WriteContext.
 func Write(backend SecretProviderBackend, outputDir *string, fsPath *string) (*WriteInfo, error) {
-	dir, err := fallbackToTempDir(outputDir)
+	return write(context.Background(), NewSecretProvider(backend), WriteOptions{Output: derefString(outputDir), Input: derefString(fsPath)})
+}
+
+// WriteRouted is the same as Write, except that each secret is saved into the backend selected by the router.
+//
+// Deprecated: Use WriteContext with Router set.
+func WriteRouted(router *Router, outputDir *string, fsPath *string) (*WriteInfo, error) {
+	return write(context.Background(), NewRoutedSecretProvider(router), WriteOptions{Output: derefString(outputDir), Input: derefString(fsPath)})
+}
+
+func write(ctx context.Context, secrets *SecretProvider, opts WriteOptions) (*WriteInfo, error) {
+	fsPath := opts.Input
+
+	dir, err := fallbackToTempDir(opts.Output)
 	if err != nil {
 		return nil, err
 	}
 
-	yamlFiles, err := ReadYAMLFiles(*fsPath)
+	yamlFiles, err := ReadYAMLFiles(fsPath)
 	if err != nil {
 		return nil, err
 	}
 
-	secrets := &SecretProvider{
-		backend: backend,
-		Secrets: map[string]map[string]Secret{},
+	namespaces, err := defaultNamespaces(yamlFiles, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, nodes := range yamlFiles {
+	secrets.ChecksumSalt = opts.ChecksumSalt
+
+	for path, nodes := range yamlFiles {
+		secrets.DefaultNamespace = namespaces[path]
+
 		var res []yaml.Node
 		for _, node := range nodes {
 			// Schedule all the secrets to be stored in the secrets store
@@ -139,12 +414,88 @@ func Write(backend SecretProviderBackend, outputDir *string, fsPath *string) (*W
 		}
 	}
 
-	// Actually store all the scheduled secrets and obtain the version id
-	if err := secrets.Save(); err != nil {
+	// Read before saving, so that Save fails instead of overwriting what another writer saves in the meantime
+	if err := secrets.ReadCurrentVersions(ctx); err != nil {
 		return nil, err
 	}
 
-	for path, nodes := range yamlFiles {
+	out, err := newStagedOutput(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer out.cleanup()
+
+	// Actually store all the scheduled secrets and obtain the version id
+	if err := secrets.Save(ctx); err != nil {
+		return nil, revertOnError(secrets, err)
+	}
+
+	info, err := writeSanitized(ctx, secrets, out, yamlFiles, namespaces, opts)
+	if err != nil {
+		return nil, revertOnError(secrets, err)
+	}
+
+	return info, nil
+}
+
+// revertOnError reverts the secrets saved by the failed write, so that no backend version is left unreferenced
+func revertOnError(secrets *SecretProvider, err error) error {
+	// ctx isn't used, because the cancellation of ctx is one of the reasons to revert
+	if revertErr := secrets.Revert(context.Background()); revertErr != nil {
+		return fmt.Errorf("%w. Reverting the saved secrets failed too: %v", err, revertErr)
+	}
+
+	return err
+}
+
+// writeSanitized writes the manifests with the refs to the secrets saved by secrets.Save
+func writeSanitized(ctx context.Context, secrets *SecretProvider, out *stagedOutput, yamlFiles map[string][]yaml.Node, namespaces map[string]string, opts WriteOptions) (*WriteInfo, error) {
+	fsPath, dir := opts.Input, out.dir
+
+	// Warnings are copied to be sorted, leaving the ones of secrets in the order they were found
+	info := &WriteInfo{Dir: dir, Files: []WrittenFile{}, Secrets: []SanitizedSecret{}, Warnings: append([]string(nil), secrets.Warnings...)}
+
+	for ns, nsSecrets := range secrets.Secrets {
+		for name, sec := range nsSecrets {
+			for key := range sec {
+				ref, err := secrets.GetRef(ns, name, key)
+				if err != nil {
+					return nil, err
+				}
+
+				info.Secrets = append(info.Secrets, newSanitizedSecret(ns, name, key, ref))
+			}
+		}
+	}
+
+	sort.Strings(info.Warnings)
+
+	sort.Slice(info.Secrets, func(i, j int) bool {
+		a, b := info.Secrets[i], info.Secrets[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Key < b.Key
+	})
+
+	var paths []string
+	for path := range yamlFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		nodes := yamlFiles[path]
+
+		secrets.DefaultNamespace = namespaces[path]
+
 		var res []yaml.Node
 		for _, node := range nodes {
 			// Replace secrets' data with references
@@ -152,65 +503,194 @@ func Write(backend SecretProviderBackend, outputDir *string, fsPath *string) (*W
 			if err != nil {
 				return nil, err
 			}
+
+			if opts.ChecksumWorkloads {
+				n, err = annotateWorkload(secrets, *n)
+				if err != nil {
+					return nil, err
+				}
+			}
+
 			res = append(res, *n)
 		}
 
 		var relpath string
-		if path != *fsPath {
-			relpath = strings.TrimPrefix(path, *fsPath)
+		if path != fsPath {
+			relpath = strings.TrimPrefix(path, fsPath)
 		} else {
 			relpath = path
 		}
 
 		dest := filepath.Join(dir, relpath)
 
-		err := (func() error {
-			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-				return err
+		var buf bytes.Buffer
+
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+
+		for i, node := range res {
+			if err := encoder.Encode(&node); err != nil {
+				return nil, fmt.Errorf("encoding %s: %w", dest, err)
 			}
 
-			f, err := os.Create(dest)
-			if err != nil {
-				return err
+			if i != len(res)-1 {
+				buf.WriteString("---\n")
 			}
-			defer f.Close()
+		}
 
-			//var w io.Writer
+		encoder.Close()
 
-			// buf := &bytes.Buffer{}
-			// w = buf
-			w := bufio.NewWriter(f)
+		if err := out.write(dest, buf.Bytes()); err != nil {
+			return nil, err
+		}
 
-			encoder := yaml.NewEncoder(w)
-			encoder.SetIndent(2)
+		info.Files = append(info.Files, WrittenFile{Input: path, Output: dest})
+	}
 
-			for i, node := range res {
-				if err := encoder.Encode(&node); err != nil {
-					return err
-				}
+	if err := out.commit(); err != nil {
+		return nil, err
+	}
 
-				if i != len(res)-1 {
-					if _, err := w.Write([]byte("---\n")); err != nil {
-						return err
-					}
-				}
+	return info, nil
+}
+
+// stagedOutput stages the files to be written to dir in a temporary directory within it,
+// so that no file in dir is touched until all of them are rendered.
+//
+// Committing is atomic per file, not for the directory as a whole: each file is replaced by a rename, and the files
+// replaced so far are restored when a later one fails. A reader walking dir during the commit may see a mix of old and new files.
+type stagedOutput struct {
+	dir, staging string
+	// files are the staged files relative to dir, in the order they are staged
+	files []string
+}
+
+// stagingDirPrefix is the prefix of the name of the staging directory created within the output directory
+const stagingDirPrefix = ".flux-repo-staging-"
+
+func newStagedOutput(dir string) (*stagedOutput, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating directory %s: %w", dir, err)
+	}
+
+	// Within dir, so that the staged files can be renamed into dir within the same filesystem even when dir is a mount point
+	staging, err := ioutil.TempDir(dir, stagingDirPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("creating staging directory for %s: %w", dir, err)
+	}
+
+	return &stagedOutput{dir: dir, staging: staging}, nil
+}
+
+// write stages the file to be written to dest, which must be under dir
+func (o *stagedOutput) write(dest string, data []byte) error {
+	rel, err := filepath.Rel(o.dir, dest)
+	if err != nil {
+		return err
+	}
+
+	staged := filepath.Join(o.staging, "new", rel)
+
+	if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+		return fmt.Errorf("creating directory %s: %w", filepath.Dir(staged), err)
+	}
+
+	if err := ioutil.WriteFile(staged, data, 0644); err != nil {
+		return fmt.Errorf("writing file %s: %w", staged, err)
+	}
+
+	o.files = append(o.files, rel)
+
+	return nil
+}
+
+// commit renames the staged files into dir.
+// Each file is replaced atomically, and the files replaced so far are restored when any of them fails to be replaced.
+func (o *stagedOutput) commit() error {
+	type replaced struct {
+		dest, backup string
+	}
+
+	var done []replaced
+
+	restore := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			if done[i].backup != "" {
+				os.Rename(done[i].backup, done[i].dest)
+			} else {
+				os.Remove(done[i].dest)
 			}
+		}
+	}
+
+	for _, rel := range o.files {
+		dest := filepath.Join(o.dir, rel)
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			restore()
+			return fmt.Errorf("creating directory %s: %w", filepath.Dir(dest), err)
+		}
 
-			encoder.Close()
+		var backup string
 
-			if err := w.Flush(); err != nil {
+		if stat, err := os.Lstat(dest); err == nil {
+			backup = filepath.Join(o.staging, "old", rel)
+
+			if err := backupFile(dest, backup); err != nil {
+				restore()
 				return err
 			}
 
-			fmt.Printf("Wrote %s to %s\n", path, dest)
-
-			return nil
-		})()
+			// Replaced files keep their modes, like the ones only readable by the owner
+			if stat.Mode().IsRegular() {
+				if err := os.Chmod(filepath.Join(o.staging, "new", rel), stat.Mode().Perm()); err != nil {
+					restore()
+					return fmt.Errorf("changing mode of %s: %w", dest, err)
+				}
+			}
+		}
 
-		if err != nil {
-			return nil, err
+		if err := os.Rename(filepath.Join(o.staging, "new", rel), dest); err != nil {
+			restore()
+			return fmt.Errorf("replacing file %s: %w", dest, err)
 		}
+
+		done = append(done, replaced{dest: dest, backup: backup})
+	}
+
+	return nil
+}
+
+// backupFile makes a copy of the file at src to be restored by renaming it back.
+// A hard link keeps the original file in place until it's replaced, and the content is copied instead
+// on filesystems that don't support hard links.
+func backupFile(src, backup string) error {
+	if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+		return fmt.Errorf("creating directory %s: %w", filepath.Dir(backup), err)
+	}
+
+	if err := os.Link(src, backup); err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("backing up file %s: %w", src, err)
 	}
 
-	return &WriteInfo{Dir: dir}, nil
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("backing up file %s: %w", src, err)
+	}
+
+	if err := ioutil.WriteFile(backup, data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("backing up file %s: %w", src, err)
+	}
+
+	return nil
+}
+
+// cleanup removes the staging directory along with the files left uncommitted
+func (o *stagedOutput) cleanup() error {
+	return os.RemoveAll(o.staging)
 }
@@ -0,0 +1,352 @@
+package fluxrepo
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/flux-repo/pkg/encrypt"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// testSops encrypts with a data key that isn't encrypted with any master key, so that no KMS is needed
+func testSops() *encrypt.Sops {
+	return &encrypt.Sops{EncryptedRegex: "^(data|stringData)$"}
+}
+
+func TestFilterFileWithSopsList(t *testing.T) {
+	testcases := []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "SecretList",
+			content: `apiVersion: v1
+kind: SecretList
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: foo
+  stringData:
+    password: pass1
+`,
+		},
+		{
+			name: "List",
+			content: `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: bar
+  data:
+    config: value1
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: foo
+  stringData:
+    password: pass1
+`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			outputs, err := filterFileWithSops(testSops(), "in/list.yaml", "out/list.yaml", []byte(tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(outputs) != 1 {
+				t.Fatalf("expected one output, got %d", len(outputs))
+			}
+
+			if outputs[0].dest != "out/list.yaml" {
+				t.Errorf("unexpected dest: %s", outputs[0].dest)
+			}
+
+			data := string(outputs[0].data)
+
+			if strings.Contains(data, "pass1") || !strings.Contains(data, "ENC[") {
+				t.Errorf("expected the list to be encrypted, got:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestFilterFileWithSops(t *testing.T) {
+	secret := func(name, password string) string {
+		return "apiVersion: v1\nkind: Secret\nmetadata:\n  name: " + name + "\nstringData:\n  password: " + password + "\n"
+	}
+
+	configMap := func(name, value string) string {
+		return "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\ndata:\n  config: " + value + "\n"
+	}
+
+	testcases := []struct {
+		name    string
+		content string
+		// want is the content each output is expected to contain, keyed by the dest. Encrypted outputs are marked with ENC[
+		want map[string][]string
+	}{
+		{
+			name:    "all secrets",
+			content: secret("foo", "pass1") + "---\n---\n" + secret("bar", "pass2"),
+			want:    map[string][]string{"out/app.yaml": {"ENC["}},
+		},
+		{
+			name:    "no secrets",
+			content: configMap("foo", "value1") + "---\n" + configMap("bar", "value2"),
+			want:    map[string][]string{"out/app.yaml": {"value1", "value2"}},
+		},
+		{
+			name: "mixed",
+			// The empty document isn't counted in the numbering of the outputs
+			content: configMap("foo", "value1") + "---\n---\n" + secret("bar", "pass1") + "---\n" + configMap("baz", "value2"),
+			want: map[string][]string{
+				"out/app.0.yaml": {"value1"},
+				"out/app.1.yaml": {"ENC["},
+				"out/app.2.yaml": {"value2"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			outputs, err := filterFileWithSops(testSops(), "in/app.yaml", "out/app.yaml", []byte(tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(outputs) != len(tc.want) {
+				t.Fatalf("expected %d outputs, got %d", len(tc.want), len(outputs))
+			}
+
+			for _, o := range outputs {
+				want, ok := tc.want[o.dest]
+				if !ok {
+					t.Errorf("unexpected dest: %s", o.dest)
+					continue
+				}
+
+				data := string(o.data)
+
+				for _, w := range want {
+					if !strings.Contains(data, w) {
+						t.Errorf("expected %s to contain %q, got:\n%s", o.dest, w, data)
+					}
+				}
+
+				if strings.Contains(data, "pass1") || strings.Contains(data, "pass2") {
+					t.Errorf("expected the secrets in %s to be encrypted, got:\n%s", o.dest, data)
+				}
+			}
+
+			if tc.name == "no secrets" && string(outputs[0].data) != tc.content {
+				t.Errorf("expected the file without secrets to be written as-is, got:\n%s", outputs[0].data)
+			}
+		})
+	}
+}
+
+func TestStagedOutput(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{"a.yaml": "old a", "b/c.yaml": "old c"})
+
+	out, err := newStagedOutput(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.cleanup()
+
+	if filepath.Dir(out.staging) != dir || !strings.HasPrefix(filepath.Base(out.staging), stagingDirPrefix) {
+		t.Errorf("expected the staging directory within %s, got %s", dir, out.staging)
+	}
+
+	for name, content := range map[string]string{"a.yaml": "new a", "b/c.yaml": "new c", "d.yaml": "new d"} {
+		if err := out.write(filepath.Join(dir, name), []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := readFile(t, filepath.Join(dir, "a.yaml")); got != "old a" {
+		t.Errorf("expected no file to be touched before commit, got %q", got)
+	}
+
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := out.cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"a.yaml": "new a", "b/c.yaml": "new c", "d.yaml": "new d"} {
+		if got := readFile(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("unexpected content of %s: want %q, got %q", name, want, got)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), stagingDirPrefix) {
+			t.Errorf("expected the staging directory to be removed, found %s", e.Name())
+		}
+	}
+}
+
+func TestStagedOutputRestoresOnFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// b.yaml is a directory, which can't be replaced by the staged file
+	writeFiles(t, dir, map[string]string{"a.yaml": "old a", "b.yaml/c.yaml": "old c"})
+
+	out, err := newStagedOutput(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.cleanup()
+
+	for _, name := range []string{"a.yaml", "new.yaml", "b.yaml"} {
+		if err := out.write(filepath.Join(dir, name), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := out.commit(); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+
+	if got := readFile(t, filepath.Join(dir, "a.yaml")); got != "old a" {
+		t.Errorf("expected a.yaml to be restored, got %q", got)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "new.yaml")); !os.IsNotExist(err) {
+		t.Errorf("expected new.yaml to be removed, got %v", err)
+	}
+}
+
+func TestBackupFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{"a.yaml": "a"})
+
+	// The hard link can't be created as the backup already exists, which results in the content being copied
+	writeFiles(t, dir, map[string]string{"backup/a.yaml": "stale"})
+
+	if err := backupFile(filepath.Join(dir, "a.yaml"), filepath.Join(dir, "backup", "a.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(dir, "backup", "a.yaml")); got != "a" {
+		t.Errorf("unexpected backup: %q", got)
+	}
+}
+
+func TestWriteSanitizedSortsCopyOfWarnings(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out, err := newStagedOutput(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.cleanup()
+
+	secrets := NewSecretProvider(&memoryBackend{Path: "app"})
+	secrets.Warnings = []string{"b", "a"}
+
+	info, err := writeSanitized(context.Background(), secrets, out, map[string][]yaml.Node{}, nil, WriteOptions{Input: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"a", "b"}; !reflect.DeepEqual(info.Warnings, want) {
+		t.Errorf("unexpected warnings: want %v, got %v", want, info.Warnings)
+	}
+
+	if want := []string{"b", "a"}; !reflect.DeepEqual(secrets.Warnings, want) {
+		t.Errorf("expected the warnings of the provider to be left in the order they were found, got %v", secrets.Warnings)
+	}
+}
+
+func TestWriteInfoJSON(t *testing.T) {
+	resetMemoryStore()
+	defer resetMemoryStore()
+
+	in := tempDir(t)
+	defer os.RemoveAll(in)
+
+	out := tempDir(t)
+	defer os.RemoveAll(out)
+
+	writeFiles(t, in, map[string]string{
+		"db.yaml":  "apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\n  namespace: ns1\nstringData:\n  user: user1\n  password: pass1\n",
+		"app.yaml": "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\n  namespace: ns1\nstringData:\n  token: tok\n",
+	})
+
+	info, err := WriteContext(context.Background(), WriteOptions{Input: in, Output: out, Backend: &memoryBackend{Path: "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got interface{}
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := func(name, key string) map[string]interface{} {
+		return map[string]interface{}{
+			"namespace": "ns1",
+			"name":      name,
+			"key":       key,
+			"ref":       "ref+memory://app?version=1#/ns1/" + name + "/" + key,
+			"backend":   "memory",
+			"path":      "app",
+			"version":   "1",
+		}
+	}
+
+	file := func(name string) map[string]interface{} {
+		return map[string]interface{}{
+			"input":  filepath.Join(in, name),
+			"output": filepath.Join(out, name),
+		}
+	}
+
+	// Warnings are omitted when there's none
+	want := map[string]interface{}{
+		"dir":     out,
+		"files":   []interface{}{file("app.yaml"), file("db.yaml")},
+		"secrets": []interface{}{secret("app", "token"), secret("db", "password"), secret("db", "user")},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected JSON report:\nwant: %v\ngot:  %s", want, bs)
+	}
+
+	if strings.Contains(string(bs), "pass1") {
+		t.Errorf("expected the JSON report to contain no secret values, got %s", bs)
+	}
+}
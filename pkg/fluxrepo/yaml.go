@@ -2,10 +2,12 @@ package fluxrepo
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	yaml "gopkg.in/yaml.v3"
 )
@@ -75,3 +77,139 @@ func ReadYAMLFiles(f string) (map[string][]yaml.Node, error) {
 
 	return res, nil
 }
+
+// EncodeYAMLDocuments encodes the documents in the same format as the files written by Write.
+// Empty documents are omitted.
+func EncodeYAMLDocuments(nodes []yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+
+	for i := range nodes {
+		if isEmptyDocument(nodes[i]) {
+			continue
+		}
+
+		if err := encoder.Encode(&nodes[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SecretStringData returns the namespace, the name and the stringData mapping node of the Secret document.
+// ok is false when the document isn't a Secret or has no stringData.
+func SecretStringData(node *yaml.Node) (ns, name string, stringData *yaml.Node, ok bool) {
+	if node.Kind != yaml.DocumentNode || len(node.Content) == 0 || !isSecretNode(*node) {
+		return "", "", nil, false
+	}
+
+	mappings := node.Content[0].Content
+	for i := 0; i+1 < len(mappings); i += 2 {
+		k, v := mappings[i], mappings[i+1]
+
+		switch k.Value {
+		case "metadata":
+			m := stringMap(v)
+			ns, name = m["namespace"], m["name"]
+		case "stringData":
+			if v.Kind == yaml.MappingNode {
+				stringData = v
+			}
+		}
+	}
+
+	return ns, name, stringData, stringData != nil
+}
+
+// listItems returns the items sequence node of the document of a `List` or `*List` kind, like `SecretList`.
+// ok is false for other documents.
+func listItems(node yaml.Node) (items *yaml.Node, ok bool) {
+	if node.Kind != yaml.DocumentNode || len(node.Content) == 0 || node.Content[0].Kind != yaml.MappingNode {
+		return nil, false
+	}
+
+	m := node.Content[0]
+
+	if !strings.HasSuffix(stringMap(m)["kind"], "List") {
+		return nil, false
+	}
+
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "items" && m.Content[i+1].Kind == yaml.SequenceNode {
+			return m.Content[i+1], true
+		}
+	}
+
+	return nil, false
+}
+
+// mapListItems returns a copy of the List document whose items are replaced with the results of f.
+// Each item is passed to f wrapped in a document, so that functions for top-level documents can be used as-is.
+func mapListItems(node yaml.Node, f func(yaml.Node) (*yaml.Node, error)) (*yaml.Node, error) {
+	items, _ := listItems(node)
+
+	mapped := *items
+	mapped.Content = nil
+
+	for _, item := range items.Content {
+		n, err := f(yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{item}})
+		if err != nil {
+			return nil, err
+		}
+
+		mapped.Content = append(mapped.Content, n.Content[0])
+	}
+
+	root := *node.Content[0]
+	root.Content = nil
+
+	for i := 0; i+1 < len(node.Content[0].Content); i += 2 {
+		k, v := node.Content[0].Content[i], node.Content[0].Content[i+1]
+		if v == items {
+			v = &mapped
+		}
+
+		root.Content = append(root.Content, k, v)
+	}
+
+	res := node
+	res.Content = []*yaml.Node{&root}
+
+	return &res, nil
+}
+
+// documentsIn returns the documents followed by the items of each of them wrapped in documents when it's a List, recursively.
+// The items share nodes with the documents, so that changes made to them are reflected to the documents.
+func documentsIn(nodes []yaml.Node) []*yaml.Node {
+	var docs []*yaml.Node
+
+	for i := range nodes {
+		docs = append(docs, &nodes[i])
+
+		if items, ok := listItems(nodes[i]); ok {
+			for _, item := range items.Content {
+				docs = append(docs, documentsIn([]yaml.Node{{Kind: yaml.DocumentNode, Content: []*yaml.Node{item}}})...)
+			}
+		}
+	}
+
+	return docs
+}
+
+// isEmptyDocument returns true for a document like the one between consecutive `---` separators.
+func isEmptyDocument(node yaml.Node) bool {
+	if len(node.Content) == 0 {
+		return true
+	}
+
+	c := node.Content[0]
+
+	return len(node.Content) == 1 && c.Kind == yaml.ScalarNode && c.Tag == "!!null" && c.Value == ""
+}